@@ -0,0 +1,340 @@
+package kelthuzad
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxHistory is the number of the latest restarts kept for the status.
+const maxHistory = 100
+
+// outputLines is the number of the latest lines of the output kept for the API at least.
+const outputLines = 100
+
+// restart is a record of the restart history.
+// Its cause classifies it as regex-match, detector, plugin, sequence, probe-failure, resource-limit, exit-code, manual or scheduled.
+type restart struct {
+	Time     time.Time `json:"time"`
+	Reason   string    `json:"reason"`
+	Cause    string    `json:"cause,omitempty"`
+	Line     string    `json:"line,omitempty"`
+	Pattern  string    `json:"pattern,omitempty"`
+	Context  []string  `json:"context,omitempty"`
+	Pid      int       `json:"pid"`
+	ExitCode *int      `json:"exitCode,omitempty"`
+}
+
+// cause returns the cause of r, which is told by the reason for a record older than the causes.
+func (r restart) cause() string {
+	switch {
+	case r.Cause != "":
+		return r.Cause
+	case r.Reason == "exit":
+		return "exit-code"
+	case r.Reason == "fail":
+		return "unclassified"
+	}
+	return r.Reason
+}
+
+// status is what the status endpoint responds.
+type status struct {
+	Service  string         `json:"service"`
+	Pid      int            `json:"pid"`
+	Running  bool           `json:"running"`
+	Ready    bool           `json:"ready"`
+	Uptime   int            `json:"uptime"`
+	Restarts int            `json:"restarts"`
+	Paused   bool           `json:"paused"`
+	Breaker  string         `json:"breaker,omitempty"`
+	Budget   *budgetStatus  `json:"budget,omitempty"`
+	Probes   []probeResult  `json:"probes,omitempty"`
+	Causes   map[string]int `json:"causes,omitempty"`
+	History  []restart      `json:"history"`
+}
+
+// record keeps the restart of p for reason classified as cause in the history and the journal, and counts the cause.
+// The exit code is recorded as well if it has exited, and so are the last lines of the output if it's failed.
+func (w *Watchdog) record(p *proc, reason string, cause string, line string, pattern string) {
+	cfg := w.config()
+	w.metrics.restarted(cause)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	r := restart{
+		Time:    time.Now(),
+		Reason:  reason,
+		Cause:   cause,
+		Line:    line,
+		Pattern: pattern,
+		Pid:     p.pid,
+	}
+	if reason == "fail" {
+		r.Context = w.recent.last(cfg.ContextLines)
+	}
+	if isClosed(p.done) {
+		code := p.code
+		r.ExitCode = &code
+	}
+
+	if cfg.Journal != "" {
+		err := appendJournal(cfg.Journal, r)
+		if err != nil {
+			w.log.logf("SYSTEM", record{Level: "warn", Event: "journal"}, "journal %v", err)
+		}
+	}
+
+	w.restartLog = append(w.restartLog, r)
+	if len(w.restartLog) > maxHistory {
+		w.restartLog = w.restartLog[len(w.restartLog)-maxHistory:]
+	}
+}
+
+// status returns the current status of the watchdog.
+func (w *Watchdog) status() status {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	s := status{
+		Service:  w.name,
+		Restarts: w.restarts,
+		Paused:   w.paused,
+		Probes:   append([]probeResult{}, w.probeRes...),
+		History:  append([]restart{}, w.restartLog...),
+	}
+	// the causes of the history, which is loaded from the journal as well
+	for _, r := range s.History {
+		if s.Causes == nil {
+			s.Causes = make(map[string]int)
+		}
+		s.Causes[r.cause()]++
+	}
+	if w.breaker != nil {
+		s.Breaker = w.breaker.current(time.Now())
+	}
+	if w.budget != nil {
+		tokens, exhausted := w.budget.left(time.Now())
+		s.Budget = &budgetStatus{Max: w.budget.max, Tokens: tokens, Exhausted: exhausted}
+	}
+	if w.proc != nil {
+		s.Pid = w.proc.pid
+		s.Running = !isClosed(w.proc.done)
+		if s.Running {
+			s.Ready = w.ready == nil || !w.readyAt.IsZero()
+			s.Uptime = int(time.Since(w.spawnedAt).Seconds())
+		}
+	}
+
+	return s
+}
+
+// unhealthy returns why the process isn't healthy, which is when it isn't running or isn't ready yet,
+// or nothing if it's healthy.
+func (w *Watchdog) unhealthy() string {
+	s := w.status()
+	switch {
+	case !s.Running:
+		return "the process isn't running"
+	case !s.Ready:
+		return "the process isn't ready"
+	}
+	return ""
+}
+
+// setPaused pauses or resumes the failure detection.
+func (w *Watchdog) setPaused(paused bool) {
+	w.mu.Lock()
+	w.paused = paused
+	w.mu.Unlock()
+
+	if paused {
+		w.log.logf("SYSTEM", record{Level: "info", Event: "pause"}, "monitoring is paused")
+	} else {
+		w.log.logf("SYSTEM", record{Level: "info", Event: "resume"}, "monitoring is resumed")
+	}
+}
+
+// isPaused reports whether the failure detection is paused.
+func (w *Watchdog) isPaused() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.paused
+}
+
+// isClosed reports whether ch is closed already.
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// listen listens on addr, which is a TCP address or a Unix socket path prefixed by unix:.
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+
+	// a socket left by a crashed watchdog would block listening
+	path := strings.TrimPrefix(addr, "unix:")
+	os.Remove(path)
+	return net.Listen("unix", path)
+}
+
+// serveAPI serves the control API on ln until ctx is done.
+func (w *Watchdog) serveAPI(ctx context.Context, ln net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(w.status())
+	})
+	// the probes of the orchestrators see the health of the process, not of kelthuzad
+	for _, path := range []string{"/healthz", "/readyz"} {
+		mux.HandleFunc(path, func(rw http.ResponseWriter, r *http.Request) {
+			why := w.unhealthy()
+			if why != "" {
+				http.Error(rw, why, http.StatusServiceUnavailable)
+				return
+			}
+
+			rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprintln(rw, "ok")
+		})
+	}
+	mux.HandleFunc("/output", func(rw http.ResponseWriter, r *http.Request) {
+		n := outputLines
+		if lines := r.URL.Query().Get("lines"); lines != "" {
+			var err error
+			n, err = strconv.Atoi(lines)
+			if err != nil || n < 0 {
+				http.Error(rw, "lines must be a number", http.StatusBadRequest)
+				return
+			}
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(map[string][]string{"lines": w.recent.last(n)})
+	})
+	mux.HandleFunc("/metrics", func(rw http.ResponseWriter, r *http.Request) {
+		m := w.notifier.Load().metrics
+		if m == nil {
+			http.Error(rw, "the metrics aren't a sink", http.StatusNotFound)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.write(rw)
+	})
+	mux.HandleFunc("/restart", w.handleAction(func() {
+		w.restartManually(ctx, "the API")
+	}))
+	mux.HandleFunc("/reload", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			rw.Header().Set("Allow", http.MethodPost)
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		err := w.reload()
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(w.status())
+	})
+	mux.HandleFunc("/pause", w.handleAction(func() {
+		w.setPaused(true)
+	}))
+	mux.HandleFunc("/resume", w.handleAction(func() {
+		w.setPaused(false)
+	}))
+	mux.HandleFunc("/stop", w.handleAction(func() {
+		w.log.logf("SYSTEM", record{Level: "info", Event: "stop"}, "stopping by the API...")
+		w.stop(nil)
+	}))
+
+	srv := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	w.log.logf("SYSTEM", record{Level: "info", Event: "api"}, "serving the API on %v...", w.config().APIAddr)
+	err := srv.Serve(ln)
+	if err != http.ErrServerClosed {
+		w.stop(fmt.Errorf("kelthuzad: serveAPI: %w", err))
+	}
+}
+
+// restartManually kills and respawns the current process in the background as asked by by, and reports whether it does,
+// which it doesn't when it's being respawned already.
+func (w *Watchdog) restartManually(ctx context.Context, by string) bool {
+	p := w.current()
+	if !w.claim(p) {
+		w.log.logf("SYSTEM", record{Level: "info", Event: "manual"}, "the process is being respawned already")
+		return false
+	}
+
+	w.log.logf("SYSTEM", record{Level: "info", Event: "manual"}, "restarting by %v...", by)
+	go w.restart(ctx, p, "manual", "manual", "", "", nil)
+	return true
+}
+
+// Restart kills and respawns the current process gracefully as the API does, telling it's asked by by.
+// It's done once Run is running, and ignored while another restart is asked or going on.
+func (w *Watchdog) Restart(by string) {
+	select {
+	case w.manual <- by:
+	default:
+		w.log.logf("SYSTEM", record{Level: "info", Event: "manual"}, "a restart is asked already")
+	}
+}
+
+// restartOnRequest restarts the process asked by Restart until ctx is done.
+func (w *Watchdog) restartOnRequest(ctx context.Context) {
+	for {
+		select {
+		case by := <-w.manual:
+			w.restartManually(ctx, by)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ToggleDebug switches the level of the logs and the lines echoed to debug, or back to LogLevel, and returns the new one.
+func (w *Watchdog) ToggleDebug() string {
+	level := w.log.toggleDebug()
+	w.log.logf("SYSTEM", record{Level: "info", Event: "level"}, "the level is %v", level)
+	return level
+}
+
+// handleAction returns the handler running action on POST, which responds the status after that.
+func (w *Watchdog) handleAction(action func()) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			rw.Header().Set("Allow", http.MethodPost)
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		action()
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(rw).Encode(w.status())
+	}
+}
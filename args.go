@@ -0,0 +1,62 @@
+package kelthuzad
+
+import (
+	"errors"
+	"strings"
+)
+
+// splitArgs splits a command string into words the way a shell does.
+// Words are separated by unquoted whitespace, single quotes keep everything literally,
+// double quotes keep everything but backslash escapes, and a backslash outside quotes escapes the next rune.
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+
+	for _, r := range s {
+		switch {
+		case escaped:
+			// a backslash inside double quotes only escapes a few runes
+			if quote == '"' && r != '"' && r != '\\' && r != '$' && r != '`' {
+				word.WriteRune('\\')
+			}
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if escaped {
+		return nil, errors.New("trailing backslash in " + s)
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated quote in " + s)
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+
+	return args, nil
+}
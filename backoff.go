@@ -0,0 +1,53 @@
+package kelthuzad
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff calculates the delay before each respawn, which grows exponentially while the process keeps failing.
+type backoff struct {
+	initial    time.Duration
+	max        time.Duration
+	multiplier float64
+	resetAfter time.Duration
+	jitter     float64
+	current    time.Duration
+}
+
+// newBackoff returns the backoff configured by cfg.
+func newBackoff(cfg *Config) *backoff {
+	return &backoff{
+		initial:    time.Duration(cfg.Delay) * time.Second,
+		max:        time.Duration(cfg.MaxDelay) * time.Second,
+		multiplier: cfg.Multiplier,
+		resetAfter: time.Duration(cfg.ResetAfter) * time.Second,
+		jitter:     float64(cfg.Jitter) / 100,
+	}
+}
+
+// next returns the delay before respawning the process which has been running for uptime, which is randomized by the jitter.
+func (b *backoff) next(uptime time.Duration) time.Duration {
+	// the process was healthy long enough, so start over from the initial delay, unless it never does by 0
+	if b.current == 0 || (b.resetAfter > 0 && uptime >= b.resetAfter) {
+		b.current = b.initial
+	}
+
+	delay := b.current
+	if delay > b.max {
+		delay = b.max
+	}
+
+	// grow the delay for the next failure
+	b.current = time.Duration(float64(b.current) * b.multiplier)
+	if b.current > b.max {
+		b.current = b.max
+	}
+
+	// spread the respawns of the same processes, while the growth goes on without it
+	if b.jitter > 0 {
+		delay = (delay + time.Duration((rand.Float64()*2-1)*b.jitter*float64(delay))).Round(time.Millisecond)
+	}
+
+	return delay
+}
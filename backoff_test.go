@@ -0,0 +1,74 @@
+package kelthuzad
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBackoffNext(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        Config
+		uptimes    []time.Duration
+		wantDelays []time.Duration
+	}{
+		{
+			name:       "grows up to max",
+			cfg:        Config{Delay: 1, MaxDelay: 5, Multiplier: 2, ResetAfter: 60},
+			uptimes:    []time.Duration{0, time.Second, time.Second, time.Second, time.Second},
+			wantDelays: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second},
+		},
+		{
+			name:       "resets at exactly ResetAfter",
+			cfg:        Config{Delay: 1, MaxDelay: 60, Multiplier: 2, ResetAfter: 10},
+			uptimes:    []time.Duration{0, time.Second, 10*time.Second - time.Millisecond, 10 * time.Second},
+			wantDelays: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, time.Second},
+		},
+		{
+			name:       "never resets by 0",
+			cfg:        Config{Delay: 1, MaxDelay: 60, Multiplier: 2, ResetAfter: 0},
+			uptimes:    []time.Duration{0, 0, time.Hour, time.Hour},
+			wantDelays: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second},
+		},
+		{
+			name:       "resets after a second",
+			cfg:        Config{Delay: 1, MaxDelay: 60, Multiplier: 3, ResetAfter: 1},
+			uptimes:    []time.Duration{0, 0, time.Second, 0},
+			wantDelays: []time.Duration{time.Second, 3 * time.Second, time.Second, 3 * time.Second},
+		},
+		{
+			name:       "stays by the multiplier of 1",
+			cfg:        Config{Delay: 2, MaxDelay: 60, Multiplier: 1, ResetAfter: 60},
+			uptimes:    []time.Duration{0, 0, 0},
+			wantDelays: []time.Duration{2 * time.Second, 2 * time.Second, 2 * time.Second},
+		},
+		{
+			name:       "initial over max",
+			cfg:        Config{Delay: 10, MaxDelay: 5, Multiplier: 2, ResetAfter: 60},
+			uptimes:    []time.Duration{0, 0},
+			wantDelays: []time.Duration{5 * time.Second, 5 * time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBackoff(&tt.cfg)
+			var delays []time.Duration
+			for _, uptime := range tt.uptimes {
+				delays = append(delays, b.next(uptime))
+			}
+			if !reflect.DeepEqual(delays, tt.wantDelays) {
+				t.Errorf("next() = %v, want %v", delays, tt.wantDelays)
+			}
+		})
+	}
+}
+
+func TestBackoffNextJitter(t *testing.T) {
+	b := newBackoff(&Config{Delay: 10, MaxDelay: 10, Multiplier: 1, Jitter: 20})
+	for i := 0; i < 100; i++ {
+		if delay := b.next(0); delay < 8*time.Second || delay > 12*time.Second {
+			t.Fatalf("next() = %v, want between 8s and 12s", delay)
+		}
+	}
+}
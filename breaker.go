@@ -0,0 +1,152 @@
+package kelthuzad
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// The states of the breaker.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// breaker suppresses the restarts of the flapping process: it opens after too many restarts within the window,
+// and gets half-open after the cool-down to allow a trial restart.
+// It's closed again if the process stays up for the window after the trial, or opens again otherwise.
+type breaker struct {
+	max      int
+	window   time.Duration
+	cooldown time.Duration
+
+	mu       sync.Mutex
+	state    string
+	history  []time.Time
+	openedAt time.Time
+	trialAt  time.Time
+}
+
+// newBreaker returns the breaker configured by cfg, or nil if it's disabled.
+func newBreaker(cfg *Config) *breaker {
+	if cfg.BreakerRestarts == 0 {
+		return nil
+	}
+
+	return &breaker{
+		max:      cfg.BreakerRestarts,
+		window:   time.Duration(cfg.BreakerWindow) * time.Second,
+		cooldown: time.Duration(cfg.BreakerCooldown) * time.Second,
+		state:    breakerClosed,
+	}
+}
+
+// current returns the state at now.
+func (b *breaker) current(now time.Time) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.advance(now)
+}
+
+// advance moves on to the state at now as the time goes, and returns it.
+// b.mu must be held.
+func (b *breaker) advance(now time.Time) string {
+	switch {
+	case b.state == breakerOpen && !now.Before(b.halfOpenAt()):
+		b.state = breakerHalfOpen
+		b.trialAt = time.Time{}
+	case b.state == breakerHalfOpen && !b.trialAt.IsZero() && now.Sub(b.trialAt) >= b.window:
+		b.state = breakerClosed
+	}
+
+	return b.state
+}
+
+// halfOpenAt returns when the open breaker gets half-open.
+// b.mu must be held.
+func (b *breaker) halfOpenAt() time.Time {
+	return b.openedAt.Add(b.cooldown)
+}
+
+// allow reports whether a restart at now is allowed, and counts it if so.
+// It also reports whether the breaker has just opened, which is when to alert.
+func (b *breaker) allow(now time.Time) (bool, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.advance(now) {
+	case breakerOpen:
+		return false, false
+	case breakerHalfOpen:
+		// the trial is the only one allowed, and another restart means it's still flapping
+		if b.trialAt.IsZero() {
+			b.trialAt = now
+			return true, false
+		}
+		b.open(now)
+		return false, true
+	}
+
+	// forget the restarts which are out of the window
+	for len(b.history) > 0 && now.Sub(b.history[0]) > b.window {
+		b.history = b.history[1:]
+	}
+	if len(b.history) >= b.max {
+		b.open(now)
+		return false, true
+	}
+	b.history = append(b.history, now)
+	return true, false
+}
+
+// open opens the breaker at now.
+// b.mu must be held.
+func (b *breaker) open(now time.Time) {
+	b.state = breakerOpen
+	b.openedAt = now
+	b.history = nil
+}
+
+// until returns when the breaker gets half-open, or the zero time unless it's open at now.
+func (b *breaker) until(now time.Time) time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.advance(now) != breakerOpen {
+		return time.Time{}
+	}
+	return b.halfOpenAt()
+}
+
+// allowRestart reports whether the breaker allows restarting the process for reason,
+// which it always does for a manual or scheduled one.
+func (w *Watchdog) allowRestart(reason string) bool {
+	if w.breaker == nil || reason == "manual" || reason == "scheduled" {
+		return true
+	}
+
+	now := time.Now()
+	allowed, opened := w.breaker.allow(now)
+	switch {
+	case opened:
+		w.log.logf("SYSTEM", record{Level: "error", Event: "breaker-open"}, "restarted too often, opening the breaker until %v...", w.breaker.until(now).Format("15:04:05"))
+		w.notify("breaker-open", "", "")
+	case allowed && w.breaker.current(now) == breakerHalfOpen:
+		w.log.logf("SYSTEM", record{Level: "info", Event: "breaker-half-open"}, "the breaker is half-open, trying a restart...")
+	}
+	return allowed
+}
+
+// waitBreaker waits for the breaker to allow respawning the exited process of pid, and reports whether it wasn't interrupted by ctx.
+func (w *Watchdog) waitBreaker(ctx context.Context, pid int) bool {
+	for !w.allowRestart("exit") {
+		until := w.breaker.until(time.Now())
+		w.log.logf("SYSTEM", record{Level: "warn", Event: "breaker", Pid: pid}, "%v isn't respawned while the breaker is open, respawning it at %v", pid, until.Format("15:04:05"))
+		if !sleep(ctx, time.Until(until)) {
+			return false
+		}
+	}
+	return true
+}
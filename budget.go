@@ -0,0 +1,107 @@
+package kelthuzad
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// budget is the token bucket of the restarts whatever triggers them: it holds up to max tokens,
+// which are refilled evenly over an hour, and every restart takes one.
+type budget struct {
+	max   int
+	every time.Duration
+
+	mu        sync.Mutex
+	tokens    float64
+	at        time.Time
+	exhausted int
+}
+
+// newBudget returns the budget configured by cfg, which starts full, or nil if it's unlimited.
+func newBudget(cfg *Config) *budget {
+	if cfg.RestartBudget == 0 {
+		return nil
+	}
+
+	return &budget{
+		max:    cfg.RestartBudget,
+		every:  time.Hour / time.Duration(cfg.RestartBudget),
+		tokens: float64(cfg.RestartBudget),
+		at:     time.Now(),
+	}
+}
+
+// refill adds the tokens which have come by now.
+// b.mu must be held.
+func (b *budget) refill(now time.Time) {
+	b.tokens += float64(now.Sub(b.at)) / float64(b.every)
+	if b.tokens > float64(b.max) {
+		b.tokens = float64(b.max)
+	}
+	b.at = now
+}
+
+// take takes a token at now and reports whether there was one, which is always so if forced.
+// It returns when the next token comes otherwise, and counts the exhaustion.
+func (b *budget) take(now time.Time, forced bool) (bool, time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, time.Time{}
+	}
+	if forced {
+		return true, time.Time{}
+	}
+	b.exhausted++
+	return false, now.Add(time.Duration((1 - b.tokens) * float64(b.every)))
+}
+
+// left returns the whole tokens at now and how many times the restarts found none.
+func (b *budget) left(now time.Time) (int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	return int(b.tokens), b.exhausted
+}
+
+// spend takes a token of the budget to restart the process of pid for reason, and reports whether to go on.
+// Once it's used up, the restart waits for the next token, is dropped or gives up as BudgetExhausted tells,
+// though the exited process is always waited for, which has nothing left to keep running.
+// A manual restart takes a token if any, and is never held back.
+func (w *Watchdog) spend(ctx context.Context, pid int, reason string) bool {
+	if w.budget == nil {
+		return true
+	}
+
+	for {
+		ok, next := w.budget.take(time.Now(), reason == "manual")
+		if ok {
+			return true
+		}
+		switch {
+		case w.config().BudgetExhausted == "drop" && reason != "exit":
+			w.log.logf("SYSTEM", record{Level: "warn", Event: "budget", Pid: pid}, "%v isn't restarted since the budget of %v restarts per hour is used up", pid, w.budget.max)
+			return false
+		case w.config().BudgetExhausted == "giveUp":
+			w.giveUp(fmt.Sprintf("used up the budget of %v restarts per hour", w.budget.max))
+			return false
+		}
+		w.log.logf("SYSTEM", record{Level: "warn", Event: "budget", Pid: pid}, "the budget of %v restarts per hour is used up, restarting %v at %v", w.budget.max, pid, next.Format("15:04:05"))
+		if !sleep(ctx, time.Until(next)) {
+			return false
+		}
+	}
+}
+
+// budgetStatus is the budget in the status.
+type budgetStatus struct {
+	Max       int `json:"max"`
+	Tokens    int `json:"tokens"`
+	Exhausted int `json:"exhausted"`
+}
@@ -0,0 +1,205 @@
+//go:build linux
+
+package kelthuzad
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// cgroupDrain is how long to wait for the killed processes to leave the cgroup.
+const cgroupDrain = time.Second
+
+// cpuPeriod is the microseconds of the period of cpu.max.
+const cpuPeriod = 100000
+
+// cgroup is the cgroup v2 dedicated to the process, under which every process gets its own cgroup holding all of its descendants.
+type cgroup struct {
+	path    string
+	created bool
+	leaves  int
+	fd      int
+}
+
+// newCgroup makes the cgroup of cfg.Cgroup with its memory and CPU limits.
+// A relative path is under the mount point of cgroup v2.
+func newCgroup(cfg *Config) (*cgroup, error) {
+	path := cfg.Cgroup
+	if !filepath.IsAbs(path) {
+		root, err := cgroupRoot()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(root, path)
+	}
+
+	c := &cgroup{path: path}
+	_, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		err = os.MkdirAll(path, 0755)
+		c.created = err == nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var fs unix.Statfs_t
+	err = unix.Statfs(path, &fs)
+	if err != nil {
+		return nil, err
+	}
+	if fs.Type != unix.CGROUP2_SUPER_MAGIC {
+		c.remove()
+		return nil, fmt.Errorf("%v isn't a cgroup v2", path)
+	}
+
+	// the parent has to hand the controllers down, and the limits left by the last run go back to max
+	memory, cpu := "max", "max"
+	if cfg.CgroupMemory > 0 {
+		memory = strconv.Itoa(cfg.CgroupMemory << 20)
+	}
+	if cfg.CgroupCPU > 0 {
+		cpu = fmt.Sprintf("%v %v", cfg.CgroupCPU*cpuPeriod/100, cpuPeriod)
+	}
+	for _, l := range []struct {
+		controller string
+		file       string
+		value      string
+		set        bool
+	}{
+		{"memory", "memory.max", memory, cfg.CgroupMemory > 0},
+		{"cpu", "cpu.max", cpu, cfg.CgroupCPU > 0},
+	} {
+		if l.set {
+			err = os.WriteFile(filepath.Join(filepath.Dir(path), "cgroup.subtree_control"), []byte("+"+l.controller), 0)
+			if err != nil {
+				c.remove()
+				return nil, fmt.Errorf("enabling %v under %v: %w", l.controller, filepath.Dir(path), err)
+			}
+		} else if _, err := os.Stat(filepath.Join(path, l.file)); err != nil {
+			continue
+		}
+		err = os.WriteFile(filepath.Join(path, l.file), []byte(l.value), 0)
+		if err != nil {
+			c.remove()
+			return nil, fmt.Errorf("%v: %w", l.file, err)
+		}
+	}
+
+	return c, nil
+}
+
+// cgroupRoot returns the mount point of cgroup v2 of mountinfo.
+func cgroupRoot() (string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// the fields of the mount are followed by " - " and the type
+		mount, fs, ok := strings.Cut(scanner.Text(), " - ")
+		fields := strings.Fields(mount)
+		if ok && len(fields) >= 5 && strings.HasPrefix(fs, "cgroup2 ") {
+			return fields[4], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("cgroup v2 isn't mounted")
+}
+
+// place makes cmd start in a new cgroup under c, which is returned to call placed after starting it.
+// The cgroup is never reused, since the processes spawned into the cgroup killed once are killed by some kernels.
+func (c *cgroup) place(cmd *exec.Cmd) (*cgroup, error) {
+	c.leaves++
+	leaf := &cgroup{path: filepath.Join(c.path, fmt.Sprintf("%v-%v", os.Getpid(), c.leaves))}
+	err := os.Mkdir(leaf.path, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("kelthuzad: cgroup: %w", err)
+	}
+	leaf.created = true
+	leaf.fd, err = unix.Open(leaf.path, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		leaf.remove()
+		return nil, fmt.Errorf("kelthuzad: cgroup %v: %w", leaf.path, err)
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = leaf.fd
+
+	return leaf, nil
+}
+
+// placed releases the cgroup which the process has started in, or removes it unless started.
+func (c *cgroup) placed(started bool) {
+	unix.Close(c.fd)
+	if !started {
+		c.remove()
+	}
+}
+
+// pids returns the processes in c.
+func (c *cgroup) pids() ([]int, error) {
+	data, err := os.ReadFile(filepath.Join(c.path, "cgroup.procs"))
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, field := range strings.Fields(string(data)) {
+		pid, err := strconv.Atoi(field)
+		if err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// signal sends sig to every process in c, and returns an error if there's none.
+func (c *cgroup) signal(sig syscall.Signal) error {
+	pids, err := c.pids()
+	if err != nil {
+		return err
+	}
+	err = syscall.ESRCH
+	for _, pid := range pids {
+		if syscall.Kill(pid, sig) == nil {
+			err = nil
+		}
+	}
+	return err
+}
+
+// kill kills every process in c at once by cgroup.kill, or one by one on the kernels older than 5.14,
+// and waits for them to leave a little.
+func (c *cgroup) kill() error {
+	err := os.WriteFile(filepath.Join(c.path, "cgroup.kill"), []byte("1"), 0)
+	if errors.Is(err, os.ErrNotExist) {
+		err = c.signal(syscall.SIGKILL)
+	}
+
+	for deadline := time.Now().Add(cgroupDrain); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if pids, _ := c.pids(); len(pids) == 0 {
+			break
+		}
+	}
+	return err
+}
+
+// remove removes c if kelthuzad made it, which must be empty.
+// The cgroup of a process is removed once it's gone.
+func (c *cgroup) remove() {
+	if c.created {
+		os.Remove(c.path)
+	}
+}
@@ -0,0 +1,33 @@
+//go:build !linux
+
+package kelthuzad
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+)
+
+// cgroup isn't supported on the other systems.
+type cgroup struct{}
+
+// newCgroup returns an error, since cgroup v2 is only on Linux.
+func newCgroup(cfg *Config) (*cgroup, error) {
+	return nil, errors.New("cgroup v2 is only supported on Linux")
+}
+
+func (c *cgroup) place(cmd *exec.Cmd) (*cgroup, error) {
+	return nil, nil
+}
+
+func (c *cgroup) placed(started bool) {}
+
+func (c *cgroup) signal(sig syscall.Signal) error {
+	return nil
+}
+
+func (c *cgroup) kill() error {
+	return nil
+}
+
+func (c *cgroup) remove() {}
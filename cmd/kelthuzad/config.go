@@ -0,0 +1,47 @@
+package main
+
+import (
+	"github.com/codacy-badger/kelthuzad"
+	"github.com/jessevdk/go-flags"
+	"gopkg.in/yaml.v2"
+	"os"
+	"reflect"
+)
+
+// loadConfig reads the YAML config file of path into cfg.
+// The options given on the command line are put back afterwards, so they override the values of the file.
+func loadConfig(parser *flags.Parser, path string, cfg *kelthuzad.Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// keep what the command line says before the file overwrites it
+	given := *cfg
+	err = yaml.UnmarshalStrict(data, cfg)
+	if err != nil {
+		return err
+	}
+
+	fields := reflect.TypeOf(*cfg)
+	from := reflect.ValueOf(&given).Elem()
+	to := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < fields.NumField(); i++ {
+		long := fields.Field(i).Tag.Get("long")
+		if long == "" {
+			continue
+		}
+
+		option := parser.FindOptionByLongName(long)
+		if option != nil && option.IsSet() && !option.IsSetDefault() {
+			to.Field(i).Set(from.Field(i))
+		}
+	}
+
+	// the trailing arguments aren't an option, so they win whenever they're given
+	if len(given.Args.Rest) > 0 {
+		cfg.Args = given.Args
+	}
+
+	return nil
+}
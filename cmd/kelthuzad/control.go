@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jessevdk/go-flags"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// controlOptions are the options of the subcommands talking to the running kelthuzad.
+type controlOptions struct {
+	APIAddr string `long:"apiAddr" description:"The address of the control API of the running kelthuzad, which is host:port or unix:/path/to/socket" env:"KELTHUZAD_API_ADDR" required:"yes"`
+}
+
+// parseControl parses args of the subcommand name.
+func parseControl(name string, args []string) (*controlOptions, error) {
+	opt := &controlOptions{}
+	parser := flags.NewParser(opt, flags.Default)
+	parser.Usage = name + " [OPTIONS]"
+	_, err := parser.ParseArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	return opt, nil
+}
+
+// call requests method of path to the control API on addr, and decodes what it responds, which is the status mostly, into v.
+func call(addr string, method string, path string, v interface{}) error {
+	// the API can be on a Unix socket, which needs its own dialer
+	client := &http.Client{Timeout: 10 * time.Second}
+	url := "http://" + addr + path
+	if socket := strings.TrimPrefix(addr, "unix:"); socket != addr {
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		}
+		url = "http://kelthuzad" + path
+	}
+
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("the API responded %v %v", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// runStop stops the running kelthuzad gracefully along with the process.
+func runStop(args []string) error {
+	opt, err := parseControl("stop", args)
+	if err != nil {
+		return err
+	}
+
+	var s status
+	err = call(opt.APIAddr, http.MethodPost, "/stop", &s)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stdout, "stopping...")
+	return nil
+}
+
+// runRestartChild kills and respawns the process of the running kelthuzad.
+func runRestartChild(args []string) error {
+	opt, err := parseControl("restart-child", args)
+	if err != nil {
+		return err
+	}
+
+	var s status
+	err = call(opt.APIAddr, http.MethodPost, "/restart", &s)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stdout, "restarting %v...\n", s.Pid)
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"github.com/codacy-badger/kelthuzad"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// runCoordinator runs the coordinator of opt until it's interrupted or terminated, in the background with --daemon.
+func runCoordinator(opt *options) error {
+	if opt.Daemon && !daemonized() {
+		pid, err := daemonize()
+		if err != nil {
+			return err
+		}
+		log.Printf("[SYSTEM] running in the background as %v, logging to %v\n", pid, opt.LogFile)
+		return nil
+	}
+	if opt.LogFile != "" {
+		log.SetOutput(&lumberjack.Logger{
+			Filename:   opt.LogFile,
+			MaxSize:    opt.LogMaxSize,
+			MaxBackups: opt.LogMaxBackups,
+			Compress:   opt.LogCompress,
+		})
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return kelthuzad.NewCoordinator(opt.Coordinator, opt.CoordToken, opt.LogFormat).Run(ctx)
+}
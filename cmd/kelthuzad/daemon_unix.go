@@ -0,0 +1,46 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// daemonEnv marks kelthuzad started again in the background, which mustn't start another one.
+const daemonEnv = "KELTHUZAD_DAEMONIZED"
+
+// daemonized reports whether kelthuzad is the one started in the background.
+func daemonized() bool {
+	return os.Getenv(daemonEnv) == "1"
+}
+
+// daemonize starts kelthuzad again with the same arguments in a new session without the terminal, and returns its pid.
+func daemonize() (int, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer null.Close()
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdin = null
+	cmd.Stdout = null
+	cmd.Stderr = null
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	if err != nil {
+		return 0, err
+	}
+
+	// nobody waits for it, and it's adopted by init once this one exits
+	pid := cmd.Process.Pid
+	cmd.Process.Release()
+	return pid, nil
+}
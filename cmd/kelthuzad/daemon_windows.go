@@ -0,0 +1,15 @@
+//go:build windows
+
+package main
+
+import "errors"
+
+// daemonized reports false, since Windows has no daemon but a service.
+func daemonized() bool {
+	return false
+}
+
+// daemonize returns an error, since Windows has no session to detach from the terminal.
+func daemonize() (int, error) {
+	return 0, errors.New("--daemon isn't supported on Windows")
+}
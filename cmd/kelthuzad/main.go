@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/codacy-badger/kelthuzad"
+	"github.com/jessevdk/go-flags"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// options are the command line options, which are the config of the watchdog and the path of its config file.
+type options struct {
+	ConfigPath    string `long:"config" description:"The path of a YAML config file, whose values are overridden by the options"`
+	ForwardHUP    bool   `long:"forwardHup" description:"Forward SIGHUP to the process instead of reloading the config"`
+	ForwardUSR    bool   `long:"forwardUsr" description:"Forward SIGUSR1 and SIGUSR2 to the process instead of restarting it and toggling the debug level"`
+	GiveUpCode    int    `long:"giveUpCode" description:"The exit code of kelthuzad when it gives up respawning" default:"1"`
+	Daemon        bool   `long:"daemon" description:"Run in the background detached from the terminal, logging to logFile (not on Windows)"`
+	LogFile       string `long:"logFile" description:"The path of the file to write the log of kelthuzad to instead of stderr"`
+	LogMaxSize    int    `long:"logMaxSize" description:"The megabytes of the log file to rotate it" default:"100"`
+	LogMaxBackups int    `long:"logMaxBackups" description:"The number of the rotated log files to keep, 0 means all" default:"0"`
+	LogCompress   bool   `long:"logCompress" description:"Compress the rotated log files by gzip"`
+	Coordinator   string `long:"coordinator" description:"Run as the coordinator of the agents joining it on the address, which is host:port or unix:/path/to/socket, instead of the watchdog"`
+	CoordToken    string `long:"coordinatorToken" description:"The bearer token which the agents and the clients of the coordinator must have" env:"KELTHUZAD_COORDINATOR_TOKEN"`
+
+	kelthuzad.Config
+}
+
+// subcommands are run by the first argument instead of the watchdog, which is run by run or without any of them.
+var subcommands = map[string]func(args []string) error{
+	"status":          runStatus,
+	"stop":            runStop,
+	"restart-child":   runRestartChild,
+	"validate-config": runValidate,
+	"test":            runTest,
+	"report":          runReport,
+	"top":             runTop,
+}
+
+// parseOptions parses args and fills the options which aren't given with the config file.
+func parseOptions(args []string) (*options, error) {
+	// initialize empty options
+	opt := &options{}
+
+	// parse the arguments
+	parser := flags.NewParser(opt, flags.Default)
+	parser.Usage = "[run] [OPTIONS]"
+	_, err := parser.ParseArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	// fill the options which aren't given with the config file
+	if opt.ConfigPath != "" {
+		err = loadConfig(parser, opt.ConfigPath, &opt.Config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return opt, nil
+}
+
+// reloader returns the function parsing args and the config file again.
+func reloader(args []string) func() (*kelthuzad.Config, error) {
+	return func() (*kelthuzad.Config, error) {
+		opt, err := parseOptions(args)
+		if err != nil {
+			return nil, err
+		}
+
+		return &opt.Config, nil
+	}
+}
+
+// runValidate checks the options and the config file as run does, without running anything.
+func runValidate(args []string) error {
+	opt, err := parseOptions(args)
+	if err != nil {
+		return err
+	}
+	if opt.Daemon && opt.LogFile == "" {
+		return errors.New("--daemon needs --logFile, since nobody sees stderr")
+	}
+	_, err = kelthuzad.New(&opt.Config)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stdout, "the config is valid")
+	return nil
+}
+
+func main() {
+	// the subcommands ask the running one or check the config instead of running another
+	args := os.Args[1:]
+	if len(args) > 0 {
+		if run, ok := subcommands[args[0]]; ok {
+			err := run(args[1:])
+			if err != nil {
+				var flagsErr *flags.Error
+				if !errors.As(err, &flagsErr) {
+					fmt.Fprintln(os.Stderr, err)
+				}
+				os.Exit(1)
+			}
+			return
+		}
+		if args[0] == "run" {
+			args = args[1:]
+		}
+	}
+
+	// set the log flags
+	log.SetFlags(log.Ltime | log.LstdFlags)
+
+	opt, err := parseOptions(args)
+	if err != nil {
+		// go-flags has told what's wrong with the arguments already
+		var flagsErr *flags.Error
+		if errors.As(err, &flagsErr) {
+			os.Exit(1)
+		}
+		log.Fatalln("[FATAL] loadConfig", err)
+	}
+	if opt.Daemon && opt.LogFile == "" {
+		log.Fatalln("[FATAL] --daemon needs --logFile, since nobody sees stderr")
+	}
+	opt.Reloader = reloader(args)
+
+	// the coordinator spawns nothing, so it needs no command
+	if opt.Coordinator != "" {
+		err = runCoordinator(opt)
+		if err != nil {
+			log.Fatalln("[FATAL]", err)
+		}
+		return
+	}
+
+	// get a watchdog object
+	w, err := kelthuzad.New(&opt.Config)
+	if err != nil {
+		log.Fatalln("[FATAL]", err)
+	}
+
+	// the config is fine, so leave the rest to the one in the background
+	if opt.Daemon && !daemonized() {
+		pid, err := daemonize()
+		if err != nil {
+			log.Fatalln("[FATAL] daemonize", err)
+		}
+		log.Printf("[SYSTEM] running in the background as %v, logging to %v\n", pid, opt.LogFile)
+		return
+	}
+	if opt.LogFile != "" {
+		log.SetOutput(&lumberjack.Logger{
+			Filename:   opt.LogFile,
+			MaxSize:    opt.LogMaxSize,
+			MaxBackups: opt.LogMaxBackups,
+			Compress:   opt.LogCompress,
+		})
+	}
+
+	// handle an interrupt or a termination for terminate children process and itself gracefully
+	ctx, cancel := context.WithCancel(context.Background())
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signalChan
+		// the JSON logs must not be mixed with a text line
+		if opt.LogFormat != "json" {
+			log.Printf("[SYSTEM] recieved %v, stopping...\n\n", sig)
+		}
+		cancel()
+	}()
+
+	// forward the signals for the process to it, such as SIGUSR1 to reopen its logs
+	forwardChan := make(chan os.Signal, 1)
+	var signals []os.Signal
+	if opt.ForwardUSR {
+		signals = append(signals, usrSignals...)
+	}
+	if opt.ForwardHUP {
+		signals = append(signals, syscall.SIGHUP)
+	}
+	if len(signals) > 0 {
+		signal.Notify(forwardChan, signals...)
+	}
+	go func() {
+		for sig := range forwardChan {
+			err := w.Signal(sig)
+			if err != nil {
+				log.Println("[SYSTEM] forward", sig, err)
+			}
+		}
+	}()
+
+	// restart the process gracefully by SIGUSR1 and toggle the debug level by SIGUSR2, unless they're forwarded
+	usrChan := make(chan os.Signal, 1)
+	if !opt.ForwardUSR && len(usrSignals) > 0 {
+		signal.Notify(usrChan, usrSignals...)
+	}
+	go func() {
+		for sig := range usrChan {
+			if sig == usrSignals[0] {
+				w.Restart("SIGUSR1")
+			} else {
+				w.ToggleDebug()
+			}
+		}
+	}()
+
+	// reload the config whenever it hangs up, unless it's forwarded
+	hupChan := make(chan os.Signal, 1)
+	if !opt.ForwardHUP {
+		signal.Notify(hupChan, syscall.SIGHUP)
+	}
+	go func() {
+		for range hupChan {
+			cfg, err := opt.Reloader()
+			if err == nil {
+				err = w.Reload(cfg)
+			}
+			if err != nil {
+				log.Println("[SYSTEM] reload", err)
+			}
+		}
+	}()
+
+	// start monitoring
+	err = w.Run(ctx)
+	if errors.Is(err, kelthuzad.ErrGiveUp) {
+		os.Exit(opt.GiveUpCode)
+	}
+	if err != nil {
+		log.Fatalln("[FATAL]", err)
+	}
+
+	// exit as the last process did, which is 143 if it was stopped by SIGTERM
+	if code := w.ExitCode(); code > 0 {
+		os.Exit(code)
+	}
+}
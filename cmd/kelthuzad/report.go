@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/jessevdk/go-flags"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// reportOptions are the options of the report subcommand.
+type reportOptions struct {
+	Journal string `long:"journal" description:"The path of the journal of the restarts to summarize" required:"yes"`
+	Since   int    `long:"since" description:"The hours back from now to summarize, 0 means the whole journal" default:"0"`
+	By      string `long:"by" description:"The period to count the causes by" choice:"hour" choice:"day" choice:"week" default:"day"`
+}
+
+// journaled is a restart of the journal.
+type journaled struct {
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"`
+	Cause  string    `json:"cause"`
+	Line   string    `json:"line"`
+}
+
+// cause returns the cause of r, which is told by the reason for a record older than the causes.
+func (r journaled) cause() string {
+	switch {
+	case r.Cause != "":
+		return r.Cause
+	case r.Reason == "exit":
+		return "exit-code"
+	case r.Reason == "fail":
+		return "unclassified"
+	}
+	return r.Reason
+}
+
+// periodFormats are the layouts of the periods which the causes are counted by, where a week is told by its Monday.
+var periodFormats = map[string]string{"hour": "2006-01-02 15:00", "day": "2006-01-02", "week": "2006-01-02"}
+
+// runReport summarizes the causes of the restarts in the journal, in total and by the period.
+func runReport(args []string) error {
+	opt := &reportOptions{}
+	parser := flags.NewParser(opt, flags.Default)
+	parser.Usage = "report [OPTIONS]"
+	_, err := parser.ParseArgs(args)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(opt.Journal)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var since time.Time
+	if opt.Since > 0 {
+		since = time.Now().Add(-time.Duration(opt.Since) * time.Hour)
+	}
+	var history []journaled
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r journaled
+		// a line broken by a crash in the middle of writing is skipped
+		if json.Unmarshal(scanner.Bytes(), &r) != nil || r.Time.Before(since) {
+			continue
+		}
+		history = append(history, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(history) == 0 {
+		fmt.Fprintln(os.Stdout, "no restarts")
+		return nil
+	}
+
+	totals := make(map[string]int)
+	last := make(map[string]journaled)
+	var periods []string
+	byPeriod := make(map[string]map[string]int)
+	for _, r := range history {
+		cause := r.cause()
+		totals[cause]++
+		last[cause] = r
+
+		period := periodOf(r.Time.Local(), opt.By)
+		if byPeriod[period] == nil {
+			byPeriod[period] = make(map[string]int)
+			periods = append(periods, period)
+		}
+		byPeriod[period][cause]++
+	}
+
+	first, latest := history[0].Time.Local(), history[len(history)-1].Time.Local()
+	fmt.Fprintf(os.Stdout, "%v restarts from %v to %v\n", len(history), first.Format(time.RFC3339), latest.Format(time.RFC3339))
+	for _, cause := range byCount(totals) {
+		r := last[cause]
+		summary := fmt.Sprintf("last at %v", r.Time.Local().Format(time.RFC3339))
+		if r.Line != "" {
+			summary += ": " + strings.SplitN(r.Line, "\n", 2)[0]
+		}
+		fmt.Fprintf(os.Stdout, "  %-16v %5v %4.0f%%  %v\n", cause, totals[cause], float64(totals[cause])*100/float64(len(history)), summary)
+	}
+
+	fmt.Fprintf(os.Stdout, "by %v:\n", opt.By)
+	for _, period := range periods {
+		var counts []string
+		for _, cause := range byCount(byPeriod[period]) {
+			counts = append(counts, fmt.Sprintf("%v %v", cause, byPeriod[period][cause]))
+		}
+		fmt.Fprintf(os.Stdout, "  %v  %v\n", period, strings.Join(counts, ", "))
+	}
+
+	return nil
+}
+
+// periodOf returns the period of by which t is in.
+func periodOf(t time.Time, by string) string {
+	if by == "week" {
+		t = t.AddDate(0, 0, -(int(t.Weekday())+6)%7)
+	}
+	return t.Format(periodFormats[by])
+}
+
+// byCount returns the causes of counts from the most counted, and by the name on a tie.
+func byCount(counts map[string]int) []string {
+	var causes []string
+	for cause := range counts {
+		causes = append(causes, cause)
+	}
+	sort.Slice(causes, func(i, j int) bool {
+		if counts[causes[i]] != counts[causes[j]] {
+			return counts[causes[i]] > counts[causes[j]]
+		}
+		return causes[i] < causes[j]
+	})
+	return causes
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// usrSignals are SIGUSR1 and SIGUSR2, which restart the process and toggle the debug level unless they're forwarded to it.
+var usrSignals = []os.Signal{syscall.SIGUSR1, syscall.SIGUSR2}
@@ -0,0 +1,8 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// usrSignals are SIGUSR1 and SIGUSR2, which Windows doesn't have.
+var usrSignals []os.Signal
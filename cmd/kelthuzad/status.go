@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// status is what the status endpoint responds.
+type status struct {
+	Service  string `json:"service"`
+	Pid      int    `json:"pid"`
+	Running  bool   `json:"running"`
+	Ready    bool   `json:"ready"`
+	Uptime   int    `json:"uptime"`
+	Restarts int    `json:"restarts"`
+	Paused   bool   `json:"paused"`
+	Breaker  string `json:"breaker"`
+	Budget   *struct {
+		Max       int `json:"max"`
+		Tokens    int `json:"tokens"`
+		Exhausted int `json:"exhausted"`
+	} `json:"budget"`
+	Probes []struct {
+		Probe    string    `json:"probe"`
+		Healthy  bool      `json:"healthy"`
+		Failures int       `json:"failures"`
+		Error    string    `json:"error"`
+		Time     time.Time `json:"time"`
+	} `json:"probes"`
+	History []struct {
+		Time     time.Time `json:"time"`
+		Reason   string    `json:"reason"`
+		Cause    string    `json:"cause"`
+		Line     string    `json:"line"`
+		Pattern  string    `json:"pattern"`
+		Pid      int       `json:"pid"`
+		ExitCode *int      `json:"exitCode"`
+	} `json:"history"`
+}
+
+// runStatus prints the status of the running kelthuzad, which is queried by its control API.
+func runStatus(args []string) error {
+	opt, err := parseControl("status", args)
+	if err != nil {
+		return err
+	}
+
+	var s status
+	err = call(opt.APIAddr, http.MethodGet, "/status", &s)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stdout, "pid:      %v\n", s.Pid)
+	fmt.Fprintf(os.Stdout, "running:  %v\n", s.Running)
+	fmt.Fprintf(os.Stdout, "ready:    %v\n", s.Ready)
+	fmt.Fprintf(os.Stdout, "paused:   %v\n", s.Paused)
+	fmt.Fprintf(os.Stdout, "uptime:   %v\n", time.Duration(s.Uptime)*time.Second)
+	fmt.Fprintf(os.Stdout, "restarts: %v\n", s.Restarts)
+	if s.Breaker != "" {
+		fmt.Fprintf(os.Stdout, "breaker:  %v\n", s.Breaker)
+	}
+	if s.Budget != nil {
+		fmt.Fprintf(os.Stdout, "budget:   %v of %v restarts left, used up %v times\n", s.Budget.Tokens, s.Budget.Max, s.Budget.Exhausted)
+	}
+	for _, p := range s.Probes {
+		result := "healthy"
+		if !p.Healthy {
+			result = fmt.Sprintf("failed %v times in a row: %v", p.Failures, p.Error)
+		}
+		fmt.Fprintf(os.Stdout, "probe:    %v %v at %v\n", p.Probe, result, p.Time.Local().Format(time.RFC3339))
+	}
+	if len(s.History) > 0 {
+		last := s.History[len(s.History)-1]
+		reason := last.Reason
+		if last.Cause != "" {
+			reason += " by " + last.Cause
+		}
+		if last.Line != "" {
+			reason += ": " + last.Line
+		}
+		if last.ExitCode != nil {
+			reason += fmt.Sprintf(" (exit code %v)", *last.ExitCode)
+		}
+		fmt.Fprintf(os.Stdout, "last:     %v at %v\n", reason, last.Time.Local().Format(time.RFC3339))
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"github.com/codacy-badger/kelthuzad"
+	"github.com/jessevdk/go-flags"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// testOptions are the options of the test subcommand, which are the ones of run with the sample.
+type testOptions struct {
+	SampleFile string `long:"sampleFile" description:"The path of the file to replay the lines of, or - for stdin" required:"yes"`
+
+	options
+}
+
+// runTest replays the sample through the detection, and prints the lines which matched and would have triggered a restart.
+func runTest(args []string) error {
+	opt := &testOptions{}
+	parser := flags.NewParser(opt, flags.Default)
+	parser.Usage = "test [OPTIONS]"
+	_, err := parser.ParseArgs(args)
+	if err != nil {
+		return err
+	}
+	if opt.ConfigPath != "" {
+		err = loadConfig(parser, opt.ConfigPath, &opt.Config)
+		if err != nil {
+			return err
+		}
+	}
+
+	var sample io.Reader = os.Stdin
+	if opt.SampleFile != "-" {
+		f, err := os.Open(opt.SampleFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		sample = f
+	}
+
+	var matched, restarts int
+	lines, err := kelthuzad.Replay(&opt.Config, sample, func(v kelthuzad.Verdict) {
+		matched++
+		// a multiline match is indented under its number, and a Go plugin fails it without counting
+		text := strings.ReplaceAll(v.Line, "\n", "\n    ")
+		var verdict string
+		if v.Matches > 0 {
+			verdict = fmt.Sprintf(" (%v/%v)", v.Matches, opt.FailThreshold)
+		}
+		if v.Failed {
+			restarts++
+			verdict += ", would restart"
+		}
+		fmt.Fprintf(os.Stdout, "%v: %v -> %v%v%v\n", v.Number, text, v.Pattern, verdict, formatCaptures(v.Captures))
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stdout, "%v of %v lines matched, which would have triggered %v restarts\n", matched, lines, restarts)
+	return nil
+}
+
+// formatCaptures formats captures sorted by the names, or nothing if there's none.
+func formatCaptures(captures map[string]string) string {
+	if len(captures) == 0 {
+		return ""
+	}
+
+	var names []string
+	for name := range captures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		pairs = append(pairs, name+"="+captures[name])
+	}
+	return " [" + strings.Join(pairs, " ") + "]"
+}
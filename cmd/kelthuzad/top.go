@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jessevdk/go-flags"
+	"golang.org/x/term"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// topOptions are the options of the top subcommand.
+type topOptions struct {
+	APIAddrs []string `long:"apiAddr" description:"The address of the control API of a running kelthuzad, which is named as name=address, or by its process otherwise (repeatable)" env:"KELTHUZAD_API_ADDR" env-delim:"," required:"yes"`
+	Interval int      `long:"interval" description:"The seconds between the refreshes" default:"1"`
+}
+
+// service is a running kelthuzad shown by top.
+type service struct {
+	name   string
+	addr   string
+	status status
+	output []string
+	err    error
+}
+
+// refresh gets the status of s, and the latest lines of its output as well unless lines is 0.
+func (s *service) refresh(lines int) {
+	var st status
+	s.err = call(s.addr, http.MethodGet, "/status", &st)
+	if s.err != nil {
+		return
+	}
+	s.status = st
+	if lines == 0 {
+		return
+	}
+
+	var output struct {
+		Lines []string `json:"lines"`
+	}
+	s.err = call(s.addr, http.MethodGet, fmt.Sprintf("/output?lines=%v", lines), &output)
+	s.output = output.Lines
+}
+
+// title returns the name of s, which is the one of its process unless it's given.
+func (s *service) title() string {
+	switch {
+	case s.name != "":
+		return s.name
+	case s.status.Service != "":
+		return s.status.Service
+	}
+	return s.addr
+}
+
+// state summarizes the status of s in a word.
+func (s *service) state() string {
+	switch {
+	case s.err != nil:
+		return "unreachable"
+	case s.status.Paused:
+		return "paused"
+	case s.status.Breaker == "open":
+		return "breaker-open"
+	case s.status.Running && s.status.Ready:
+		return "ready"
+	case s.status.Running:
+		return "starting"
+	}
+	return "down"
+}
+
+// runTop shows the services on the terminal until q is pressed, refreshing them every interval.
+// The selected one is restarted by r, and paused or resumed by p.
+func runTop(args []string) error {
+	opt := &topOptions{}
+	parser := flags.NewParser(opt, flags.Default)
+	parser.Usage = "top [OPTIONS]"
+	_, err := parser.ParseArgs(args)
+	if err != nil {
+		return err
+	}
+	if opt.Interval <= 0 {
+		return errors.New("--interval must be positive")
+	}
+
+	var services []*service
+	for _, spec := range opt.APIAddrs {
+		// neither host:port nor unix:/path has =
+		name, addr, ok := strings.Cut(spec, "=")
+		if !ok {
+			name, addr = "", spec
+		}
+		services = append(services, &service{name: name, addr: addr})
+	}
+
+	in := int(os.Stdin.Fd())
+	if !term.IsTerminal(in) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		return errors.New("top needs a terminal")
+	}
+	state, err := term.MakeRaw(in)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(in, state)
+	// draw on the alternate screen without the cursor, which are back as they were on quitting
+	fmt.Fprint(os.Stdout, "\x1b[?1049h\x1b[?25l")
+	defer fmt.Fprint(os.Stdout, "\x1b[?25h\x1b[?1049l")
+
+	keys := make(chan string)
+	go readKeys(keys)
+	ticker := time.NewTicker(time.Duration(opt.Interval) * time.Second)
+	defer ticker.Stop()
+
+	selected, message := 0, ""
+	for {
+		width, height, err := term.GetSize(int(os.Stdout.Fd()))
+		if err != nil {
+			width, height = 80, 24
+		}
+		// the output fills what's left below the table
+		lines := height - len(services) - 6
+		if lines < 0 {
+			lines = 0
+		}
+		refresh(services, selected, lines)
+		draw(services, selected, message, width, lines)
+
+		select {
+		case <-ticker.C:
+			continue
+		case key, ok := <-keys:
+			if !ok {
+				return nil
+			}
+			s := services[selected]
+			switch key {
+			case "q", "\x03":
+				return nil
+			case "up", "k":
+				selected = (selected + len(services) - 1) % len(services)
+			case "down", "j", "\t":
+				selected = (selected + 1) % len(services)
+			case "r":
+				message = act(s, "/restart", "restarting")
+			case "p":
+				if s.status.Paused {
+					message = act(s, "/resume", "resuming")
+				} else {
+					message = act(s, "/pause", "pausing")
+				}
+			}
+		}
+	}
+}
+
+// readKeys sends the keys pressed to keys, where the arrows are up and down, until stdin is closed.
+// The keys typed quickly come in a read together.
+func readKeys(keys chan<- string) {
+	defer close(keys)
+
+	buf := make([]byte, 64)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		for in := string(buf[:n]); in != ""; {
+			key := in[:1]
+			if len(in) >= 3 && (strings.HasPrefix(in, "\x1b[") || strings.HasPrefix(in, "\x1bO")) {
+				key = in[:3]
+			}
+			in = in[len(key):]
+
+			switch key {
+			case "\x1b[A", "\x1bOA":
+				keys <- "up"
+			case "\x1b[B", "\x1bOB":
+				keys <- "down"
+			default:
+				keys <- key
+			}
+		}
+	}
+}
+
+// refresh refreshes the services side by side, where only the selected one gets its output of lines.
+func refresh(services []*service, selected int, lines int) {
+	var wg sync.WaitGroup
+	for i, s := range services {
+		n := 0
+		if i == selected {
+			n = lines
+		}
+		wg.Add(1)
+		go func(s *service, n int) {
+			defer wg.Done()
+			s.refresh(n)
+		}(s, n)
+	}
+	wg.Wait()
+}
+
+// act posts path to the API of s, and returns the message telling what it does.
+func act(s *service, path string, doing string) string {
+	var st status
+	err := call(s.addr, http.MethodPost, path, &st)
+	if err != nil {
+		return fmt.Sprintf("%v %v", s.title(), err)
+	}
+	return fmt.Sprintf("%v %v...", doing, s.title())
+}
+
+// draw draws the table of the services and the output of the selected one within width, followed by message.
+func draw(services []*service, selected int, message string, width int, lines int) {
+	screen := []string{
+		"kelthuzad top: up/down to select, r to restart, p to pause or resume, q to quit",
+		"",
+		fmt.Sprintf("  %-20v %-12v %8v %10v %8v  %v", "SERVICE", "STATE", "PID", "UPTIME", "RESTARTS", "LAST"),
+	}
+	for i, s := range services {
+		marker := " "
+		if i == selected {
+			marker = ">"
+		}
+		last := ""
+		if s.err != nil {
+			last = s.err.Error()
+		} else if n := len(s.status.History); n > 0 {
+			r := s.status.History[n-1]
+			last = r.Reason
+			if r.Cause != "" {
+				last = r.Cause
+			}
+			last += fmt.Sprintf(" %v ago", time.Since(r.Time).Round(time.Second))
+		}
+		uptime := time.Duration(s.status.Uptime) * time.Second
+		screen = append(screen, fmt.Sprintf("%v %-20v %-12v %8v %10v %8v  %v", marker, s.title(), s.state(), s.status.Pid, uptime, s.status.Restarts, last))
+	}
+
+	screen = append(screen, "", "output of "+services[selected].title()+":")
+	output := services[selected].output
+	if len(output) > lines {
+		output = output[len(output)-lines:]
+	}
+	screen = append(screen, output...)
+	for len(screen) < len(services)+5+lines {
+		screen = append(screen, "")
+	}
+	screen = append(screen, message)
+
+	for i, line := range screen {
+		screen[i] = fit(line, width)
+	}
+	// the raw terminal needs the carriage returns
+	fmt.Fprint(os.Stdout, "\x1b[H\x1b[2J"+strings.Join(screen, "\r\n"))
+}
+
+// fit cuts line to width, replacing the tabs and dropping the other control characters, which would break the screen.
+func fit(line string, width int) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range strings.ReplaceAll(line, "\t", "    ") {
+		if unicode.IsControl(r) {
+			continue
+		}
+		if n == width {
+			break
+		}
+		b.WriteRune(r)
+		n++
+	}
+	return b.String()
+}
@@ -0,0 +1,296 @@
+package kelthuzad
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// staleReports is the number of the reports missed for an agent to be down.
+const staleReports = 3
+
+// report is what an agent reports to the coordinator every join interval.
+type report struct {
+	ID        string   `json:"id"`
+	Service   string   `json:"service"`
+	Host      string   `json:"host"`
+	Interval  int      `json:"interval"`
+	Status    status   `json:"status"`
+	Metrics   string   `json:"metrics"`
+	DependsOn []string `json:"dependsOn,omitempty"`
+	Group     string   `json:"group,omitempty"`
+}
+
+// reply is what the coordinator replies to a report, which are the actions queued for the agent.
+type reply struct {
+	Actions []string `json:"actions"`
+}
+
+// agent is the latest report of an agent known by the coordinator, and the actions queued for it.
+type agent struct {
+	report
+	seen    time.Time
+	pending []string
+	// handled is the restarts of the agent which the dependencies are ordered for already
+	handled int
+}
+
+// up reports whether a has reported within the staleReports.
+func (a *agent) up(now time.Time) bool {
+	return now.Sub(a.seen) < time.Duration(staleReports*a.Interval)*time.Second
+}
+
+// agentStatus is an agent in the status of the coordinator.
+type agentStatus struct {
+	ID        string    `json:"id"`
+	Service   string    `json:"service"`
+	Host      string    `json:"host"`
+	Up        bool      `json:"up"`
+	Seen      time.Time `json:"seen"`
+	Status    status    `json:"status"`
+	DependsOn []string  `json:"dependsOn,omitempty"`
+	Group     string    `json:"group,omitempty"`
+}
+
+// agentActions are the actions which the coordinator forwards to an agent.
+var agentActions = map[string]bool{"restart": true, "pause": true, "resume": true, "stop": true}
+
+// Coordinator aggregates the agents joining it, and serves their status, metrics and actions on one API.
+type Coordinator struct {
+	addr  string
+	token string
+	log   *logger
+
+	mu     sync.Mutex
+	agents map[string]*agent
+	wave   wave
+}
+
+// NewCoordinator returns the coordinator serving on addr, which is host:port or unix:/path/to/socket,
+// and requires token of the agents and the clients unless it's empty.
+func NewCoordinator(addr string, token string, logFormat string) *Coordinator {
+	return &Coordinator{addr: addr, token: token, log: newLogger(logFormat), agents: make(map[string]*agent)}
+}
+
+// Run serves the API of the coordinator until ctx is done.
+func (c *Coordinator) Run(ctx context.Context) error {
+	ln, err := listen(c.addr)
+	if err != nil {
+		return fmt.Errorf("kelthuzad: listenCoordinator: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/report", c.handleReport)
+	mux.HandleFunc("/status", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(map[string][]agentStatus{"agents": c.status()})
+	})
+	mux.HandleFunc("/metrics", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		c.writeMetrics(rw)
+	})
+	mux.HandleFunc("/agents/", c.handleAction)
+
+	srv := &http.Server{Handler: c.authorize(mux)}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	c.log.logf("SYSTEM", record{Level: "info", Event: "api"}, "serving the coordinator on %v...", c.addr)
+	err = srv.Serve(ln)
+	if err != http.ErrServerClosed {
+		return fmt.Errorf("kelthuzad: serveCoordinator: %w", err)
+	}
+	return nil
+}
+
+// authorize requires the bearer token of the coordinator for every request unless it's empty.
+func (c *Coordinator) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if c.token != "" && r.Header.Get("Authorization") != "Bearer "+c.token {
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// handleReport keeps the report of an agent, and replies the actions queued for it.
+func (c *Coordinator) handleReport(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var rep report
+	err := json.NewDecoder(r.Body).Decode(&rep)
+	if err != nil || rep.ID == "" || rep.Interval <= 0 {
+		http.Error(rw, "the report must be JSON with the id and the interval", http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	a, known := c.agents[rep.ID]
+	if !known {
+		a = &agent{}
+		c.agents[rep.ID] = a
+	}
+	back := known && !a.up(time.Now())
+	if !known || rep.Status.Restarts < a.handled {
+		// the restarts before it's joined, or before it's come back as another process, are not ordered
+		a.handled = rep.Status.Restarts
+	}
+	a.report, a.seen = rep, time.Now()
+	c.order(a, time.Now())
+	actions := a.pending
+	a.pending = nil
+	c.mu.Unlock()
+
+	switch {
+	case !known:
+		c.log.logf("SYSTEM", record{Level: "info", Event: "join"}, "%v has joined", rep.ID)
+	case back:
+		c.log.logf("SYSTEM", record{Level: "info", Event: "join"}, "%v is back", rep.ID)
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(reply{Actions: actions})
+}
+
+// handleAction queues the action of /agents/<id>/<action> for the agent, which takes it on its next report.
+func (c *Coordinator) handleAction(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/agents/")
+	i := strings.LastIndex(path, "/")
+	if i < 0 || !agentActions[path[i+1:]] {
+		http.Error(rw, "the action must be restart, pause, resume or stop", http.StatusNotFound)
+		return
+	}
+	id, action := path[:i], path[i+1:]
+
+	c.mu.Lock()
+	a, ok := c.agents[id]
+	if ok {
+		a.pending = append(a.pending, action)
+	}
+	c.mu.Unlock()
+	if !ok {
+		http.Error(rw, "unknown agent "+id, http.StatusNotFound)
+		return
+	}
+
+	c.log.logf("SYSTEM", record{Level: "info", Event: action}, "%v is queued for %v", action, id)
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+// agentsNow returns the copies of the agents ordered by the id.
+func (c *Coordinator) agentsNow() []agent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var agents []agent
+	for _, a := range c.agents {
+		agents = append(agents, *a)
+	}
+	sort.Slice(agents, func(i, j int) bool {
+		return agents[i].ID < agents[j].ID
+	})
+	return agents
+}
+
+// status returns the status of every agent.
+func (c *Coordinator) status() []agentStatus {
+	now := time.Now()
+	agents := []agentStatus{}
+	for _, a := range c.agentsNow() {
+		agents = append(agents, agentStatus{ID: a.ID, Service: a.Service, Host: a.Host, Up: a.up(now), Seen: a.seen, Status: a.Status, DependsOn: a.DependsOn, Group: a.Group})
+	}
+	return agents
+}
+
+// family is a metric of the agents, whose samples are grouped together as the text format of Prometheus needs.
+type family struct {
+	help    string
+	typ     string
+	samples []string
+}
+
+// writeMetrics writes the metrics of every agent to out, each sample labeled by the agent,
+// followed by whether each agent is up.
+func (c *Coordinator) writeMetrics(out io.Writer) {
+	var names []string
+	families := make(map[string]*family)
+	familyOf := func(name string) *family {
+		f, ok := families[name]
+		if !ok {
+			f = &family{}
+			families[name] = f
+			names = append(names, name)
+		}
+		return f
+	}
+
+	now := time.Now()
+	agents := c.agentsNow()
+	for _, a := range agents {
+		label := fmt.Sprintf("agent=\"%v\"", labelEscaper.Replace(a.ID))
+		for _, line := range strings.Split(a.Metrics, "\n") {
+			if strings.HasPrefix(line, "# ") {
+				fields := strings.SplitN(line, " ", 4)
+				if len(fields) < 4 {
+					continue
+				}
+				f := familyOf(fields[2])
+				switch {
+				case fields[1] == "HELP" && f.help == "":
+					f.help = line
+				case fields[1] == "TYPE" && f.typ == "":
+					f.typ = line
+				}
+				continue
+			}
+
+			// name{labels} value or name value
+			i := strings.IndexAny(line, "{ ")
+			if i <= 0 {
+				continue
+			}
+			name, rest := line[:i], line[i:]
+			if strings.HasPrefix(rest, "{") {
+				rest = "{" + label + "," + rest[1:]
+			} else {
+				rest = "{" + label + "}" + rest
+			}
+			f := familyOf(name)
+			f.samples = append(f.samples, name+rest)
+		}
+	}
+
+	for _, name := range names {
+		f := families[name]
+		for _, line := range append([]string{f.help, f.typ}, f.samples...) {
+			if line != "" {
+				fmt.Fprintln(out, line)
+			}
+		}
+	}
+	fmt.Fprintln(out, "# HELP kelthuzad_agent_up Whether the agent has reported lately.")
+	fmt.Fprintln(out, "# TYPE kelthuzad_agent_up gauge")
+	for _, a := range agents {
+		up := 0
+		if a.up(now) {
+			up = 1
+		}
+		fmt.Fprintf(out, "kelthuzad_agent_up{agent=\"%v\"} %v\n", labelEscaper.Replace(a.ID), up)
+	}
+}
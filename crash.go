@@ -0,0 +1,194 @@
+package kelthuzad
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// coreSignals are the signals dumping a core by default.
+var coreSignals = map[syscall.Signal]bool{
+	syscall.SIGQUIT: true,
+	syscall.SIGILL:  true,
+	syscall.SIGTRAP: true,
+	syscall.SIGABRT: true,
+	syscall.SIGBUS:  true,
+	syscall.SIGFPE:  true,
+	syscall.SIGSEGV: true,
+}
+
+// crashed reports whether p has exited by a signal dumping a core, and whether it's p itself rather than a child of the shell,
+// which exits with 128 plus the signal.
+func crashed(p *proc) (bool, bool) {
+	ws, ok := p.cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if ok && ws.Signaled() {
+		return ws.CoreDump() || coreSignals[ws.Signal()], true
+	}
+	return p.code > 128 && coreSignals[syscall.Signal(p.code-128)], false
+}
+
+// archiveCrash moves the core files of p, which has crashed after spawnedAt, into a new directory of CrashDir
+// along with the last lines of the output, and keeps only the latest CrashKeep directories.
+func (w *Watchdog) archiveCrash(p *proc, spawnedAt time.Time) {
+	if w.config().CrashDir == "" || p.cmd == nil {
+		return
+	}
+	crash, itself := crashed(p)
+	if !crash {
+		return
+	}
+
+	dir := filepath.Join(w.config().CrashDir, fmt.Sprintf("%v-%v", time.Now().UTC().Format("20060102T150405.000Z"), p.pid))
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		w.log.logf("SYSTEM", record{Level: "warn", Event: "crash", Pid: p.pid}, "archiving the crash %v", err)
+		return
+	}
+
+	var lines strings.Builder
+	for _, line := range w.recent.last(w.config().CrashLines) {
+		lines.WriteString(line + "\n")
+	}
+	err = os.WriteFile(filepath.Join(dir, "output"), []byte(lines.String()), 0644)
+	if err != nil {
+		w.log.logf("SYSTEM", record{Level: "warn", Event: "crash", Pid: p.pid}, "archiving the crash %v", err)
+	}
+
+	// the pid of the child of the shell is unknown
+	pid := 0
+	if itself {
+		pid = p.pid
+	}
+	cores, piped := w.findCores(pid, spawnedAt)
+	for _, core := range cores {
+		err := move(core, filepath.Join(dir, filepath.Base(core)))
+		if err != nil {
+			w.log.logf("SYSTEM", record{Level: "warn", Event: "crash", Pid: p.pid}, "archiving the core %v", err)
+		}
+	}
+	switch {
+	case piped:
+		w.log.logf("SYSTEM", record{Level: "info", Event: "crash", Pid: p.pid}, "%v has crashed, whose core is piped to the handler of the kernel, archived into %v", p.pid, dir)
+	case len(cores) == 0:
+		w.log.logf("SYSTEM", record{Level: "info", Event: "crash", Pid: p.pid}, "%v has crashed without a core, archived into %v", p.pid, dir)
+	default:
+		w.log.logf("SYSTEM", record{Level: "info", Event: "crash", Pid: p.pid}, "%v has crashed, archived into %v with %v cores", p.pid, dir, len(cores))
+	}
+
+	w.pruneCrashes()
+}
+
+// findCores returns the core files of the process of pid modified after since, following the core pattern of the kernel,
+// and reports whether the cores are piped to a handler instead.
+// Every specifier of the pattern but the pid, and the pid as well if it's 0, matches anything.
+func (w *Watchdog) findCores(pid int, since time.Time) ([]string, bool) {
+	pattern := "core"
+	if b, err := os.ReadFile("/proc/sys/kernel/core_pattern"); err == nil {
+		pattern = strings.TrimSpace(string(b))
+	}
+	if strings.HasPrefix(pattern, "|") {
+		return nil, true
+	}
+
+	var glob strings.Builder
+	withPid := false
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c != '%':
+			if strings.ContainsRune(`*?[\`, rune(c)) {
+				glob.WriteByte('\\')
+			}
+			glob.WriteByte(c)
+		case i+1 == len(pattern):
+		case pattern[i+1] == '%':
+			glob.WriteByte('%')
+			i++
+		case strings.IndexByte("pPiI", pattern[i+1]) >= 0 && pid != 0:
+			glob.WriteString(strconv.Itoa(pid))
+			withPid = true
+			i++
+		default:
+			glob.WriteByte('*')
+			i++
+		}
+	}
+	if b, err := os.ReadFile("/proc/sys/kernel/core_uses_pid"); err == nil && strings.TrimSpace(string(b)) == "1" && !withPid {
+		if pid != 0 {
+			glob.WriteString("." + strconv.Itoa(pid))
+		} else {
+			glob.WriteString(".*")
+		}
+	}
+
+	// a relative pattern is in the working directory of the process
+	path := glob.String()
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(w.config().Chdir, path)
+	}
+	matches, _ := filepath.Glob(path)
+	var cores []string
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err == nil && info.Mode().IsRegular() && !info.ModTime().Before(since) {
+			cores = append(cores, match)
+		}
+	}
+	return cores, false
+}
+
+// pruneCrashes removes the oldest directories of CrashDir over CrashKeep, whose names start with the time.
+func (w *Watchdog) pruneCrashes() {
+	entries, err := os.ReadDir(w.config().CrashDir)
+	if err != nil {
+		return
+	}
+
+	var dirs []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			dirs = append(dirs, entry.Name())
+		}
+	}
+	sort.Strings(dirs)
+	for len(dirs) > w.config().CrashKeep {
+		err := os.RemoveAll(filepath.Join(w.config().CrashDir, dirs[0]))
+		if err != nil {
+			w.log.logf("SYSTEM", record{Level: "warn", Event: "crash"}, "removing the old crash %v", err)
+		}
+		dirs = dirs[1:]
+	}
+}
+
+// move renames the file of src to dst, or copies it over another filesystem and removes src.
+func move(src string, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
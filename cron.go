@@ -0,0 +1,168 @@
+package kelthuzad
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronMacros are the shorthands of the cron expressions.
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	dayNames   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// cron is a cron expression of minute, hour, day of month, month and day of week, each of which is a set of bits.
+// If both the days of month and week are restricted, either of them matches as cron does.
+type cron struct {
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	anyDom bool
+	anyDow bool
+}
+
+// parseCron parses a cron expression of five fields such as "30 3 * * 1-5", or a macro such as @daily.
+func parseCron(s string) (*cron, error) {
+	expr := strings.TrimSpace(s)
+	if macro, ok := cronMacros[strings.ToLower(expr)]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%v must be the five fields of minute, hour, day of month, month and day of week", s)
+	}
+
+	c := &cron{anyDom: fields[2] == "*", anyDow: fields[4] == "*"}
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("%v: minute %w", s, err)
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("%v: hour %w", s, err)
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("%v: day of month %w", s, err)
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, fmt.Errorf("%v: month %w", s, err)
+	}
+	// 7 is Sunday as well as 0
+	if c.dow, err = parseCronField(fields[4], 0, 7, dayNames); err != nil {
+		return nil, fmt.Errorf("%v: day of week %w", s, err)
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+
+	return c, nil
+}
+
+// parseCronField parses a comma separated list of *, a value or a range of a-b, each optionally followed by /step,
+// where the values are from min to max, or the names from min.
+func parseCronField(s string, min int, max int, names []string) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(s, ",") {
+		span, stepSpec, stepped := strings.Cut(item, "/")
+		step := 1
+		if stepped {
+			var err error
+			step, err = strconv.Atoi(stepSpec)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("%v has an invalid step", item)
+			}
+		}
+
+		from, to := min, max
+		if span != "*" {
+			lo, hi, ranged := strings.Cut(span, "-")
+			var err error
+			from, err = cronValue(lo, min, max, names)
+			if err != nil {
+				return 0, err
+			}
+			to = from
+			if ranged {
+				to, err = cronValue(hi, min, max, names)
+				if err != nil {
+					return 0, err
+				}
+			} else if stepped {
+				to = max
+			}
+			if from > to {
+				return 0, fmt.Errorf("%v is a reversed range", span)
+			}
+		}
+
+		for v := from; v <= to; v += step {
+			bits |= 1 << v
+		}
+	}
+
+	return bits, nil
+}
+
+// cronValue parses a value from min to max, or a name of names from min.
+func cronValue(s string, min int, max int, names []string) (int, error) {
+	for i, name := range names {
+		if strings.EqualFold(s, name) {
+			return min + i, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < min || v > max {
+		return 0, fmt.Errorf("%v must be from %v to %v", s, min, max)
+	}
+	return v, nil
+}
+
+// matchDay reports whether the day of t matches c.
+func (c *cron) matchDay(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+	switch {
+	case c.anyDom && c.anyDow:
+		return true
+	case c.anyDom:
+		return dow
+	case c.anyDow:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// next returns the first time after now which matches c in the location of now, or zero if none within 5 years such as Feb 30.
+func (c *cron) next(now time.Time) time.Time {
+	t := now.Truncate(time.Minute).Add(time.Minute)
+	limit := now.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,199 @@
+package kelthuzad
+
+import (
+	"sort"
+	"time"
+)
+
+// respawnReports is the number of the reports which an agent restarted in a wave is waited for to respawn.
+const respawnReports = 12
+
+// wave is the restarts which the coordinator orders by the dependencies of the services, one service after another.
+type wave struct {
+	// pending are the services to restart, in the order of their dependencies
+	pending []string
+	// awaited are the agents restarted and not respawned yet, with the number of their reports since
+	awaited map[string]int
+}
+
+// order orders the restarts which follow the report of a, with c.mu held.
+// A respawned agent of the wave lets the next service be restarted, and any other respawned agent
+// has the services depending on it restarted, and the rest of its group as well if it's failed.
+func (c *Coordinator) order(a *agent, now time.Time) {
+	respawned := a.Status.Restarts > a.handled && a.Status.Running && a.Status.Ready
+	if respawned {
+		a.handled = a.Status.Restarts
+	}
+
+	reports, awaited := c.wave.awaited[a.ID]
+	switch {
+	case awaited && respawned:
+		delete(c.wave.awaited, a.ID)
+		c.log.logf("SYSTEM", record{Level: "info", Event: "depend"}, "%v has respawned", a.ID)
+	case awaited && reports >= respawnReports:
+		delete(c.wave.awaited, a.ID)
+		c.log.logf("SYSTEM", record{Level: "warn", Event: "depend"}, "%v hasn't respawned in %v reports, going on without it", a.ID, reports)
+	case awaited:
+		c.wave.awaited[a.ID] = reports + 1
+	case respawned:
+		c.follow(a)
+	}
+	c.advance(now)
+}
+
+// follow adds the services to restart after a has respawned to the wave.
+func (c *Coordinator) follow(a *agent) {
+	deps := make(map[string][]string)
+	groups := make(map[string]string)
+	for _, other := range c.agents {
+		deps[other.Service] = append(deps[other.Service], other.DependsOn...)
+		if other.Group != "" {
+			groups[other.Service] = other.Group
+		}
+	}
+
+	var group []string
+	if a.Group != "" && failed(a.Status) {
+		for service, g := range groups {
+			if g == a.Group && service != a.Service {
+				group = append(group, service)
+			}
+		}
+	}
+	services := append(group, dependents(deps, append([]string{a.Service}, group...))...)
+	if len(services) == 0 {
+		return
+	}
+
+	merged := make(map[string]bool)
+	for _, service := range append(c.wave.pending, services...) {
+		if service != a.Service {
+			merged[service] = true
+		}
+	}
+	var pending []string
+	for service := range merged {
+		pending = append(pending, service)
+	}
+	ordered, cyclic := restartOrder(deps, pending)
+	if cyclic {
+		c.log.logf("SYSTEM", record{Level: "warn", Event: "depend"}, "the dependencies among %v have a cycle, so its services are restarted by the name", ordered)
+	}
+	c.wave.pending = ordered
+	c.log.logf("SYSTEM", record{Level: "info", Event: "depend"}, "%v has respawned, restarting %v in order...", a.ID, ordered)
+}
+
+// advance restarts the next service of the wave once none of its agents is awaited.
+func (c *Coordinator) advance(now time.Time) {
+	for id := range c.wave.awaited {
+		a, ok := c.agents[id]
+		if !ok || !a.up(now) {
+			delete(c.wave.awaited, id)
+			c.log.logf("SYSTEM", record{Level: "warn", Event: "depend"}, "%v is down, going on without it", id)
+		}
+	}
+
+	for len(c.wave.awaited) == 0 && len(c.wave.pending) > 0 {
+		service := c.wave.pending[0]
+		c.wave.pending = c.wave.pending[1:]
+		for id, a := range c.agents {
+			if a.Service != service || !a.up(now) {
+				continue
+			}
+			if c.wave.awaited == nil {
+				c.wave.awaited = make(map[string]int)
+			}
+			a.pending = append(a.pending, "restart")
+			c.wave.awaited[id] = 0
+			c.log.logf("SYSTEM", record{Level: "info", Event: "restart"}, "restart is queued for %v after its dependencies", id)
+		}
+		if len(c.wave.awaited) == 0 {
+			c.log.logf("SYSTEM", record{Level: "warn", Event: "depend"}, "no agent of %v is up to restart", service)
+		}
+	}
+}
+
+// failed reports whether the latest restart of s is for a failure, not asked for or scheduled.
+func failed(s status) bool {
+	if len(s.History) == 0 {
+		return false
+	}
+	reason := s.History[len(s.History)-1].Reason
+	return reason != "manual" && reason != "scheduled"
+}
+
+// dependents returns the services depending on any of seeds, directly or not, ordered by the name.
+func dependents(deps map[string][]string, seeds []string) []string {
+	found := make(map[string]bool)
+	for _, seed := range seeds {
+		found[seed] = true
+	}
+
+	var result []string
+	queue := append([]string{}, seeds...)
+	for len(queue) > 0 {
+		service := queue[0]
+		queue = queue[1:]
+		for other, on := range deps {
+			if found[other] || !contains(on, service) {
+				continue
+			}
+			found[other] = true
+			result = append(result, other)
+			queue = append(queue, other)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// restartOrder orders services so that each one comes after its dependencies among them, and by the name otherwise.
+// The services in a cycle come last ordered by the name, which is reported.
+func restartOrder(deps map[string][]string, services []string) ([]string, bool) {
+	in := make(map[string]bool)
+	for _, service := range services {
+		in[service] = true
+	}
+
+	var ordered []string
+	placed := make(map[string]bool)
+	for len(ordered) < len(in) {
+		var ready, rest []string
+		for service := range in {
+			if placed[service] {
+				continue
+			}
+			rest = append(rest, service)
+			waiting := false
+			for _, dep := range deps[service] {
+				if in[dep] && !placed[dep] && dep != service {
+					waiting = true
+					break
+				}
+			}
+			if !waiting {
+				ready = append(ready, service)
+			}
+		}
+		if len(ready) == 0 {
+			sort.Strings(rest)
+			return append(ordered, rest...), true
+		}
+		sort.Strings(ready)
+		for _, service := range ready {
+			placed[service] = true
+		}
+		ordered = append(ordered, ready...)
+	}
+	return ordered, false
+}
+
+// contains reports whether values has value.
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
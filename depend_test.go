@@ -0,0 +1,114 @@
+package kelthuzad
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRestartOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		deps       map[string][]string
+		services   []string
+		want       []string
+		wantCyclic bool
+	}{
+		{"by the name", nil, []string{"c", "a", "b"}, []string{"a", "b", "c"}, false},
+		{"after the dependency", map[string][]string{"a": {"b"}}, []string{"a", "b"}, []string{"b", "a"}, false},
+		{"a chain", map[string][]string{"a": {"b"}, "b": {"c"}}, []string{"a", "b", "c"}, []string{"c", "b", "a"}, false},
+		{"a diamond", map[string][]string{"web": {"api", "cache"}, "api": {"db"}, "cache": {"db"}}, []string{"web", "cache", "api", "db"}, []string{"db", "api", "cache", "web"}, false},
+		{"a dependency not restarted", map[string][]string{"a": {"x"}}, []string{"a"}, []string{"a"}, false},
+		{"on itself", map[string][]string{"a": {"a"}}, []string{"a"}, []string{"a"}, false},
+		{"a cycle", map[string][]string{"a": {"b"}, "b": {"a"}, "c": {"d"}}, []string{"a", "b", "c", "d"}, []string{"d", "c", "a", "b"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, cyclic := restartOrder(tt.deps, tt.services)
+			if !reflect.DeepEqual(got, tt.want) || cyclic != tt.wantCyclic {
+				t.Errorf("restartOrder() = %v, %v, want %v, %v", got, cyclic, tt.want, tt.wantCyclic)
+			}
+		})
+	}
+}
+
+func TestDependents(t *testing.T) {
+	deps := map[string][]string{"web": {"api"}, "api": {"db"}, "worker": {"db", "queue"}, "db": {"web"}}
+	tests := []struct {
+		name  string
+		seeds []string
+		want  []string
+	}{
+		{"none", []string{"web"}, []string{"api", "db", "worker"}},
+		{"directly and not", []string{"db"}, []string{"api", "web", "worker"}},
+		{"of several", []string{"queue", "api"}, []string{"db", "web", "worker"}},
+		{"unknown", []string{"cache"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := dependents(deps, tt.seeds)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dependents() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrder(t *testing.T) {
+	tests := []struct {
+		name   string
+		reason string
+		// want are the agents queued a restart one after another, each once the one before has respawned
+		want []string
+	}{
+		{"a failure restarts the dependents and the group", "fail", []string{"api@h", "cache@h", "web@h"}},
+		{"a manual restart restarts the dependents only", "manual", []string{"api@h", "web@h"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCoordinator("", "", "json")
+			c.log.setLevel("error")
+			now := time.Now()
+			reported := func(id string, service string, restarts int, deps []string, group string, reason string) *agent {
+				a, ok := c.agents[id]
+				if !ok {
+					a = &agent{handled: restarts}
+					c.agents[id] = a
+				}
+				a.report = report{ID: id, Service: service, Interval: 5, DependsOn: deps, Group: group,
+					Status: status{Running: true, Ready: true, Restarts: restarts, History: []restart{{Reason: reason}}}}
+				a.seen = now
+				c.order(a, now)
+				return a
+			}
+			reported("db@h", "db", 0, nil, "data", "")
+			reported("api@h", "api", 0, []string{"db"}, "", "")
+			reported("web@h", "web", 0, []string{"api"}, "", "")
+			reported("cache@h", "cache", 0, nil, "data", "")
+
+			reported("db@h", "db", 1, nil, "data", tt.reason)
+			var got []string
+			for restarts := 1; restarts <= len(tt.want); restarts++ {
+				var queued []*agent
+				for _, a := range c.agents {
+					if len(a.pending) > 0 {
+						queued = append(queued, a)
+					}
+				}
+				if len(queued) != 1 {
+					t.Fatalf("%v agents are queued a restart, want 1", len(queued))
+				}
+				a := queued[0]
+				got = append(got, a.ID)
+				a.pending = nil
+				reported(a.ID, a.Service, a.Status.Restarts+1, a.DependsOn, a.Group, "manual")
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("restarted %v, want %v", got, tt.want)
+			}
+			if len(c.wave.pending) > 0 || len(c.wave.awaited) > 0 {
+				t.Errorf("the wave is left with %v and %v", c.wave.pending, c.wave.awaited)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package kelthuzad
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// detectorBacklog is how many lines can wait for a detector, over which they're dropped not to block the monitoring.
+const detectorBacklog = 1024
+
+// detectorRetry is how long to wait before starting a detector plugin again when it exits.
+const detectorRetry = 5 * time.Second
+
+// Detector detects a failure in the lines of the process besides the pattern.
+type Detector interface {
+	// Detect reads lines until ctx is done, and calls fail with the line telling why whenever it detects a failure
+	Detect(ctx context.Context, lines <-chan string, fail func(reason string))
+	// String describes it
+	String() string
+}
+
+// detector is a Detector with the lines waiting for it, and the ones dropped since droppedAt while it's behind.
+type detector struct {
+	Detector
+	lines chan string
+
+	mu        sync.Mutex
+	dropped   int
+	droppedAt time.Time
+}
+
+// newDetectors returns the plugins of cfg.Detectors followed by cfg.CustomDetectors, which log to log.
+func newDetectors(cfg *Config, log *logger) []*detector {
+	var detectors []*detector
+	for _, command := range cfg.Detectors {
+		plugin := &execDetector{command: command, maxLineSize: cfg.MaxLineSize, log: log}
+		detectors = append(detectors, &detector{Detector: plugin, lines: make(chan string, detectorBacklog)})
+	}
+	for _, d := range cfg.CustomDetectors {
+		detectors = append(detectors, &detector{Detector: d, lines: make(chan string, detectorBacklog)})
+	}
+
+	return detectors
+}
+
+// feed gives line to every detector, and drops it for the ones which are behind.
+// The drops are told at most every second, which would flood the log at the rate of the lines otherwise.
+func (w *Watchdog) feed(line string) {
+	for _, d := range w.detectors {
+		select {
+		case d.lines <- line:
+			d.mu.Lock()
+			if d.dropped > 0 && time.Since(d.droppedAt) >= time.Second {
+				w.log.logf("SYSTEM", record{Level: "warn", Event: "detector"}, "dropped %v lines while %v was behind", d.dropped, d)
+				d.dropped = 0
+			}
+			d.mu.Unlock()
+		default:
+			d.mu.Lock()
+			if d.dropped == 0 {
+				w.log.logf("SYSTEM", record{Level: "warn", Event: "detector"}, "%v is behind, dropping the lines...", d)
+				d.droppedAt = time.Now()
+			}
+			d.dropped++
+			d.mu.Unlock()
+		}
+	}
+}
+
+// runDetector runs d until ctx is done, and fails the current process whenever d detects a failure.
+func (w *Watchdog) runDetector(ctx context.Context, d *detector) {
+	d.Detect(ctx, d.lines, func(reason string) {
+		w.detected(ctx, d.String(), "detector", reason, nil)
+	})
+}
+
+// detected fails the current process by line which the detector by detected with captures telling why, classified as cause,
+// unless the detection is paused, or the process is being replaced or cooling down.
+func (w *Watchdog) detected(ctx context.Context, by string, cause string, line string, captures map[string]string) {
+	p := w.current()
+	w.mu.Lock()
+	paused := w.paused
+	cooling := w.restarts > 0 && time.Since(w.spawnedAt) < time.Duration(w.config().Cooldown)*time.Second
+	var pid int
+	if w.proc != nil {
+		pid = w.proc.pid
+	}
+	w.mu.Unlock()
+
+	switch {
+	case paused:
+		w.log.logf("MATCH", record{Level: "warn", Event: "match", Pid: pid, Line: line, Pattern: by, Captures: captures}, "%v -> %v, not failing while paused", line, by)
+	case p == nil || cooling:
+		w.log.logf("MATCH", record{Level: "warn", Event: "match", Pid: pid, Line: line, Pattern: by, Captures: captures}, "%v -> %v, not failing while respawning or cooling down", line, by)
+	default:
+		w.failLater(p, cause, line, by, captures)
+	}
+}
+
+// execDetector is a plugin command run by the shell, which gets the lines on its stdin
+// and prints a line of FAIL, optionally followed by why, on its stdout to detect a failure.
+type execDetector struct {
+	command     string
+	maxLineSize int
+	log         *logger
+}
+
+// Detect runs the plugin until ctx is done, which is run again whenever it exits.
+// The lines while it's not running are dropped.
+func (d *execDetector) Detect(ctx context.Context, lines <-chan string, fail func(reason string)) {
+	d.log.logf("SYSTEM", record{Level: "info", Event: "detector"}, "detecting by %v...", d)
+	for {
+		err := d.run(ctx, lines, fail)
+		if ctx.Err() != nil {
+			return
+		}
+
+		d.log.logf("SYSTEM", record{Level: "warn", Event: "detector"}, "%v %v, starting again in %v...", d, err, detectorRetry)
+		// the lines keep coming meanwhile, so the wait is timed once
+		retry := time.NewTimer(detectorRetry)
+		for sleeping := true; sleeping; {
+			select {
+			case <-lines:
+			case <-retry.C:
+				sleeping = false
+			case <-ctx.Done():
+				retry.Stop()
+				return
+			}
+		}
+	}
+}
+
+// run runs the plugin until it exits or ctx is done, and writes lines to its stdin.
+// The plugin is killed with what it started, and what it leaves holding its stdout keeps it running only for a while.
+func (d *execDetector) run(ctx context.Context, lines <-chan string, fail func(reason string)) error {
+	cmd := shellCommand(d.command)
+	prepare(cmd, nil)
+	cmd.Stderr = os.Stderr
+	cmd.WaitDelay = outputDelay
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	// Wait waits for what its stdout is copied to, unlike StdoutPipe, so it's bounded by WaitDelay
+	stdout, out := io.Pipe()
+	cmd.Stdout = out
+	err = startOwned(cmd, -1, nil)
+	if err != nil {
+		return err
+	}
+
+	// killing it also ends a write which it doesn't read
+	stop := context.AfterFunc(ctx, func() {
+		killGroup(cmd)
+	})
+	defer stop()
+
+	// the other lines it prints are only logged, which helps writing it
+	go func() {
+		reader := newLineReader(stdout, d.maxLineSize)
+		for {
+			line, _, err := reader.next()
+			if err != nil {
+				return
+			}
+			if line == "FAIL" || strings.HasPrefix(line, "FAIL ") {
+				fail(line)
+			} else {
+				d.log.logf("SYSTEM", record{Level: "info", Event: "detector"}, "%v: %v", d, line)
+			}
+		}
+	}()
+	exited := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		disown(cmd)
+		// what it left is gone with it, since it's started again
+		killGroup(cmd)
+		out.Close()
+		exited <- err
+	}()
+
+	for {
+		select {
+		case line := <-lines:
+			_, err := io.WriteString(stdin, line+"\n")
+			if err != nil {
+				killGroup(cmd)
+				<-exited
+				return err
+			}
+		case err := <-exited:
+			if err == nil {
+				err = errors.New("exited")
+			}
+			return err
+		case <-ctx.Done():
+			stdin.Close()
+			<-exited
+			return nil
+		}
+	}
+}
+
+func (d *execDetector) String() string {
+	return d.command
+}
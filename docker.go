@@ -0,0 +1,308 @@
+package kelthuzad
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// dockerTimeout is how long to wait for the Docker API to respond, except for the calls which wait for the container.
+const dockerTimeout = 30 * time.Second
+
+// containerRetry is how long to wait before following the logs of the container again, or waiting for it again.
+const containerRetry = time.Second
+
+// docker is the client of the Docker Engine API about a container.
+type docker struct {
+	client    *http.Client
+	base      string
+	container string
+}
+
+// newDocker returns the client of the container of cfg.DockerContainer via cfg.DockerHost, or nil without the container.
+func newDocker(cfg *Config) *docker {
+	if cfg.DockerContainer == "" {
+		return nil
+	}
+
+	// the API is usually on a Unix socket, which needs its own dialer
+	d := &docker{client: &http.Client{}, base: "http://" + cfg.DockerHost, container: cfg.DockerContainer}
+	if path := strings.TrimPrefix(cfg.DockerHost, "unix:"); path != cfg.DockerHost {
+		d.client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		}
+		d.base = "http://docker"
+	}
+
+	return d
+}
+
+// call calls the API of the container at path with query, and returns the response unless it failed.
+// 304 Not Modified is a success, which means the container is already started or stopped.
+func (d *docker) call(ctx context.Context, method string, path string, query url.Values) (*http.Response, error) {
+	u := d.base + "/containers/" + url.PathEscape(d.container) + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotModified {
+		defer resp.Body.Close()
+
+		// the API tells why in the message
+		var body struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return nil, fmt.Errorf("%v %v responded %v %v", method, path, resp.Status, body.Message)
+	}
+
+	return resp, nil
+}
+
+// post posts to path with query, and discards the response.
+func (d *docker) post(path string, query url.Values) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dockerTimeout)
+	defer cancel()
+
+	resp, err := d.call(ctx, http.MethodPost, path, query)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// containerState is what matters of the inspected container.
+type containerState struct {
+	State struct {
+		Running bool `json:"Running"`
+		Pid     int  `json:"Pid"`
+	} `json:"State"`
+	Config struct {
+		Tty bool `json:"Tty"`
+	} `json:"Config"`
+}
+
+// inspect returns the state of the container.
+func (d *docker) inspect(ctx context.Context) (containerState, error) {
+	ctx, cancel := context.WithTimeout(ctx, dockerTimeout)
+	defer cancel()
+
+	var s containerState
+	resp, err := d.call(ctx, http.MethodGet, "/json", nil)
+	if err != nil {
+		return s, err
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(&s)
+	return s, err
+}
+
+// wait waits for the container to stop until ctx is done, and returns its exit code.
+func (d *docker) wait(ctx context.Context) (int, error) {
+	resp, err := d.call(ctx, http.MethodPost, "/wait", url.Values{"condition": {"not-running"}})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		StatusCode int `json:"StatusCode"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	return body.StatusCode, err
+}
+
+// logs follows the logs of streams since the Unix time since until ctx is done, and each line starts with its timestamp.
+func (d *docker) logs(ctx context.Context, streams string, since string) (io.ReadCloser, error) {
+	query := url.Values{"follow": {"1"}, "timestamps": {"1"}, "since": {since}}
+	if streams != "stderr" {
+		query.Set("stdout", "1")
+	}
+	if streams != "stdout" {
+		query.Set("stderr", "1")
+	}
+
+	resp, err := d.call(ctx, http.MethodGet, "/logs", query)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// startContainer starts the container as the current process, or adopts it if it's running already.
+func (w *Watchdog) startContainer(ctx context.Context) (*proc, error) {
+	// start it under the lock as a command is, though it's left running when Run returns
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	err := w.docker.post("/start", nil)
+	if err != nil {
+		return nil, fmt.Errorf("kelthuzad: start container %v: %w", w.config().DockerContainer, err)
+	}
+	s, err := w.docker.inspect(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("kelthuzad: inspect container %v: %w", w.config().DockerContainer, err)
+	}
+
+	p := &proc{pid: s.State.Pid}
+	w.publish(p)
+	w.log.logf("SYSTEM", record{Level: "info", Event: "spawn", Pid: p.pid}, "the container %v is started as %v", w.config().DockerContainer, p.pid)
+	return p, nil
+}
+
+// waitContainer waits for the container of p to stop, and reports whether it did before ctx is done.
+func (w *Watchdog) waitContainer(ctx context.Context, p *proc) bool {
+	for {
+		code, err := w.docker.wait(ctx)
+		if ctx.Err() != nil {
+			return false
+		}
+		if err == nil {
+			p.code = code
+			p.state = "exit status " + strconv.Itoa(code)
+			return true
+		}
+
+		// the daemon may be restarting, which doesn't mean the container stopped
+		w.log.logf("SYSTEM", record{Level: "warn", Event: "docker", Pid: p.pid}, "wait container %v %v", w.config().DockerContainer, err)
+		if !sleep(ctx, containerRetry) {
+			return false
+		}
+	}
+}
+
+// stopContainer stops the container of p, which Docker kills unless it stops within the grace period.
+func (w *Watchdog) stopContainer(p *proc) {
+	w.notify("kill", "", "")
+
+	err := w.docker.post("/stop", url.Values{"t": {strconv.Itoa(w.config().Grace)}})
+	if err != nil {
+		w.log.logf("SYSTEM", record{Level: "warn", Event: "kill", Pid: p.pid}, "stop container %v %v", w.config().DockerContainer, err)
+		return
+	}
+	<-p.done
+}
+
+// signalContainer sends sig to the container.
+func (w *Watchdog) signalContainer(sig os.Signal) error {
+	name := sig.String()
+	if s, ok := sig.(syscall.Signal); ok {
+		name = strconv.Itoa(int(s))
+	}
+
+	return w.docker.post("/kill", url.Values{"signal": {name}})
+}
+
+// monitorContainer follows the logs of the container and checks each line until ctx is done.
+// The logs end whenever the container stops, so they're followed again from the last line seen.
+func (w *Watchdog) monitorContainer(ctx context.Context) {
+	w.log.logf("SYSTEM", record{Level: "info", Event: "monitor"}, "monitoring the logs of the container %v...", w.config().DockerContainer)
+	last := time.Now()
+	for {
+		err := w.followContainer(ctx, &last)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			w.log.logf("SYSTEM", record{Level: "warn", Event: "docker"}, "logs of container %v %v", w.config().DockerContainer, err)
+		}
+		if !sleep(ctx, containerRetry) {
+			return
+		}
+	}
+}
+
+// followContainer checks the lines of the logs after last until they end or ctx is done, and keeps last at the last line seen.
+func (w *Watchdog) followContainer(ctx context.Context, last *time.Time) error {
+	s, err := w.docker.inspect(ctx)
+	if err != nil {
+		return err
+	}
+	body, err := w.docker.logs(ctx, w.config().Streams, fmt.Sprintf("%d.%09d", last.Unix(), last.Nanosecond()))
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	// stdout and stderr are multiplexed into frames unless the container has a TTY
+	var r io.Reader = body
+	if !s.Config.Tty {
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go demux(body, pw)
+		r = pr
+	}
+
+	reader := newLineReader(r, w.config().MaxLineSize)
+	for {
+		line, truncated, err := reader.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if truncated {
+			w.log.logf("SYSTEM", record{Level: "warn", Event: "truncate"}, "a line over %v bytes is truncated", w.config().MaxLineSize)
+		}
+
+		// the lines since last are there again when the logs are followed again, which don't count twice
+		stamp, text := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			stamp, text = line[:i], line[i+1:]
+		}
+		at, err := time.Parse(time.RFC3339Nano, stamp)
+		if err == nil {
+			if !at.After(*last) {
+				continue
+			}
+			*last = at
+		}
+
+		w.check(ctx, cleanLine(w.config(), strings.TrimSuffix(text, "\r")))
+	}
+}
+
+// demux copies the payloads of the frames of r, which multiplexes stdout and stderr, to pw until r ends.
+// A frame is headed by the stream in a byte, 3 zero bytes and the size of the payload in 4 big-endian bytes.
+func demux(r io.Reader, pw *io.PipeWriter) {
+	header := make([]byte, 8)
+	for {
+		_, err := io.ReadFull(r, header)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		_, err = io.CopyN(pw, r, int64(binary.BigEndian.Uint32(header[4:])))
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package kelthuzad
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// leaderTTL is how long the lock is held without being renewed.
+	leaderTTL = 15 * time.Second
+	// leaderRetry is the interval of renewing the lock, and of trying to take it.
+	leaderRetry = 2 * time.Second
+)
+
+// elector is the lock which the instances of kelthuzad race for, and whose holder leads them.
+type elector interface {
+	// acquire tries to take the lock as identity, and reports whether it's taken.
+	acquire(ctx context.Context, identity string) (bool, error)
+	// renew keeps the lock taken, and reports whether it's still held.
+	renew(ctx context.Context) (bool, error)
+	// release gives the lock up.
+	release()
+}
+
+// newElector returns the lock of spec, which is file:PATH, consul:URL/KEY or etcd:URL/KEY.
+func newElector(spec string) (elector, error) {
+	scheme, rest, _ := strings.Cut(spec, ":")
+	switch scheme {
+	case "file":
+		if rest == "" {
+			return nil, errors.New("the path of the lock is empty")
+		}
+		return &fileLock{path: rest}, nil
+	case "consul", "etcd":
+		u, err := url.Parse(rest)
+		if err != nil {
+			return nil, err
+		}
+		key := strings.Trim(u.Path, "/")
+		if u.Scheme == "" || u.Host == "" || key == "" {
+			return nil, fmt.Errorf("%v must be %v:http://host:port/key", spec, scheme)
+		}
+		base := u.Scheme + "://" + u.Host
+		client := &http.Client{Timeout: leaderRetry * 2}
+		if scheme == "consul" {
+			return &consulLock{base: base, key: key, client: client}, nil
+		}
+		return &etcdLock{base: base, key: key, client: client}, nil
+	}
+	return nil, fmt.Errorf("unknown lock %v, which must be file:PATH, consul:URL/KEY or etcd:URL/KEY", spec)
+}
+
+// runElected supervises the process only while leading by the lock until ctx is done,
+// and waits for the lock otherwise, so just one of the instances runs it at a time.
+// The process is killed once the lock is lost, which another instance takes to run it over.
+func (w *Watchdog) runElected(ctx context.Context) error {
+	host, _ := os.Hostname()
+	identity := host + "_" + strconv.Itoa(os.Getpid())
+
+	var failed string
+	waiting := false
+	for {
+		held, err := w.elector.acquire(ctx, identity)
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case err != nil && err.Error() != failed:
+			// the same failure every retry is told once
+			w.log.logf("SYSTEM", record{Level: "warn", Event: "elect"}, "couldn't take the lock %v: %v", w.config().LeaderLock, err)
+			failed = err.Error()
+		case err == nil:
+			failed = ""
+		}
+		if !held {
+			if !waiting {
+				w.log.logf("SYSTEM", record{Level: "info", Event: "elect"}, "%v waits for the lock %v to lead...", identity, w.config().LeaderLock)
+				waiting = true
+			}
+			if !sleep(ctx, leaderRetry) {
+				return nil
+			}
+			continue
+		}
+		waiting = false
+
+		w.log.logf("SYSTEM", record{Level: "info", Event: "elect"}, "%v leads by the lock %v", identity, w.config().LeaderLock)
+		leading, cancel := context.WithCancel(ctx)
+		kept := make(chan struct{})
+		go func() {
+			defer close(kept)
+			defer cancel()
+			w.keepLead(leading)
+		}()
+		err = w.supervise(leading)
+		lost := leading.Err() != nil && ctx.Err() == nil
+		cancel()
+		<-kept
+		w.elector.release()
+		if !lost {
+			return err
+		}
+		w.log.logf("SYSTEM", record{Level: "warn", Event: "elect"}, "%v doesn't lead anymore, so the process is killed", identity)
+	}
+}
+
+// keepLead renews the lock every leaderRetry until ctx is done, and returns once it's lost,
+// which is when another has taken it or it couldn't be renewed within leaderTTL.
+func (w *Watchdog) keepLead(ctx context.Context) {
+	renewed := time.Now()
+	for sleep(ctx, leaderRetry) {
+		held, err := w.elector.renew(ctx)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err == nil && held:
+			renewed = time.Now()
+		case err == nil:
+			w.log.logf("SYSTEM", record{Level: "warn", Event: "elect"}, "the lock %v has been lost", w.config().LeaderLock)
+			return
+		case time.Since(renewed) >= leaderTTL:
+			w.log.logf("SYSTEM", record{Level: "warn", Event: "elect"}, "couldn't renew the lock %v within %v: %v", w.config().LeaderLock, leaderTTL, err)
+			return
+		}
+	}
+}
+
+// fileLock is the lock of a file, which is shared by the instances on a host or over a network filesystem.
+// It's held until the file is closed, which the system does when kelthuzad dies.
+type fileLock struct {
+	path string
+	f    *os.File
+}
+
+// acquire locks the file, and writes identity in it to tell who leads.
+func (l *fileLock) acquire(ctx context.Context, identity string) (bool, error) {
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return false, err
+	}
+	locked, err := tryLock(f)
+	if err != nil || !locked {
+		f.Close()
+		return false, err
+	}
+	f.Truncate(0)
+	f.WriteAt([]byte(identity+"\n"), 0)
+	l.f = f
+	return true, nil
+}
+
+func (l *fileLock) renew(ctx context.Context) (bool, error) {
+	return l.f != nil, nil
+}
+
+func (l *fileLock) release() {
+	if l.f != nil {
+		l.f.Close()
+		l.f = nil
+	}
+}
+
+// callLock sends body of JSON to path of base, and decodes the response into v unless it's nil.
+// It returns errNotFound for 404 Not Found.
+func callLock(ctx context.Context, client *http.Client, method string, base string, path string, body interface{}, v interface{}) error {
+	var in io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		in = strings.NewReader(b)
+	default:
+		encoded, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		in = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, base+path, in)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errNotFound
+	case resp.StatusCode != http.StatusOK:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%v responded %v: %v", base, resp.Status, strings.TrimSpace(string(msg)))
+	case v == nil:
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// errNotFound is returned by callLock for 404 Not Found.
+var errNotFound = errors.New("not found")
+
+// consulLock is the key of Consul, which is locked by a session living for leaderTTL unless it's renewed.
+type consulLock struct {
+	base    string
+	key     string
+	client  *http.Client
+	session string
+}
+
+// acquire creates a session and locks the key by it, whose value is identity.
+// The session is destroyed right away unless the key is locked.
+func (l *consulLock) acquire(ctx context.Context, identity string) (bool, error) {
+	var session struct {
+		ID string
+	}
+	err := callLock(ctx, l.client, http.MethodPut, l.base, "/v1/session/create", map[string]interface{}{
+		"Name":      "kelthuzad " + identity,
+		"TTL":       leaderTTL.String(),
+		"Behavior":  "release",
+		"LockDelay": "0s",
+	}, &session)
+	if err != nil {
+		return false, err
+	}
+	l.session = session.ID
+
+	var locked bool
+	err = callLock(ctx, l.client, http.MethodPut, l.base, "/v1/kv/"+l.key+"?acquire="+l.session, identity, &locked)
+	if err != nil || !locked {
+		l.release()
+	}
+	return locked, err
+}
+
+// renew renews the session, which is gone only when the key isn't locked by it anymore.
+func (l *consulLock) renew(ctx context.Context) (bool, error) {
+	err := callLock(ctx, l.client, http.MethodPut, l.base, "/v1/session/renew/"+l.session, nil, nil)
+	if err == errNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (l *consulLock) release() {
+	if l.session == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), leaderRetry)
+	defer cancel()
+	callLock(ctx, l.client, http.MethodPut, l.base, "/v1/kv/"+l.key+"?release="+l.session, nil, nil)
+	callLock(ctx, l.client, http.MethodPut, l.base, "/v1/session/destroy/"+l.session, nil, nil)
+	l.session = ""
+}
+
+// etcdLock is the key of etcd over its JSON gateway, which is created with a lease living for leaderTTL unless it's renewed.
+type etcdLock struct {
+	base   string
+	key    string
+	client *http.Client
+	lease  string
+}
+
+// acquire grants a lease and creates the key with it unless the key exists, whose value is identity.
+// The lease is revoked right away unless the key is created.
+func (l *etcdLock) acquire(ctx context.Context, identity string) (bool, error) {
+	var lease struct {
+		ID string `json:"ID"`
+	}
+	err := callLock(ctx, l.client, http.MethodPost, l.base, "/v3/lease/grant", map[string]string{"TTL": strconv.Itoa(int(leaderTTL.Seconds()))}, &lease)
+	if err != nil {
+		return false, err
+	}
+	l.lease = lease.ID
+
+	key := base64.StdEncoding.EncodeToString([]byte(l.key))
+	var txn struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	err = callLock(ctx, l.client, http.MethodPost, l.base, "/v3/kv/txn", map[string]interface{}{
+		"compare": []map[string]string{{"key": key, "result": "EQUAL", "target": "CREATE", "create_revision": "0"}},
+		"success": []map[string]interface{}{{"request_put": map[string]string{"key": key, "value": base64.StdEncoding.EncodeToString([]byte(identity)), "lease": l.lease}}},
+	}, &txn)
+	if err != nil || !txn.Succeeded {
+		l.release()
+	}
+	return txn.Succeeded, err
+}
+
+// renew keeps the lease alive, which has expired with the key when its TTL is gone.
+func (l *etcdLock) renew(ctx context.Context) (bool, error) {
+	var alive struct {
+		Result struct {
+			TTL string `json:"TTL"`
+		} `json:"result"`
+	}
+	err := callLock(ctx, l.client, http.MethodPost, l.base, "/v3/lease/keepalive", map[string]string{"ID": l.lease}, &alive)
+	if err != nil {
+		return false, err
+	}
+	return alive.Result.TTL != "" && alive.Result.TTL != "0", nil
+}
+
+func (l *etcdLock) release() {
+	if l.lease == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), leaderRetry)
+	defer cancel()
+	callLock(ctx, l.client, http.MethodPost, l.base, "/v3/lease/revoke", map[string]string{"ID": l.lease}, nil)
+	l.lease = ""
+}
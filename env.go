@@ -0,0 +1,107 @@
+package kelthuzad
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// envVar is an environment variable of the process, whose value is a template.
+type envVar struct {
+	key   string
+	value *template.Template
+}
+
+// envData is what the value of an environment variable can refer to, such as {{.Restarts}}.
+type envData struct {
+	// Restarts is the number of respawns so far
+	Restarts int
+	// KelthuzadPid is the pid of the watchdog itself
+	KelthuzadPid int
+}
+
+// newEnv returns the environment variables of EnvFile overridden by Env.
+func newEnv(cfg *Config) ([]envVar, error) {
+	var pairs []string
+	if cfg.EnvFile != "" {
+		lines, err := readEnvFile(cfg.EnvFile)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, lines...)
+	}
+	pairs = append(pairs, cfg.Env...)
+
+	env := make([]envVar, 0, len(pairs))
+	for _, pair := range pairs {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("kelthuzad: env %q isn't KEY=VALUE", pair)
+		}
+
+		t, err := template.New(key).Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("kelthuzad: env %v: %w", key, err)
+		}
+		// catch a reference to what doesn't exist before spawning
+		err = t.Execute(&strings.Builder{}, envData{})
+		if err != nil {
+			return nil, fmt.Errorf("kelthuzad: env %v: %w", key, err)
+		}
+
+		env = append(env, envVar{key: key, value: t})
+	}
+
+	return env, nil
+}
+
+// readEnvFile reads the KEY=VALUE lines of path, skipping blank lines and comments.
+func readEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("kelthuzad: env file: %w", err)
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, strings.TrimPrefix(line, "export "))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("kelthuzad: env file: %w", err)
+	}
+
+	return lines, nil
+}
+
+// environ returns the environment of the process to spawn, which is the one of the watchdog with w.env on top.
+// It returns nil to inherit the environment as is when there's nothing to set.
+func (w *Watchdog) environ() ([]string, error) {
+	if len(w.env) == 0 {
+		return nil, nil
+	}
+
+	w.mu.Lock()
+	data := envData{Restarts: w.restarts, KelthuzadPid: os.Getpid()}
+	w.mu.Unlock()
+	environ := os.Environ()
+	for _, v := range w.env {
+		var value strings.Builder
+		err := v.value.Execute(&value, data)
+		if err != nil {
+			return nil, fmt.Errorf("kelthuzad: env %v: %w", v.key, err)
+		}
+
+		// the later one wins when a key is duplicated
+		environ = append(environ, v.key+"="+value.String())
+	}
+
+	return environ, nil
+}
@@ -0,0 +1,289 @@
+package kelthuzad
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parseEventSink splits spec of an event sink into its kind and argument.
+func parseEventSink(spec string) (string, string, error) {
+	switch {
+	case spec == "stdout" || spec == "metrics":
+		return spec, "", nil
+	case strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://"):
+		return "webhook", spec, nil
+	}
+
+	kind, arg, ok := strings.Cut(spec, ":")
+	if !ok || arg == "" || (kind != "file" && kind != "exec" && kind != "kafka" && kind != "nats") {
+		return "", "", fmt.Errorf("%v must be stdout, file:PATH, exec:COMMAND, kafka:BROKERS/TOPIC, nats:SERVERS/SUBJECT, metrics or a URL", spec)
+	}
+	return kind, arg, nil
+}
+
+// stdout writes an event to stdout as a line of JSON.
+type stdout struct{}
+
+// stdoutMu serializes the events to stdout, which is shared by the notifiers before and after a reload.
+var stdoutMu sync.Mutex
+
+func (stdout) send(e event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	stdoutMu.Lock()
+	defer stdoutMu.Unlock()
+	_, err = os.Stdout.Write(append(line, '\n'))
+	return err
+}
+
+func (stdout) String() string {
+	return "stdout"
+}
+
+// file appends an event to the file of path as a line of JSON.
+// It's opened every time, so it can be rotated by moving it away.
+type file struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (f *file) send(e event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(append(line, '\n'))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (f *file) String() string {
+	return f.path
+}
+
+// script runs a command string with an event as JSON on its stdin and the environment variables of the hooks,
+// which is killed with what it started if it runs longer than timeout.
+type script struct {
+	command string
+	timeout time.Duration
+}
+
+func (s *script) send(e event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	cmd := shellCommand(s.command)
+	prepare(cmd, nil)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = hookEnv(e)
+	cmd.WaitDelay = outputDelay
+	err = startOwned(cmd, -1, nil)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		disown(cmd)
+		done <- err
+	}()
+
+	select {
+	case err = <-done:
+		return err
+	case <-time.After(s.timeout):
+		killGroup(cmd)
+		<-done
+		return fmt.Errorf("didn't finish in %v", s.timeout)
+	}
+}
+
+func (s *script) String() string {
+	return s.command
+}
+
+// metrics counts the events by the type, the matches by the pattern and the restarts by the cause, which are served on /metrics of the API.
+// It's kept by the watchdog, so the counts survive the reloads, and passes the matches and the restarts to statsd as well.
+type metrics struct {
+	mu       sync.Mutex
+	counts   map[string]int
+	matches  map[patternKey]int
+	restarts map[string]int
+	budget   *budget
+	statsd   *statsd
+}
+
+// patternKey is the kind of a pattern, which is pattern or exclude, and the pattern.
+type patternKey struct {
+	kind    string
+	pattern string
+}
+
+// matched counts a match of pattern of kind.
+func (m *metrics) matched(kind string, pattern string) {
+	m.statsd.matched(kind, pattern)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.matches == nil {
+		m.matches = make(map[patternKey]int)
+	}
+	m.matches[patternKey{kind, pattern}]++
+}
+
+// restarted counts a restart of cause.
+func (m *metrics) restarted(cause string) {
+	m.statsd.restarted(cause)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.restarts == nil {
+		m.restarts = make(map[string]int)
+	}
+	m.restarts[cause]++
+}
+
+func (m *metrics) send(e event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.counts == nil {
+		m.counts = make(map[string]int)
+	}
+	m.counts[e.Type]++
+	return nil
+}
+
+func (m *metrics) String() string {
+	return "metrics"
+}
+
+// write writes the counts to out in the text format of Prometheus.
+func (m *metrics) write(out io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var types []string
+	for typ := range m.counts {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	fmt.Fprintln(out, "# HELP kelthuzad_events_total The number of the events by the type.")
+	fmt.Fprintln(out, "# TYPE kelthuzad_events_total counter")
+	for _, typ := range types {
+		fmt.Fprintf(out, "kelthuzad_events_total{type=%q} %v\n", typ, m.counts[typ])
+	}
+
+	var keys []patternKey
+	for key := range m.matches {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].kind != keys[j].kind {
+			return keys[i].kind < keys[j].kind
+		}
+		return keys[i].pattern < keys[j].pattern
+	})
+	fmt.Fprintln(out, "# HELP kelthuzad_pattern_matches_total The number of the lines matched by the pattern, whose kind is pattern or exclude.")
+	fmt.Fprintln(out, "# TYPE kelthuzad_pattern_matches_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(out, "kelthuzad_pattern_matches_total{kind=%q,pattern=\"%v\"} %v\n", key.kind, labelEscaper.Replace(key.pattern), m.matches[key])
+	}
+
+	var causes []string
+	for cause := range m.restarts {
+		causes = append(causes, cause)
+	}
+	sort.Strings(causes)
+	fmt.Fprintln(out, "# HELP kelthuzad_restarts_total The number of the restarts by the cause, which is regex-match, detector, plugin, sequence, probe-failure, resource-limit, exit-code, manual or scheduled.")
+	fmt.Fprintln(out, "# TYPE kelthuzad_restarts_total counter")
+	for _, cause := range causes {
+		fmt.Fprintf(out, "kelthuzad_restarts_total{cause=%q} %v\n", cause, m.restarts[cause])
+	}
+
+	if m.budget != nil {
+		tokens, exhausted := m.budget.left(time.Now())
+		fmt.Fprintln(out, "# HELP kelthuzad_restart_budget_tokens The restarts left in the budget.")
+		fmt.Fprintln(out, "# TYPE kelthuzad_restart_budget_tokens gauge")
+		fmt.Fprintf(out, "kelthuzad_restart_budget_tokens %v\n", tokens)
+		fmt.Fprintln(out, "# HELP kelthuzad_restart_budget_exhausted_total The number of the restarts which found the budget used up.")
+		fmt.Fprintln(out, "# TYPE kelthuzad_restart_budget_exhausted_total counter")
+		fmt.Fprintf(out, "kelthuzad_restart_budget_exhausted_total %v\n", exhausted)
+	}
+}
+
+// labelEscaper escapes a value of a label of Prometheus, which knows only these escapes unlike %q.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// hub broadcasts an event to the subscribers of the gRPC Events, which is kept by the watchdog across the reloads.
+type hub struct {
+	mu   sync.Mutex
+	subs map[chan event]bool
+}
+
+// subscribe returns the channel getting the events until it's unsubscribed.
+func (h *hub) subscribe() chan event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.subs == nil {
+		h.subs = make(map[chan event]bool)
+	}
+	ch := make(chan event, 64)
+	h.subs[ch] = true
+	return ch
+}
+
+// unsubscribe stops sending the events to ch.
+func (h *hub) unsubscribe(ch chan event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.subs, ch)
+}
+
+func (h *hub) send(e event) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// a slow subscriber mustn't delay respawning
+	dropped := 0
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		return fmt.Errorf("dropped %v for %v slow subscribers", e.Type, dropped)
+	}
+	return nil
+}
+
+func (h *hub) String() string {
+	return "grpc"
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package kelthuzad
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// tryLock locks f exclusively without blocking, and reports whether it's locked.
+func tryLock(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,88 @@
+package kelthuzad
+
+import (
+	"errors"
+	"fmt"
+	"plugin"
+	"time"
+)
+
+// errBusy means a Go plugin is still checking a line over the budget.
+var errBusy = errors.New("busy")
+
+// goPlugin is a detector compiled as a Go plugin by go build -buildmode=plugin,
+// which exports Detect as func(line string) (bool, string) to tell whether line is a failure and why.
+type goPlugin struct {
+	path   string
+	detect func(string) (bool, string)
+	busy   chan struct{}
+}
+
+// verdict is what Detect of a Go plugin returned.
+type verdict struct {
+	failed bool
+	reason string
+	err    error
+}
+
+// loadGoPlugins loads every Go plugin of paths.
+func loadGoPlugins(paths []string) ([]*goPlugin, error) {
+	var plugins []*goPlugin
+	for _, path := range paths {
+		p, err := plugin.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("kelthuzad: GoPlugin %v: %w", path, err)
+		}
+		symbol, err := p.Lookup("Detect")
+		if err != nil {
+			return nil, fmt.Errorf("kelthuzad: GoPlugin %v: %w", path, err)
+		}
+		detect, ok := symbol.(func(string) (bool, string))
+		if !ok {
+			return nil, fmt.Errorf("kelthuzad: GoPlugin %v: Detect must be func(line string) (bool, string), not %T", path, symbol)
+		}
+
+		plugins = append(plugins, &goPlugin{path: path, detect: detect, busy: make(chan struct{}, 1)})
+	}
+
+	return plugins, nil
+}
+
+// check calls Detect with line, and returns the verdict unless it takes over budget.
+// The call over budget is left running, since a goroutine can't be killed,
+// and the lines are skipped until it returns so that Detect is never called concurrently.
+func (g *goPlugin) check(line string, budget time.Duration) (bool, string, error) {
+	select {
+	case g.busy <- struct{}{}:
+	default:
+		return false, "", errBusy
+	}
+
+	result := make(chan verdict, 1)
+	go func() {
+		defer func() {
+			<-g.busy
+		}()
+		defer func() {
+			if r := recover(); r != nil {
+				result <- verdict{err: fmt.Errorf("panic: %v", r)}
+			}
+		}()
+
+		failed, reason := g.detect(line)
+		result <- verdict{failed: failed, reason: reason}
+	}()
+
+	timer := time.NewTimer(budget)
+	defer timer.Stop()
+	select {
+	case v := <-result:
+		return v.failed, v.reason, v.err
+	case <-timer.C:
+		return false, "", fmt.Errorf("took over %v, skipping the lines until it returns", budget)
+	}
+}
+
+func (g *goPlugin) String() string {
+	return g.path
+}
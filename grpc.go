@@ -0,0 +1,127 @@
+package kelthuzad
+
+import (
+	"context"
+	"fmt"
+	"github.com/codacy-badger/kelthuzad/controlpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"net"
+)
+
+// controlServer serves the gRPC control API of w.
+type controlServer struct {
+	controlpb.UnimplementedControlServer
+	w *Watchdog
+	// ctx is the one of Run, which the restarts are done within
+	ctx context.Context
+}
+
+// serveGRPC serves the gRPC control API on ln until ctx is done.
+func (w *Watchdog) serveGRPC(ctx context.Context, ln net.Listener) {
+	srv := grpc.NewServer()
+	controlpb.RegisterControlServer(srv, &controlServer{w: w, ctx: ctx})
+	go func() {
+		<-ctx.Done()
+		srv.Stop()
+	}()
+
+	w.log.logf("SYSTEM", record{Level: "info", Event: "api"}, "serving the gRPC API on %v...", w.config().GRPCAddr)
+	err := srv.Serve(ln)
+	if err != nil && ctx.Err() == nil {
+		w.stop(fmt.Errorf("kelthuzad: serveGRPC: %w", err))
+	}
+}
+
+func (s *controlServer) Status(context.Context, *controlpb.StatusRequest) (*controlpb.StatusResponse, error) {
+	return toStatusResponse(s.w.status()), nil
+}
+
+func (s *controlServer) Restart(context.Context, *controlpb.RestartRequest) (*controlpb.StatusResponse, error) {
+	s.w.restartManually(s.ctx, "the API")
+	return toStatusResponse(s.w.status()), nil
+}
+
+func (s *controlServer) Pause(context.Context, *controlpb.PauseRequest) (*controlpb.StatusResponse, error) {
+	s.w.setPaused(true)
+	return toStatusResponse(s.w.status()), nil
+}
+
+func (s *controlServer) Resume(context.Context, *controlpb.ResumeRequest) (*controlpb.StatusResponse, error) {
+	s.w.setPaused(false)
+	return toStatusResponse(s.w.status()), nil
+}
+
+// Events streams the events of the requested types until the client cancels it or kelthuzad stops.
+// The events are dropped for the client which can't keep up with them.
+func (s *controlServer) Events(req *controlpb.EventsRequest, stream controlpb.Control_EventsServer) error {
+	for _, typ := range req.Types {
+		if !eventTypes[typ] {
+			return grpcstatus.Errorf(codes.InvalidArgument, "unknown type of the events %v", typ)
+		}
+	}
+	types := eventSet(req.Types)
+
+	events := s.w.hub.subscribe()
+	defer s.w.hub.unsubscribe(events)
+	for {
+		select {
+		case e := <-events:
+			if types != nil && !types[e.Type] {
+				continue
+			}
+			err := stream.Send(toEvent(e))
+			if err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		case <-s.ctx.Done():
+			return grpcstatus.Error(codes.Unavailable, "kelthuzad is stopping")
+		}
+	}
+}
+
+// toStatusResponse converts st to the message.
+func toStatusResponse(st status) *controlpb.StatusResponse {
+	res := &controlpb.StatusResponse{
+		Pid:      int32(st.Pid),
+		Running:  st.Running,
+		Ready:    st.Ready,
+		Uptime:   int64(st.Uptime),
+		Restarts: int32(st.Restarts),
+		Paused:   st.Paused,
+		Breaker:  st.Breaker,
+	}
+	for _, r := range st.History {
+		record := &controlpb.RestartRecord{
+			Time:    timestamppb.New(r.Time),
+			Reason:  r.Reason,
+			Line:    r.Line,
+			Pattern: r.Pattern,
+			Pid:     int32(r.Pid),
+		}
+		if r.ExitCode != nil {
+			code := int32(*r.ExitCode)
+			record.ExitCode = &code
+		}
+		res.History = append(res.History, record)
+	}
+	return res
+}
+
+// toEvent converts e to the message.
+func toEvent(e event) *controlpb.Event {
+	return &controlpb.Event{
+		Type:      e.Type,
+		Line:      e.Line,
+		Pattern:   e.Pattern,
+		Captures:  e.Captures,
+		Pid:       int32(e.Pid),
+		Pod:       e.Pod,
+		Restarts:  int32(e.Restarts),
+		Timestamp: timestamppb.New(e.Timestamp),
+	}
+}
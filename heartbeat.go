@@ -0,0 +1,78 @@
+package kelthuzad
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// startHeartbeat starts waiting for the heartbeat of p, which is ready, until ctx is done or stopHeartbeat.
+func (w *Watchdog) startHeartbeat(ctx context.Context, p *proc) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.beatCtx, w.beatProc = ctx, p
+	w.armHeartbeat()
+}
+
+// armHeartbeat replaces the timer which fails the process waiting for the heartbeat when none arrives in time,
+// which is none without w.heartbeat, with w.mu held. Reload arms it again for the heartbeat it changes.
+func (w *Watchdog) armHeartbeat() {
+	if w.beat != nil {
+		w.beat.Stop()
+		w.beat = nil
+	}
+	if w.heartbeat == nil || w.beatProc == nil {
+		return
+	}
+
+	ctx, p := w.beatCtx, w.beatProc
+	var beat *time.Timer
+	beat = time.AfterFunc(w.beatTimeout(), func() {
+		// the timer could fire while p is being replaced
+		if ctx.Err() != nil || w.current() != p {
+			return
+		}
+
+		// or while it's being replaced by a reload, which may have removed the heartbeat
+		w.mu.Lock()
+		stale := w.beat != beat || w.heartbeat == nil
+		w.mu.Unlock()
+		if stale {
+			return
+		}
+
+		// the detection is paused, so just wait for the next one
+		if w.isPaused() {
+			w.resetHeartbeat()
+			return
+		}
+
+		w.failLater(p, "probe-failure", fmt.Sprintf("no heartbeat in %v", w.beatTimeout()), w.config().HeartbeatPattern, nil)
+	})
+	w.beat = beat
+}
+
+// resetHeartbeat gives the process another timeout to send the next heartbeat.
+func (w *Watchdog) resetHeartbeat() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.beat != nil {
+		w.beat.Reset(w.beatTimeout())
+	}
+}
+
+// stopHeartbeat stops waiting for the heartbeat of the process which is gone.
+func (w *Watchdog) stopHeartbeat() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.beat != nil {
+		w.beat.Stop()
+		w.beat = nil
+	}
+	w.beatCtx, w.beatProc = nil, nil
+}
+
+// beatTimeout returns how long to wait for a heartbeat.
+func (w *Watchdog) beatTimeout() time.Duration {
+	return time.Duration(w.config().HeartbeatTimeout) * time.Second
+}
@@ -0,0 +1,82 @@
+package kelthuzad
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runHook runs the hook command string with the environment variables describing e, which is a template of e as well,
+// whose values are in the environment variables too.
+// The hook is killed with what it started if it runs longer than the hook timeout.
+func (w *Watchdog) runHook(hook string, e event) {
+	if hook == "" {
+		return
+	}
+
+	hook, values, err := renderCommand(e.Type, hook, e)
+	if err != nil {
+		w.log.logf("HOOK", record{Level: "warn", Event: "hook", Pid: e.Pid}, "%v %v", e.Type, err)
+		return
+	}
+
+	cmd := valueCommand(hook)
+	prepare(cmd, nil)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(hookEnv(e), values...)
+	cmd.WaitDelay = outputDelay
+
+	err = startOwned(cmd, -1, nil)
+	if err != nil {
+		w.log.logf("HOOK", record{Level: "warn", Event: "hook", Pid: e.Pid}, "%v %v", e.Type, err)
+		return
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		disown(cmd)
+		done <- err
+	}()
+
+	timeout := time.Duration(w.config().HookTimeout) * time.Second
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		w.log.logf("HOOK", record{Level: "warn", Event: "hook", Pid: e.Pid}, "%v didn't finish in %v, killing...", e.Type, timeout)
+		killGroup(cmd)
+		err = <-done
+	}
+
+	if err != nil {
+		w.log.logf("HOOK", record{Level: "warn", Event: "hook", Pid: e.Pid}, "%v %v", e.Type, err)
+	}
+}
+
+// hookEnv returns the environment with the variables describing e.
+func hookEnv(e event) []string {
+	env := append(os.Environ(),
+		"KELTHUZAD_EVENT="+e.Type,
+		"KELTHUZAD_LINE="+e.Line,
+		"KELTHUZAD_PATTERN="+e.Pattern,
+		"KELTHUZAD_PID="+strconv.Itoa(e.Pid),
+		"KELTHUZAD_RESTARTS="+strconv.Itoa(e.Restarts),
+	)
+	if e.Cause != "" {
+		env = append(env, "KELTHUZAD_CAUSE="+e.Cause)
+	}
+	if e.Pod != "" {
+		env = append(env, "KELTHUZAD_POD="+e.Pod)
+	}
+	if len(e.Context) > 0 {
+		env = append(env, "KELTHUZAD_CONTEXT="+strings.Join(e.Context, "\n"))
+	}
+	// every named group of the pattern and field of JSON is KELTHUZAD_CAPTURE_ with its name uppercased,
+	// where the dots of a nested field are underscores
+	for name, value := range e.Captures {
+		env = append(env, "KELTHUZAD_CAPTURE_"+strings.ToUpper(strings.ReplaceAll(name, ".", "_"))+"="+value)
+	}
+	return env
+}
@@ -0,0 +1,72 @@
+package kelthuzad
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"time"
+)
+
+// forwardTimeout is how long to wait for the process to take a line forwarded.
+const forwardTimeout = 5 * time.Second
+
+// forwardStdin forwards every line of the stdin of kelthuzad to the stdin of the current process until ctx is done
+// or stdin is closed. The lines while it's being respawned are dropped, since nobody is there to take them.
+func (w *Watchdog) forwardStdin(ctx context.Context) {
+	if !w.config().Interactive {
+		return
+	}
+
+	// the stdin can't be read until ctx is done, so it's read aside
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		reader := bufio.NewReader(os.Stdin)
+		for {
+			line, err := reader.ReadString('\n')
+			if line != "" {
+				select {
+				case lines <- line:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err != nil {
+				if err != io.EOF {
+					w.log.logf("SYSTEM", record{Level: "warn", Event: "error"}, "reading stdin %v", err)
+				}
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				w.log.logf("SYSTEM", record{Level: "info", Event: "monitor"}, "stdin is closed, so nothing is forwarded anymore")
+				return
+			}
+
+			cur := w.current()
+			if cur == nil || cur.stdin == nil || isClosed(cur.done) {
+				w.log.logf("SYSTEM", record{Level: "warn", Event: "monitor"}, "not forwarding the line while respawning")
+				continue
+			}
+			// the last line may not end with a newline, which the process waits for
+			if line[len(line)-1] != '\n' {
+				line += "\n"
+			}
+
+			// the deadline of a ping is on the same pipe, and a wedged process mustn't block forwarding forever
+			cur.stdin.SetWriteDeadline(time.Now().Add(forwardTimeout))
+			_, err := cur.stdin.WriteString(line)
+			if err != nil && !isClosed(cur.done) {
+				w.log.logf("SYSTEM", record{Level: "warn", Event: "error", Pid: cur.pid}, "forwarding stdin %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package kelthuzad
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// join reports the status and the metrics to the coordinator of Join every JoinInterval until ctx is done,
+// and takes the actions it replies, which are queued there for this agent.
+func (w *Watchdog) join(ctx context.Context) {
+	if w.config().Join == "" {
+		return
+	}
+
+	host, _ := os.Hostname()
+	id := w.name + "@" + host
+	client := &http.Client{Timeout: 10 * time.Second}
+	url := strings.TrimSuffix(w.config().Join, "/") + "/report"
+	w.log.logf("SYSTEM", record{Level: "info", Event: "join"}, "joining %v as %v...", w.config().Join, id)
+
+	ticker := time.NewTicker(time.Duration(w.config().JoinInterval) * time.Second)
+	defer ticker.Stop()
+	var failing bool
+	for {
+		actions, err := w.report(ctx, client, url, report{ID: id, Service: w.name, Host: host, Interval: w.config().JoinInterval, DependsOn: w.config().DependsOn, Group: w.config().RestartGroup})
+		switch {
+		case err != nil && ctx.Err() != nil:
+			return
+		case err != nil && !failing:
+			// the coordinator being down is told once, not every interval
+			w.log.logf("SYSTEM", record{Level: "warn", Event: "join"}, "join %v, retrying every %vs", err, w.config().JoinInterval)
+			failing = true
+		case err == nil && failing:
+			w.log.logf("SYSTEM", record{Level: "info", Event: "join"}, "reporting to %v again", w.config().Join)
+			failing = false
+		}
+		for _, action := range actions {
+			w.act(ctx, action)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// report posts rep with the current status and metrics to url, and returns the actions replied.
+func (w *Watchdog) report(ctx context.Context, client *http.Client, url string, rep report) ([]string, error) {
+	var metrics strings.Builder
+	w.metrics.write(&metrics)
+	rep.Status, rep.Metrics = w.status(), metrics.String()
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.config().JoinToken != "" {
+		req.Header.Set("Authorization", "Bearer "+w.config().JoinToken)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the coordinator responded %v", resp.Status)
+	}
+
+	var rp reply
+	err = json.NewDecoder(resp.Body).Decode(&rp)
+	return rp.Actions, err
+}
+
+// act takes action forwarded by the coordinator as the API does.
+func (w *Watchdog) act(ctx context.Context, action string) {
+	switch action {
+	case "restart":
+		w.restartManually(ctx, "the coordinator")
+	case "pause":
+		w.setPaused(true)
+	case "resume":
+		w.setPaused(false)
+	case "stop":
+		w.log.logf("SYSTEM", record{Level: "info", Event: "stop"}, "stopping by the coordinator...")
+		w.stop(nil)
+	}
+}
@@ -0,0 +1,72 @@
+package kelthuzad
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// loadJournal reads the latest restarts in the journal of path, and compacts it to them to keep it small.
+// It returns nothing when the journal doesn't exist yet.
+func loadJournal(path string) ([]restart, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("kelthuzad: journal: %w", err)
+	}
+
+	var history []restart
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r restart
+		// a line broken by a crash in the middle of writing is skipped
+		if json.Unmarshal(scanner.Bytes(), &r) != nil {
+			continue
+		}
+		history = append(history, r)
+	}
+	f.Close()
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("kelthuzad: journal: %w", err)
+	}
+	if len(history) > maxHistory {
+		history = history[len(history)-maxHistory:]
+	}
+
+	// rewrite it with the latest ones and replace it at once
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return nil, fmt.Errorf("kelthuzad: journal: %w", err)
+	}
+	enc := json.NewEncoder(out)
+	for _, r := range history {
+		enc.Encode(r)
+	}
+	err = out.Close()
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("kelthuzad: journal: %w", err)
+	}
+
+	return history, nil
+}
+
+// appendJournal appends r to the journal of path.
+func appendJournal(path string, r restart) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(f).Encode(r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,117 @@
+package kelthuzad
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// journalRetry is how long to wait before following the journal again when journalctl exits.
+const journalRetry = 5 * time.Second
+
+// entry is an entry of the systemd journal printed by journalctl -o json.
+type entry struct {
+	Cursor  string          `json:"__CURSOR"`
+	Message json.RawMessage `json:"MESSAGE"`
+}
+
+// message returns the message of e, which is an array of bytes when it isn't valid UTF-8.
+func (e *entry) message() string {
+	var text string
+	if json.Unmarshal(e.Message, &text) == nil {
+		return text
+	}
+
+	var raw []int
+	if json.Unmarshal(e.Message, &raw) == nil {
+		b := make([]byte, len(raw))
+		for i, c := range raw {
+			b[i] = byte(c)
+		}
+		return string(b)
+	}
+
+	return ""
+}
+
+// monitorJournald follows the journal of JournaldUnit by journalctl and checks each line of the messages until ctx is done.
+// journalctl is run again when it exits, and goes on right after the last entry seen.
+func (w *Watchdog) monitorJournald(ctx context.Context) {
+	if _, err := exec.LookPath("journalctl"); err != nil {
+		w.stop(fmt.Errorf("kelthuzad: monitorJournald: %w", err))
+		return
+	}
+
+	w.log.logf("SYSTEM", record{Level: "info", Event: "monitor"}, "monitoring the journal of %v...", w.config().JournaldUnit)
+	var cursor string
+	for {
+		err := w.followJournal(ctx, &cursor)
+		if ctx.Err() != nil {
+			return
+		}
+
+		w.log.logf("SYSTEM", record{Level: "warn", Event: "journald"}, "journalctl %v, following again in %v...", err, journalRetry)
+		if !sleep(ctx, journalRetry) {
+			return
+		}
+	}
+}
+
+// followJournal runs journalctl until it exits or ctx is done, and checks the lines of the new entries.
+// It starts after cursor if given, or from the next entry, and keeps cursor at the last entry seen.
+func (w *Watchdog) followJournal(ctx context.Context, cursor *string) error {
+	args := []string{"--follow", "--output", "json", "--unit", w.config().JournaldUnit}
+	if *cursor != "" {
+		args = append(args, "--after-cursor", *cursor)
+	} else {
+		args = append(args, "--lines", "0")
+	}
+	cmd := exec.CommandContext(ctx, "journalctl", args...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	err = startOwned(cmd, -1, nil)
+	if err != nil {
+		return err
+	}
+	defer disown(cmd)
+
+	// a message can be longer than a line can be, so the entries are decoded as they come
+	decoder := json.NewDecoder(stdout)
+	for {
+		var e entry
+		err = decoder.Decode(&e)
+		if err != nil {
+			break
+		}
+		*cursor = e.Cursor
+
+		for _, line := range strings.Split(strings.TrimRight(e.message(), "\n"), "\n") {
+			if len(line) > w.config().MaxLineSize {
+				w.log.logf("SYSTEM", record{Level: "warn", Event: "truncate"}, "a line over %v bytes is truncated", w.config().MaxLineSize)
+				line = line[:w.config().MaxLineSize]
+			}
+			w.check(ctx, cleanLine(w.config(), line))
+		}
+	}
+
+	// it may be still running when an entry is malformed
+	cmd.Process.Kill()
+	waitErr := cmd.Wait()
+	if err != io.EOF {
+		return fmt.Errorf("malformed entry: %w", err)
+	}
+	if waitErr != nil {
+		return waitErr
+	}
+	return errors.New("exited")
+}
@@ -0,0 +1,190 @@
+package kelthuzad
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// jsonField is a condition on the field of a line of JSON, which is nested by the path.
+type jsonField struct {
+	name string
+	path []string
+	re   matcher
+}
+
+// jsonRule detects a failure in a line of JSON by its fields, all or any of which must match,
+// or in any line by the expression of Rule.
+type jsonRule struct {
+	fields []jsonField
+	any    bool
+	expr   ruleNode
+	source string
+}
+
+// compileRule compiles cfg.Rule, or cfg.JSONFields as cfg.JSONMatch tells, and returns nil without either.
+func compileRule(cfg *Config) (*jsonRule, error) {
+	if cfg.Rule == "" {
+		return compileJSONRule(cfg, cfg.JSONFields, cfg.JSONMatch)
+	}
+
+	expr, err := compileRuleExpr(cfg, cfg.Rule)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonRule{expr: expr, source: cfg.Rule}, nil
+}
+
+// compileJSONRule compiles fields of field=regex as cfg tells, and returns nil without any.
+func compileJSONRule(cfg *Config, fields []string, match string) (*jsonRule, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	r := &jsonRule{any: match == "any"}
+	for _, field := range fields {
+		name, pattern, ok := strings.Cut(field, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("kelthuzad: JSONField %v must be field=regex", field)
+		}
+		re, err := compile(cfg, pattern)
+		if err != nil {
+			return nil, fmt.Errorf("kelthuzad: JSONField %v: %w", field, err)
+		}
+		r.fields = append(r.fields, jsonField{name: name, path: strings.Split(name, "."), re: re})
+	}
+
+	return r, nil
+}
+
+// match reports whether line is an object of JSON whose fields match, or meets the expression,
+// and returns the values of the matching fields by their names and the named groups of the expression.
+func (r *jsonRule) match(line string) (bool, map[string]string) {
+	if r.expr != nil {
+		values := make(map[string]string)
+		if !r.expr.eval(&ruleLine{text: line}, values) {
+			return false, nil
+		}
+		return true, values
+	}
+
+	object := decodeObject(line)
+	if object == nil {
+		return false, nil
+	}
+
+	values := make(map[string]string)
+	for _, field := range r.fields {
+		value, ok := lookup(object, field.path)
+		if ok && field.re.MatchString(value) {
+			values[field.name] = value
+		} else if !r.any {
+			return false, nil
+		}
+	}
+	if len(values) == 0 {
+		return false, nil
+	}
+	return true, values
+}
+
+// String describes the conditions as the fields joined by && or ||, or as the expression.
+func (r *jsonRule) String() string {
+	if r.expr != nil {
+		return r.source
+	}
+
+	var fields []string
+	for _, field := range r.fields {
+		fields = append(fields, field.name+"="+field.re.String())
+	}
+	if r.any {
+		return strings.Join(fields, " || ")
+	}
+	return strings.Join(fields, " && ")
+}
+
+// decodeObject returns the object of JSON which line is, or nil if it isn't one.
+func decodeObject(line string) map[string]interface{} {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "{") {
+		return nil
+	}
+	var object map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+	if decoder.Decode(&object) != nil {
+		return nil
+	}
+	return object
+}
+
+// lookup returns the value at path in object, which is the JSON of the value unless it's a string.
+func lookup(object map[string]interface{}, path []string) (string, bool) {
+	var value interface{} = object
+	for _, key := range path {
+		o, ok := value.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		value, ok = o[key]
+		if !ok {
+			return "", false
+		}
+	}
+
+	if s, ok := value.(string); ok {
+		return s, true
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
+}
+
+// detect reports whether text, which is the latest lines ending with line, is a failure by pattern and rule,
+// both of which must match if given, and returns the named groups and the fields they captured.
+func detect(pattern matcher, rule *jsonRule, text string, line string) (bool, map[string]string) {
+	if pattern == nil && rule == nil {
+		return false, nil
+	}
+
+	var captures map[string]string
+	if pattern != nil {
+		if !pattern.MatchString(text) {
+			return false, nil
+		}
+		captures = capture(pattern, text)
+	}
+
+	// a line of JSON is a whole object, so the fields are of the line rather than the latest lines
+	if rule != nil {
+		ok, values := rule.match(line)
+		if !ok {
+			return false, nil
+		}
+		if captures == nil {
+			captures = make(map[string]string)
+		}
+		for name, value := range values {
+			captures[name] = value
+		}
+	}
+
+	return true, captures
+}
+
+// criteria describes what detects a failure in a line, which is pattern and the fields of rule.
+func criteria(pattern string, rule *jsonRule) string {
+	switch {
+	case rule == nil:
+		return pattern
+	case pattern == "":
+		return rule.String()
+	case rule.expr != nil || (rule.any && len(rule.fields) > 1):
+		return pattern + " && (" + rule.String() + ")"
+	default:
+		return pattern + " && " + rule.String()
+	}
+}
@@ -1,192 +1,1709 @@
-package main
+// Package kelthuzad watches a process, kills a sick one and respawns a normal one.
+package kelthuzad
 
 import (
-	"bufio"
-	"github.com/hpcloud/tail"
-	"github.com/jessevdk/go-flags"
-	"io"
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"net"
 	"os"
 	"os/exec"
-	"os/signal"
-	"regexp"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"text/template"
 	"time"
 )
 
-// Kelthuzad monitors a log or stdout, kills a sick one and respawns a normal one.
-type Kelthuzad struct {
-	cmd        *exec.Cmd
-	opt        *opts
-	pattern    *regexp.Regexp
-	stdout     io.ReadCloser
-	isSpawning bool
+// ErrGiveUp is returned by Run when the process was respawned too often within the restart window,
+// or when the restart budget was used up if it gives up then.
+var ErrGiveUp = errors.New("kelthuzad: gave up respawning")
+
+// Watchdog monitors a log or stdout, kills a sick one and respawns a normal one.
+type Watchdog struct {
+	proc       *proc
+	gen        int
+	spawning   bool
+	cfg        atomic.Pointer[Config]
+	pattern    matcher
+	excludes   *patternSet
+	rule       *jsonRule
+	sequence   *sequence
+	detectors  []*detector
+	goPlugins  []*goPlugin
+	criteria   string
+	heartbeat  matcher
+	ready      matcher
+	readyTimer *time.Timer
+	readyAt    time.Time
+	beat       *time.Timer
+	beatCtx    context.Context
+	beatProc   *proc
+	matches    []time.Time
+	seen       int
+	queued     *proc
+	lines      []string
+	env        []envVar
+	cred       *credential
+	umask      int
+	limits     []rlimit
+	cgroup     *cgroup
+	sink       *sink
+	tees       []*tee
+	telemetry  *telemetry
+	docker     *docker
+	elector    elector
+	syslog     *syslogServer
+	exitCode   int
+	probers    []prober
+	probeRes   []probeResult
+	pingLine   *template.Template
+	pingToken  string
+	pingEcho   chan struct{}
+	capture    *os.File
+	recent     *ring
+	log        *logger
+	mu         sync.Mutex
+	paused     bool
+	restartLog []restart
+	argv       []string
+	outputs    chan output
+	failures   chan failure
+	name       string
+	backoff    atomic.Pointer[backoff]
+	breaker    *breaker
+	budget     *budget
+	spawnedAt  time.Time
+	notifier   atomic.Pointer[notifier]
+	metrics    *metrics
+	severities []severity
+	statsd     *statsd
+	hub        *hub
+	restarts   int
+	history    []time.Time
+	stopped    chan error
+	manual     chan string
 }
 
-// opts have several options for argument parsing.
-type opts struct {
-	LogPath    string `short:"l" long:"logPath" description:"The path of the log instead of stdout"`
-	CmdPath    string `short:"c" long:"commandPath" description:"The path of a file containing command string to respawn the process"`
-	RawCommand string `short:"r" long:"rawCommand" description:"The command string to spawn the process"`
-	Pattern    string `short:"p" long:"pattern" description:"The regex pattern to detect a failure" required:"true"`
-	Quiet      bool   `short:"q" long:"quiet" description:"Suppress the ouputs of process which is monitored"`
-	Delay      int    `short:"d" long:"delay" description:"The seconds for waiting after respawning" default:"5"`
+// Config has several options of a Watchdog.
+// The go-flags tags describe the command line options and the yaml tags the keys of the config file.
+type Config struct {
+	LogPath          []string `short:"l" long:"logPath" description:"The path or glob of the logs instead of stdout (repeatable)" yaml:"logPath"`
+	TailFrom         string   `long:"tailFrom" description:"Where to start reading the logs which are there from the start, which is end, start, offset:BYTES or lines:N of the last lines" default:"end" yaml:"tailFrom"`
+	TailPoll         int      `long:"tailPoll" description:"The milliseconds between polling the logs for the changes instead of inotify, which doesn't notice them on NFS and the like, 0 means inotify" default:"0" yaml:"tailPoll"`
+	StateDir         string   `long:"stateDir" description:"The directory to keep the read offsets of the logs in, to resume reading them where kelthuzad left off" yaml:"stateDir"`
+	JournaldUnit     string   `long:"journaldUnit" description:"The systemd unit whose journal is followed by journalctl instead of stdout" yaml:"journaldUnit"`
+	Stdin            bool     `long:"stdin" description:"Monitor the stdin of kelthuzad at the end of a pipeline instead of stdout of the process" yaml:"stdin"`
+	Interactive      bool     `long:"interactive" description:"Forward the lines of the stdin of kelthuzad to the stdin of the process, which is attached again after a respawn" yaml:"interactive"`
+	Pty              bool     `long:"pty" description:"Run the process under a pseudo-terminal, whose output is monitored as the one stream pty, to have it line-buffered and behave as it does in a terminal" yaml:"pty"`
+	SyslogListen     string   `long:"syslogListen" description:"The address to receive syslog on over UDP and TCP instead of stdout, whose lines are checked as \"host app[pid]: message\"" yaml:"syslogListen"`
+	DockerContainer  string   `long:"dockerContainer" description:"The name or ID of the Docker container to monitor the logs of and restart via the Docker API, instead of spawning a process" yaml:"dockerContainer"`
+	KubeSelector     string   `long:"kubeSelector" description:"The label selector of the Kubernetes pods to monitor the logs of and delete on a failure, instead of spawning a process" yaml:"kubeSelector"`
+	KubeNamespace    string   `long:"kubeNamespace" description:"The namespace of the pods, which is the one kelthuzad runs in by default" yaml:"kubeNamespace"`
+	KubeContainer    string   `long:"kubeContainer" description:"The container of the pods to monitor, which is the first one by default" yaml:"kubeContainer"`
+	KubeLease        string   `long:"kubeLease" description:"The name of the lease for the replicas of kelthuzad to elect the one acting" default:"kelthuzad" yaml:"kubeLease"`
+	LeaderLock       string   `long:"leaderLock" description:"The lock for the instances of kelthuzad supervising the same service to elect the one running it, which is file:PATH, consul:URL/KEY or etcd:URL/KEY" yaml:"leaderLock"`
+	Kubeconfig       string   `long:"kubeconfig" description:"The path of the kubeconfig to use out of the cluster" env:"KUBECONFIG" yaml:"kubeconfig"`
+	DockerHost       string   `long:"dockerHost" description:"The address of the Docker API, which is host:port or unix:/path/to/socket" default:"unix:/var/run/docker.sock" yaml:"dockerHost"`
+	CmdPath          string   `short:"c" long:"commandPath" description:"The path of a file containing command string to respawn the process" yaml:"commandPath"`
+	RawCommand       string   `short:"r" long:"rawCommand" description:"The command string to spawn the process" yaml:"rawCommand"`
+	Shell            bool     `long:"shell" description:"Run commandPath via /bin/sh -c to have pipes and expand variables, with the trailing arguments as $1 and so on" yaml:"shell"`
+	SSH              string   `long:"ssh" description:"The [user@]host to run the command on by ssh, whose output is streamed back, and which is killed once the connection is gone" yaml:"ssh"`
+	SSHOptions       []string `long:"sshOption" description:"The option of ssh as name=value, such as Port=2222 or IdentityFile=~/.ssh/agent (repeatable)" yaml:"sshOptions"`
+	WaitForFile      []string `long:"waitForFile" description:"The path of a file, such as a socket or a config, which must exist before spawning the process every time (repeatable)" yaml:"waitForFile"`
+	WaitForPort      []string `long:"waitForPort" description:"The host:port which must accept a connection before spawning the process every time (repeatable)" yaml:"waitForPort"`
+	WaitTimeout      int      `long:"waitTimeout" description:"The seconds for waiting the files and the ports before giving up, 0 means forever" default:"0" yaml:"waitTimeout"`
+	Pattern          string   `short:"p" long:"pattern" description:"The regex pattern to detect a failure" yaml:"pattern"`
+	IgnoreCase       bool     `short:"i" long:"ignoreCase" description:"Match the patterns of the lines ignoring the case" yaml:"ignoreCase"`
+	FixedString      bool     `short:"F" long:"fixedString" description:"Match the patterns of the lines as the plain strings contained, which is faster than the regexps" yaml:"fixedString"`
+	RegexFlavor      string   `long:"regexFlavor" description:"The syntax of the patterns of the lines, where pcre needs kelthuzad built with -tags pcre" choice:"re2" choice:"pcre" default:"re2" yaml:"regexFlavor"`
+	JSONFields       []string `long:"jsonField" description:"The field=regex of the lines of JSON to detect a failure, where the field can be nested as a.b (repeatable)" yaml:"jsonFields"`
+	JSONMatch        string   `long:"jsonMatch" description:"Whether all or any of the JSON fields must match" choice:"all" choice:"any" default:"all" yaml:"jsonMatch"`
+	Rule             string   `long:"rule" description:"The expression to detect a failure in a line, which combines /REGEX/ and json.FIELD ==, !=, =~ or !~ by AND, OR, NOT and the parentheses, such as (/A/ AND NOT /B/) OR json.level == fatal" yaml:"rule"`
+	Sequence         []string `long:"sequence" description:"The regex pattern of a step of the sequence detecting a failure once the lines of a process match all the steps in order within SequenceWindow (repeatable)" yaml:"sequence"`
+	SequenceWindow   int      `long:"sequenceWindow" description:"The seconds from the first step of the sequence within which the rest must follow" default:"30" yaml:"sequenceWindow"`
+	Detectors        []string `long:"detector" description:"The command of a detector plugin, which gets the lines on stdin and prints FAIL on stdout to detect a failure (repeatable)" yaml:"detectors"`
+	GoPlugins        []string `long:"goPlugin" description:"The path of a Go plugin exporting Detect as func(line string) (bool, string) to detect a failure (repeatable)" yaml:"goPlugins"`
+	PluginBudget     int      `long:"pluginBudget" description:"The milliseconds a Go plugin can take to check a line, over which the lines are skipped until it returns" default:"100" yaml:"pluginBudget"`
+	ExcludePatterns  []string `long:"excludePattern" description:"The regex pattern of the benign lines which never match the pattern (repeatable)" yaml:"excludePatterns"`
+	HeartbeatPattern string   `long:"heartbeatPattern" description:"The regex pattern of a heartbeat, whose absence is a failure" yaml:"heartbeatPattern"`
+	HeartbeatTimeout int      `long:"heartbeatTimeout" description:"The seconds for waiting a heartbeat before respawning" default:"60" yaml:"heartbeatTimeout"`
+	ReadyPattern     string   `long:"readyPattern" description:"The regex pattern of the line telling the process is ready, before which it isn't probed nor healthy" yaml:"readyPattern"`
+	ReadyTimeout     int      `long:"readyTimeout" description:"The seconds for waiting the process to get ready before respawning" default:"60" yaml:"readyTimeout"`
+	FailThreshold    int      `long:"failThreshold" description:"The number of matches within the fail window to detect a failure" default:"1" yaml:"failThreshold"`
+	FailWindow       int      `long:"failWindow" description:"The seconds of the window counting the matches for failThreshold" default:"60" yaml:"failWindow"`
+	Cooldown         int      `long:"cooldown" description:"The seconds after a respawn during which the matches are counted but don't fail the process again" default:"0" yaml:"cooldown"`
+	MaxLineSize      int      `long:"maxLineSize" description:"The bytes of a line, over which it's truncated for the stdout and split for the log" default:"1048576" yaml:"maxLineSize"`
+	StripANSI        bool     `long:"stripAnsi" description:"Strip the ANSI escape sequences, such as the colors, of the lines before matching and logging them" yaml:"stripAnsi"`
+	ReplaceInvalid   bool     `long:"replaceInvalid" description:"Replace the invalid UTF-8 and the control characters but tab of the lines by U+FFFD before matching and logging them" yaml:"replaceInvalid"`
+	MultilineLines   int      `long:"multilineLines" description:"The number of the latest lines joined by newlines to match the pattern at once, for a stack trace and so on" default:"1" yaml:"multilineLines"`
+	HTTPProbe        string   `long:"httpProbe" description:"The URL to request periodically, whose failures in a row are a failure" yaml:"httpProbe"`
+	ProbeStatus      int      `long:"probeStatus" description:"The status code expected from the HTTP probe" default:"200" yaml:"probeStatus"`
+	ProbeBody        string   `long:"probeBodyPattern" description:"The regex pattern expected in the body from the HTTP probe" yaml:"probeBodyPattern"`
+	TCPProbe         string   `long:"tcpProbe" description:"The host:port to connect periodically, whose failures in a row are a failure" yaml:"tcpProbe"`
+	ExecProbe        string   `long:"execProbe" description:"The command string to run periodically, whose nonzero exits in a row are a failure" yaml:"execProbe"`
+	ProbeInterval    int      `long:"probeInterval" description:"The seconds between probes" default:"10" yaml:"probeInterval"`
+	ProbeTimeout     int      `long:"probeTimeout" description:"The seconds for waiting a probe to respond" default:"5" yaml:"probeTimeout"`
+	ProbeFailures    int      `long:"probeFailures" description:"The number of probe failures in a row to detect a failure" default:"3" yaml:"probeFailures"`
+	PingInterval     int      `long:"pingInterval" description:"The seconds between pings which write a token to the stdin of the process to be echoed on the monitored streams, 0 means never" default:"0" yaml:"pingInterval"`
+	PingLine         string   `long:"pingLine" description:"The line written to the stdin of the process as a ping, which must refer to the token as {{.Token}}" default:"{{.Token}}" yaml:"pingLine"`
+	PingTimeout      int      `long:"pingTimeout" description:"The seconds for waiting the token of a ping to be echoed" default:"5" yaml:"pingTimeout"`
+	PingMisses       int      `long:"pingMisses" description:"The number of missed pings in a row to detect a failure" default:"3" yaml:"pingMisses"`
+	MaxMemory        int      `long:"maxMemory" description:"The megabytes of the resident memory of the process and its descendants, over which for the resource period is a failure" default:"0" yaml:"maxMemory"`
+	MaxCPU           int      `long:"maxCPU" description:"The CPU percent of the process and its descendants, over which for the resource period is a failure" default:"0" yaml:"maxCPU"`
+	ResourcePeriod   int      `long:"resourcePeriod" description:"The seconds of staying over maxMemory or maxCPU to detect a failure" default:"30" yaml:"resourcePeriod"`
+	ResourceInterval int      `long:"resourceInterval" description:"The seconds between sampling the memory and the CPU" default:"5" yaml:"resourceInterval"`
+	MaxRate          float64  `long:"maxRate" description:"The lines per second, over which for the rate period is a failure" default:"0" yaml:"maxRate"`
+	MinRate          float64  `long:"minRate" description:"The lines per second, under which for the rate period is a failure" default:"0" yaml:"minRate"`
+	RatePeriod       int      `long:"ratePeriod" description:"The seconds of staying over maxRate or under minRate to detect a failure" default:"60" yaml:"ratePeriod"`
+	RateInterval     int      `long:"rateInterval" description:"The seconds between measuring the rate of the lines" default:"5" yaml:"rateInterval"`
+	FreezeWindows    []string `long:"freezeWindow" description:"The local time window of HH:MM-HH:MM during which a failure is only notified and the restart waits for the end of it (repeatable)" yaml:"freezeWindows"`
+	RestartAt        []string `long:"restartAt" description:"The local time of HH:MM to restart the process preventively every day (repeatable)" yaml:"restartAt"`
+	RestartCron      []string `long:"restartCron" description:"The cron expression of minute, hour, day of month, month and day of week in the local time, such as '0 3 * * 0' or @weekly, to restart the process preventively (repeatable)" yaml:"restartCron"`
+	Init             bool     `long:"init" description:"Reap the orphaned zombies as an init process of a container does (Linux only)" yaml:"init"`
+	DryRun           bool     `long:"dryRun" description:"Only report the failures and what would be done, without killing the process" yaml:"dryRun"`
+	LogLevel         string   `long:"logLevel" description:"The lowest level of the logs and the lines of the process echoed, where debug logs in detail what kelthuzad sees, such as the excluded lines, the heartbeats and the healthy probes, and SIGUSR2 toggles it at runtime" choice:"debug" choice:"info" choice:"warn" choice:"error" default:"info" yaml:"logLevel"`
+	SeverityPatterns []string `long:"severityPattern" description:"The LEVEL=REGEX classifying a line of the process as debug, info, warn or error by the first matching one, which is info if none does (repeatable)" default:"error=(?i)\\b(error|fatal|panic|crit(ical)?)\\b" default:"warn=(?i)\\bwarn(ing)?\\b" default:"debug=(?i)\\b(debug|trace)\\b" yaml:"severityPatterns"`
+	Quiet            bool     `short:"q" long:"quiet" description:"Suppress the ouputs of process which is monitored" yaml:"quiet"`
+	Passthrough      bool     `long:"passthrough" description:"Print every line of the monitored streams to stdout prefixed by the time, the name and the stream, instead of logging the normal lines" yaml:"passthrough"`
+	Name             string   `long:"name" description:"The name of the process prefixed to the lines passed through, which is the base name of the command by default" yaml:"name"`
+	Delay            int      `short:"d" long:"delay" description:"The seconds for waiting after respawning" default:"5" yaml:"delay"`
+	Streams          string   `short:"s" long:"streams" description:"The streams of the process to monitor instead of the log" choice:"stdout" choice:"stderr" choice:"both" default:"stdout" yaml:"streams"`
+	QueueSize        int      `long:"queueSize" description:"The lines of the process queued to be checked, over which they're blocked or dropped as QueueFull tells" default:"1024" yaml:"queueSize"`
+	QueueFull        string   `long:"queueFull" description:"Whether to block the lines of the process, which may stall it, or to drop them while the queue is full" choice:"block" choice:"drop" default:"block" yaml:"queueFull"`
+	Matchers         int      `long:"matchers" description:"The workers matching the lines of the process side by side, which needs MultilineLines of 1" default:"1" yaml:"matchers"`
+	Multiplier       float64  `short:"m" long:"multiplier" description:"The multiplier of the delay on every consecutive respawn" default:"1" yaml:"multiplier"`
+	MaxDelay         int      `long:"maxDelay" description:"The maximum seconds for waiting after respawning" default:"300" yaml:"maxDelay"`
+	ResetAfter       int      `long:"resetAfter" description:"The seconds of running healthy after which the delay goes back to the initial one, never by 0" default:"60" yaml:"resetAfter"`
+	Jitter           int      `long:"jitter" description:"The percent of the delay to randomly lengthen or shorten it by, not to respawn the same processes of many kelthuzad at once" default:"0" yaml:"jitter"`
+	Restart          string   `short:"R" long:"restart" description:"The policy to respawn the process when it exits by itself" choice:"always" choice:"on-failure" choice:"never" default:"always" yaml:"restart"`
+	Env              []string `short:"e" long:"env" description:"The KEY=VALUE to set in the environment of the process, where VALUE can refer to {{.Restarts}} and {{.KelthuzadPid}} (repeatable)" yaml:"env"`
+	EnvFile          string   `long:"envFile" description:"The path of a file of KEY=VALUE lines to set in the environment of the process, which are overridden by env" yaml:"envFile"`
+	User             string   `short:"u" long:"user" description:"The name or uid of the user to run the process as" yaml:"user"`
+	Group            string   `long:"group" description:"The name or gid of the group to run the process as, instead of the primary group of the user" yaml:"group"`
+	Chdir            string   `long:"chdir" description:"The working directory of the process" yaml:"chdir"`
+	Umask            string   `long:"umask" description:"The octal file-creation mask of the process such as 027" yaml:"umask"`
+	LimitNofile      string   `long:"limitNofile" description:"The limit of the open files of the process as soft[:hard], where either can be unlimited" yaml:"limitNofile"`
+	LimitCore        string   `long:"limitCore" description:"The limit of the bytes of a core dump of the process as soft[:hard]" yaml:"limitCore"`
+	LimitNproc       string   `long:"limitNproc" description:"The limit of the processes of the user of the process as soft[:hard]" yaml:"limitNproc"`
+	LimitMemlock     string   `long:"limitMemlock" description:"The limit of the bytes of the locked memory of the process as soft[:hard]" yaml:"limitMemlock"`
+	LimitStack       string   `long:"limitStack" description:"The limit of the bytes of the stack of the process as soft[:hard]" yaml:"limitStack"`
+	LimitAs          string   `long:"limitAs" description:"The limit of the bytes of the address space of the process as soft[:hard]" yaml:"limitAs"`
+	Cgroup           string   `long:"cgroup" description:"The cgroup v2 dedicated to the process and its descendants, which is under the mount point of cgroup v2 unless absolute (Linux only)" yaml:"cgroup"`
+	CgroupMemory     int      `long:"cgroupMemory" description:"The megabytes of memory.max of the cgroup" default:"0" yaml:"cgroupMemory"`
+	CgroupCPU        int      `long:"cgroupCPU" description:"The CPU percent of cpu.max of the cgroup, which can be over 100 on multiple cores" default:"0" yaml:"cgroupCPU"`
+	Grace            int      `short:"g" long:"gracePeriod" description:"The seconds for waiting the process to exit after SIGTERM before SIGKILL" default:"10" yaml:"gracePeriod"`
+	Webhooks         []string `short:"w" long:"webhook" description:"The URL to post the events to as JSON (repeatable)" yaml:"webhooks"`
+	WebhookEvents    []string `long:"webhookEvent" description:"The type of the events to post to the webhooks, which is spawn, ready, match, fail, kill, respawn, give-up or breaker-open (repeatable)" default:"fail" default:"kill" default:"respawn" default:"give-up" default:"breaker-open" yaml:"webhookEvents"`
+	Slack            []string `long:"slack" description:"The URL of a Slack incoming webhook to post the events to (repeatable)" yaml:"slack"`
+	SlackEvents      []string `long:"slackEvent" description:"The type of the events to post to Slack, which is spawn, ready, match, fail, kill, respawn, give-up or breaker-open (repeatable)" default:"fail" default:"give-up" default:"breaker-open" yaml:"slackEvents"`
+	SMTPAddr         string   `long:"smtpAddr" description:"The host:port of the SMTP server to send the emails" yaml:"smtpAddr"`
+	SMTPUser         string   `long:"smtpUser" description:"The user to authenticate to the SMTP server" yaml:"smtpUser"`
+	SMTPPassword     string   `long:"smtpPassword" description:"The password to authenticate to the SMTP server" env:"KELTHUZAD_SMTP_PASSWORD" yaml:"smtpPassword"`
+	EmailFrom        string   `long:"emailFrom" description:"The address to send the emails from" yaml:"emailFrom"`
+	EmailTo          []string `long:"emailTo" description:"The address to send the events to by email (repeatable)" yaml:"emailTo"`
+	EmailEvents      []string `long:"emailEvent" description:"The type of the events to send by email, which is spawn, ready, match, fail, kill, respawn, give-up or breaker-open (repeatable)" default:"fail" default:"give-up" default:"breaker-open" yaml:"emailEvents"`
+	WebhookTemplate  string   `long:"webhookTemplate" description:"The template of the body posted to the webhooks instead of the event as JSON" yaml:"webhookTemplate"`
+	SlackTemplate    string   `long:"slackTemplate" description:"The template of the text posted to Slack instead of the line" yaml:"slackTemplate"`
+	EmailSubject     string   `long:"emailSubject" description:"The template of the subject of the emails" yaml:"emailSubject"`
+	EmailTemplate    string   `long:"emailTemplate" description:"The template of the body of the emails" yaml:"emailTemplate"`
+	EventSinks       []string `long:"eventSink" description:"The sink to get every event, which is stdout or file:PATH to write it as a line of JSON, exec:COMMAND to run the command string with it as JSON on stdin, metrics to count it on /metrics of the API, kafka:BROKER[,BROKER...]/TOPIC or nats:SERVER[,SERVER...]/SUBJECT to publish it as JSON, or a URL to post it to (repeatable)" yaml:"eventSinks"`
+	NotifyLimit      int      `long:"notifyLimit" description:"The number of the events to each webhook, Slack or email within the notify window, over which are dropped, 0 means no limit" default:"0" yaml:"notifyLimit"`
+	NotifyWindow     int      `long:"notifyWindow" description:"The seconds of the window counting the events for notifyLimit" default:"60" yaml:"notifyWindow"`
+	RestartOnCodes   []int    `long:"restartOnCode" description:"The exit code to respawn the process on regardless of the restart policy, and the others aren't respawned (repeatable)" yaml:"restartOnCodes"`
+	SuccessCodes     []int    `long:"successCode" description:"The exit code which isn't a failure for the on-failure policy (repeatable)" default:"0" yaml:"successCodes"`
+	MaxRestart       int      `long:"maxRestarts" description:"The number of respawns within the restart window to give up, 0 means never" default:"0" yaml:"maxRestarts"`
+	Window           int      `long:"restartWindow" description:"The seconds of the window counting the respawns for maxRestarts" default:"60" yaml:"restartWindow"`
+	BreakerRestarts  int      `long:"breakerRestarts" description:"The number of restarts on failures within the breaker window, over which the breaker opens to stop restarting while monitoring until the breaker cool-down, 0 means never" default:"0" yaml:"breakerRestarts"`
+	BreakerWindow    int      `long:"breakerWindow" description:"The seconds of the window counting the restarts for breakerRestarts, which the trial restart must stay up for to close the breaker again" default:"60" yaml:"breakerWindow"`
+	BreakerCooldown  int      `long:"breakerCooldown" description:"The seconds until the open breaker gets half-open and allows a trial restart" default:"300" yaml:"breakerCooldown"`
+	RestartBudget    int      `long:"restartBudget" description:"The restarts per hour allowed whatever triggers them, whose tokens are refilled evenly over the hour, 0 means unlimited" default:"0" yaml:"restartBudget"`
+	BudgetExhausted  string   `long:"budgetExhausted" description:"What to do with a restart once the budget is used up, which is queue to wait for the next token, drop to keep the process running, or giveUp" choice:"queue" choice:"drop" choice:"giveUp" default:"queue" yaml:"budgetExhausted"`
+	OnGiveUp         string   `long:"onGiveUp" description:"The command string to run when giving up" yaml:"onGiveUp"`
+	PreRestart       string   `long:"preRestart" description:"The command string to run before killing or respawning the process" yaml:"preRestart"`
+	PostRestart      string   `long:"postRestart" description:"The command string to run after respawning the process" yaml:"postRestart"`
+	HookTimeout      int      `long:"hookTimeout" description:"The seconds for waiting a hook before killing it" default:"30" yaml:"hookTimeout"`
+	SnapshotDir      string   `long:"snapshotDir" description:"The directory to keep a snapshot of the diagnostics of a sick process in before killing it, each in a directory of the time and the pid" yaml:"snapshotDir"`
+	SnapshotCommand  string   `long:"snapshotCommand" description:"The command string to run in the directory of a snapshot, whose output is kept as well" yaml:"snapshotCommand"`
+	SnapshotSignal   string   `long:"snapshotSignal" description:"The signal to make the process dump its stacks for a snapshot, whose output is kept" choice:"none" choice:"SIGQUIT" choice:"SIGABRT" default:"none" yaml:"snapshotSignal"`
+	SnapshotWait     int      `long:"snapshotWait" description:"The seconds of the output kept after the snapshot signal" default:"3" yaml:"snapshotWait"`
+	LogFormat        string   `long:"logFormat" description:"The format of the logs" choice:"text" choice:"json" default:"text" yaml:"logFormat"`
+	ContextLines     int      `long:"contextLines" description:"The number of the last lines of the output attached to the failure events and the restarts of the journal" default:"0" yaml:"contextLines"`
+	CrashDir         string   `long:"crashDir" description:"The directory to archive the core files and the last lines of the output of a crashed process in, each in a directory of the time and the pid" yaml:"crashDir"`
+	CrashLines       int      `long:"crashLines" description:"The number of the last lines of the output archived for a crash" default:"100" yaml:"crashLines"`
+	CrashKeep        int      `long:"crashKeep" description:"The number of the latest crashes kept in the crash dir" default:"10" yaml:"crashKeep"`
+	OutputPath       string   `long:"outputPath" description:"The path of the file to keep the monitored streams of the process in, without the log" yaml:"outputPath"`
+	OutputMaxSize    int      `long:"outputMaxSize" description:"The megabytes of the output file to rotate it" default:"100" yaml:"outputMaxSize"`
+	OutputMaxAge     int      `long:"outputMaxAge" description:"The seconds of the output file to rotate it, 0 means never" default:"0" yaml:"outputMaxAge"`
+	OutputMaxBackups int      `long:"outputMaxBackups" description:"The number of the rotated output files to keep, 0 means all" default:"0" yaml:"outputMaxBackups"`
+	OutputCompress   bool     `long:"outputCompress" description:"Compress the rotated output files by gzip" yaml:"outputCompress"`
+	Tee              []string `long:"tee" description:"The target to copy the monitored output to as well, which is file:PATH, udp:HOST:PORT, tcp:HOST:PORT, syslog:udp://HOST:PORT, syslog:tcp://HOST:PORT or kafka:BROKER[,BROKER...]/TOPIC (repeatable)" yaml:"tee"`
+	Journal          string   `long:"journal" description:"The path of the file to keep the latest restarts in, which survives kelthuzad itself" yaml:"journal"`
+	PidFile          string   `long:"pidFile" description:"The path of the file to write the pid of kelthuzad to, which is removed on shutdown" yaml:"pidFile"`
+	ChildPidFile     string   `long:"childPidFile" description:"The path of the file to write the pid of the current process to on every respawn, which is removed once it's gone" yaml:"childPidFile"`
+	APIAddr          string   `long:"apiAddr" description:"The address to serve the control API, which is host:port or unix:/path/to/socket" yaml:"apiAddr"`
+	OTLPEndpoint     string   `long:"otlpEndpoint" description:"The OTLP/HTTP endpoint to export the traces of the restarts and the metrics to, such as http://127.0.0.1:4318" env:"OTEL_EXPORTER_OTLP_ENDPOINT" yaml:"otlpEndpoint"`
+	OTLPHeaders      []string `long:"otlpHeader" description:"The header of the exports as name=value, such as the API key of the backend (repeatable)" yaml:"otlpHeaders"`
+	OTLPInterval     int      `long:"otlpInterval" description:"The seconds between the exports of the metrics" default:"60" yaml:"otlpInterval"`
+	StatsdAddr       string   `long:"statsdAddr" description:"The host:port of the statsd or DogStatsD server to send the restarts, the matches and the uptime to over UDP, alongside /metrics or instead of it" yaml:"statsdAddr"`
+	StatsdPrefix     string   `long:"statsdPrefix" description:"The prefix of the names of the statsd metrics" default:"kelthuzad." yaml:"statsdPrefix"`
+	StatsdTags       []string `long:"statsdTag" description:"The tag of the statsd metrics as key:value, besides service (repeatable)" yaml:"statsdTags"`
+	StatsdInterval   int      `long:"statsdInterval" description:"The seconds between the sends to statsd" default:"10" yaml:"statsdInterval"`
+	Join             string   `long:"join" description:"The URL of the coordinator to report the status and the metrics to, which forwards the restarts and the pauses" yaml:"join"`
+	JoinInterval     int      `long:"joinInterval" description:"The seconds between the reports to the coordinator" default:"5" yaml:"joinInterval"`
+	JoinToken        string   `long:"joinToken" description:"The bearer token of the coordinator" env:"KELTHUZAD_JOIN_TOKEN" yaml:"joinToken"`
+	DependsOn        []string `long:"dependsOn" description:"The service which the coordinator of Join restarts this one after once it has respawned, which may be given more than once" yaml:"dependsOn"`
+	RestartGroup     string   `long:"restartGroup" description:"The group of the services which the coordinator of Join restarts together, in the order of DependsOn, when one of them fails" yaml:"restartGroup"`
+	GRPCAddr         string   `long:"grpcAddr" description:"The address to serve the gRPC control API streaming the events, which is host:port or unix:/path/to/socket" yaml:"grpcAddr"`
+	ControlSocket    string   `long:"controlSocket" description:"The path of the Unix socket taking the lines of STATUS, RESTART, PAUSE, RESUME and RELOAD (not on Windows)" yaml:"controlSocket"`
+	SocketMode       string   `long:"controlSocketMode" description:"The octal mode of the control socket, which tells who can connect to it" default:"0600" yaml:"controlSocketMode"`
+
+	// Argv is the command and its arguments to spawn the process as is without any shell, which can be set only by the config file
+	Argv []string `yaml:"argv"`
+
+	// CustomDetectors detect a failure besides the pattern and the plugins, which can be set only by the code
+	CustomDetectors []Detector `yaml:"-"`
+
+	// Reloader returns the config to reload by the API, which isn't reloadable when it's nil
+	Reloader func() (*Config, error) `yaml:"-"`
+
+	// Args holds the trailing arguments after the options, which are passed to CmdPath or Argv
+	Args struct {
+		Rest []string `yaml:"args"`
+	} `positional-args:"yes" yaml:",inline"`
 }
 
-// New returns initialized Kelthuzad pointer
-func New(opt *opts) *Kelthuzad {
-	kel := &Kelthuzad{}
-	kel.opt = opt
-	kel.pattern = regexp.MustCompile(kel.opt.Pattern)
-	kel.spawn()
+// New returns initialized Watchdog pointer, which spawns the process once it runs.
+func New(cfg *Config) (*Watchdog, error) {
+	err := cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Watchdog{}
+	w.cfg.Store(cfg)
+	if cfg.Pattern != "" {
+		w.pattern, err = compile(cfg, cfg.Pattern)
+		if err != nil {
+			return nil, err
+		}
+	}
+	w.excludes, err = compileSet(cfg, cfg.ExcludePatterns)
+	if err != nil {
+		return nil, err
+	}
+	w.rule, err = compileRule(cfg)
+	if err != nil {
+		return nil, err
+	}
+	w.criteria = criteria(cfg.Pattern, w.rule)
+	w.sequence, err = newSequence(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.HeartbeatPattern != "" {
+		w.heartbeat, err = compile(cfg, cfg.HeartbeatPattern)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.ReadyPattern != "" {
+		w.ready, err = compile(cfg, cfg.ReadyPattern)
+		if err != nil {
+			return nil, err
+		}
+	}
+	w.backoff.Store(newBackoff(cfg))
+	w.breaker = newBreaker(cfg)
+	w.budget = newBudget(cfg)
+	w.probers, err = newProbers(cfg)
+	if err != nil {
+		return nil, err
+	}
+	w.pingLine, err = parsePing(cfg)
+	if err != nil {
+		return nil, err
+	}
+	w.env, err = newEnv(cfg)
+	if err != nil {
+		return nil, err
+	}
+	w.cred, err = newCredential(cfg.User, cfg.Group)
+	if err != nil {
+		return nil, err
+	}
+	w.umask, err = parseUmask(cfg.Umask)
+	if err != nil {
+		return nil, err
+	}
+	w.limits, err = newLimits(cfg)
+	if err != nil {
+		return nil, err
+	}
+	w.sink = newSink(cfg)
+	// the latest lines are kept for the failures, the crashes and the output of the API
+	size := cfg.ContextLines
+	if cfg.CrashDir != "" && cfg.CrashLines > size {
+		size = cfg.CrashLines
+	}
+	if cfg.APIAddr != "" && outputLines > size {
+		size = outputLines
+	}
+	w.recent = newRing(size)
+	w.docker = newDocker(cfg)
+	if cfg.LeaderLock != "" {
+		w.elector, err = newElector(cfg.LeaderLock)
+		if err != nil {
+			return nil, fmt.Errorf("kelthuzad: newElector: %w", err)
+		}
+	}
+	if cfg.Journal != "" {
+		w.restartLog, err = loadJournal(cfg.Journal)
+		if err != nil {
+			return nil, err
+		}
+	}
+	w.log = newLogger(cfg.LogFormat)
+	w.log.setLevel(cfg.LogLevel)
+	w.severities, err = parseSeverities(cfg.SeverityPatterns)
+	if err != nil {
+		return nil, err
+	}
+	w.metrics = &metrics{budget: w.budget}
+	if cfg.GRPCAddr != "" {
+		w.hub = &hub{}
+	}
+	notifier, err := newNotifier(cfg, w.log, w.metrics, w.hub)
+	if err != nil {
+		return nil, err
+	}
+	w.notifier.Store(notifier)
+	w.detectors = newDetectors(cfg, w.log)
+	w.goPlugins, err = loadGoPlugins(cfg.GoPlugins)
+	if err != nil {
+		return nil, err
+	}
+	w.stopped = make(chan error, 1)
+	w.manual = make(chan string, 1)
+	// the first process is spawned before monitoring, which needs room for both the streams
+	w.outputs = make(chan output, 2)
+	w.failures = make(chan failure, 1)
+	w.exitCode = -1
+
+	switch {
+	case len(cfg.Argv) > 0:
+		// the argv is run as is, and so are the trailing arguments after it
+		w.argv = append(append([]string{}, cfg.Argv...), cfg.Args.Rest...)
+	case cfg.Shell:
+		w.argv = shellArgv(cfg.CmdPath, cfg.Args.Rest)
+	case cfg.CmdPath != "":
+		// split CmdPath like a shell does and put the trailing arguments after it
+		argv, err := splitArgs(cfg.CmdPath)
+		if err != nil {
+			return nil, err
+		}
+		if len(argv) == 0 {
+			return nil, errors.New("kelthuzad: CmdPath is blank")
+		}
+		w.argv = append(argv, cfg.Args.Rest...)
+	}
+	w.name = processName(cfg, w.argv)
+	if cfg.SSH != "" {
+		w.argv = sshArgv(cfg, w.argv)
+	}
+	w.tees, err = newTees(cfg, w.name)
+	if err != nil {
+		return nil, err
+	}
+	w.telemetry, err = newTelemetry(cfg, w.name)
+	if err != nil {
+		return nil, err
+	}
+	w.statsd, err = newStatsd(cfg, w.name)
+	if err != nil {
+		return nil, err
+	}
+	w.metrics.statsd = w.statsd
+
+	return w, nil
+}
+
+// validate makes sure that the options go together.
+func (cfg *Config) validate() error {
+	// make sure that there's a way to detect a failure by any of the options or the config file
+	if cfg.Pattern == "" && len(cfg.JSONFields) == 0 && cfg.Rule == "" && len(cfg.Sequence) == 0 && len(cfg.Detectors) == 0 && len(cfg.CustomDetectors) == 0 && len(cfg.GoPlugins) == 0 && cfg.HeartbeatPattern == "" && cfg.ReadyPattern == "" && cfg.HTTPProbe == "" && cfg.TCPProbe == "" && cfg.ExecProbe == "" && cfg.PingInterval == 0 && cfg.MaxMemory == 0 && cfg.MaxCPU == 0 && cfg.MaxRate == 0 && cfg.MinRate == 0 {
+		return errors.New("kelthuzad: you must specify one of Pattern, JSONFields, Rule, Sequence, Detectors, CustomDetectors, GoPlugins, HeartbeatPattern, ReadyPattern, HTTPProbe, TCPProbe, ExecProbe, PingInterval, MaxMemory, MaxCPU, MaxRate, MinRate")
+	}
+	if cfg.RegexFlavor == "pcre" && !pcreBuilt {
+		return errors.New("kelthuzad: RegexFlavor pcre needs kelthuzad built with -tags pcre")
+	}
+	if cfg.FixedString && cfg.RegexFlavor == "pcre" {
+		return errors.New("kelthuzad: FixedString can't be used with RegexFlavor pcre")
+	}
+	if cfg.MaxMemory < 0 || cfg.MaxCPU < 0 || cfg.ResourceInterval <= 0 {
+		return errors.New("kelthuzad: MaxMemory and MaxCPU must not be negative and ResourceInterval must be positive")
+	}
+	if cfg.MaxRate < 0 || cfg.MinRate < 0 || cfg.RateInterval <= 0 {
+		return errors.New("kelthuzad: MaxRate and MinRate must not be negative and RateInterval must be positive")
+	}
+	if cfg.MaxRate > 0 && cfg.MinRate > cfg.MaxRate {
+		return errors.New("kelthuzad: MinRate must not be over MaxRate")
+	}
+	if cfg.CgroupMemory < 0 || cfg.CgroupCPU < 0 {
+		return errors.New("kelthuzad: CgroupMemory and CgroupCPU must not be negative")
+	}
+	if (cfg.CgroupMemory > 0 || cfg.CgroupCPU > 0) && cfg.Cgroup == "" {
+		return errors.New("kelthuzad: CgroupMemory and CgroupCPU can be used only with Cgroup")
+	}
+	if len(cfg.ExcludePatterns) > 0 && cfg.Pattern == "" && len(cfg.JSONFields) == 0 && cfg.Rule == "" {
+		return errors.New("kelthuzad: ExcludePatterns can be used only with Pattern, JSONFields or Rule")
+	}
+	if cfg.Rule != "" && len(cfg.JSONFields) > 0 {
+		return errors.New("kelthuzad: Rule can't be used with JSONFields, whose conditions it can have as json.FIELD")
+	}
+	if len(cfg.GoPlugins) > 0 && cfg.PluginBudget < 1 {
+		return errors.New("kelthuzad: PluginBudget must be at least 1")
+	}
+	if cfg.Cooldown < 0 {
+		return errors.New("kelthuzad: Cooldown must not be negative")
+	}
+	if cfg.FailThreshold < 1 {
+		return errors.New("kelthuzad: FailThreshold must be at least 1")
+	}
+	if cfg.MaxLineSize < 1 {
+		return errors.New("kelthuzad: MaxLineSize must be at least 1")
+	}
+	if cfg.TailPoll < 0 {
+		return errors.New("kelthuzad: TailPoll must not be negative")
+	}
+	_, _, err := parseTailFrom(cfg.TailFrom)
+	if err != nil {
+		return fmt.Errorf("kelthuzad: TailFrom %w", err)
+	}
+	if cfg.MultilineLines < 1 {
+		return errors.New("kelthuzad: MultilineLines must be at least 1")
+	}
+	if cfg.QueueSize < 1 || cfg.Matchers < 1 {
+		return errors.New("kelthuzad: QueueSize and Matchers must be at least 1")
+	}
+	// the latest lines are joined in order, which the workers can't do
+	if cfg.Matchers > 1 && cfg.MultilineLines > 1 {
+		return errors.New("kelthuzad: Matchers over 1 can't be used with MultilineLines over 1")
+	}
+	if cfg.ProbeInterval <= 0 || cfg.ProbeFailures < 1 {
+		return errors.New("kelthuzad: ProbeInterval must be positive and ProbeFailures at least 1")
+	}
+	if len(cfg.Sequence) > 0 && (len(cfg.Sequence) < 2 || cfg.SequenceWindow <= 0) {
+		return errors.New("kelthuzad: Sequence must have two steps at least and SequenceWindow must be positive")
+	}
+	if cfg.HeartbeatPattern != "" && cfg.HeartbeatTimeout <= 0 {
+		return errors.New("kelthuzad: HeartbeatTimeout must be positive")
+	}
+	if cfg.ReadyPattern != "" && cfg.ReadyTimeout <= 0 {
+		return errors.New("kelthuzad: ReadyTimeout must be positive")
+	}
+
+	// make sure that one of these options to be specified
+	commands := 0
+	for _, given := range []bool{cfg.CmdPath != "", cfg.RawCommand != "", len(cfg.Argv) > 0, cfg.DockerContainer != "", cfg.KubeSelector != ""} {
+		if given {
+			commands++
+		}
+	}
+	if commands != 1 {
+		return errors.New("kelthuzad: you must specify one of CmdPath, RawCommand, Argv, DockerContainer, KubeSelector")
+	}
+
+	// the pods are only checked against the pattern and deleted, and the rest is up to their controller
+	if cfg.KubeSelector != "" && ((cfg.Pattern == "" && len(cfg.JSONFields) == 0 && cfg.Rule == "") || len(cfg.Sequence) > 0 || len(cfg.Detectors) > 0 || len(cfg.CustomDetectors) > 0 || len(cfg.GoPlugins) > 0 || cfg.HeartbeatPattern != "" || cfg.ReadyPattern != "" || cfg.HTTPProbe != "" || cfg.TCPProbe != "" || cfg.ExecProbe != "" || cfg.MaxMemory != 0 || cfg.MaxCPU != 0 || cfg.MaxRate != 0 || cfg.MinRate != 0 || len(cfg.FreezeWindows) > 0 || len(cfg.RestartAt) > 0 || len(cfg.RestartCron) > 0 || cfg.BreakerRestarts != 0 || cfg.ChildPidFile != "" || cfg.APIAddr != "" || cfg.GRPCAddr != "" || cfg.ControlSocket != "" || cfg.Join != "" || cfg.StatsdAddr != "" || len(cfg.Tee) > 0 || len(cfg.WaitForFile) > 0 || len(cfg.WaitForPort) > 0) {
+		return errors.New("kelthuzad: KubeSelector needs Pattern, JSONFields or Rule and can't be used with Sequence, Detectors, CustomDetectors, GoPlugins, HeartbeatPattern, ReadyPattern, HTTPProbe, TCPProbe, ExecProbe, MaxMemory, MaxCPU, MaxRate, MinRate, FreezeWindows, RestartAt, RestartCron, BreakerRestarts, ChildPidFile, APIAddr, GRPCAddr, ControlSocket, Join, StatsdAddr, Tee, WaitForFile nor WaitForPort")
+	}
+
+	// the container and the pods have their own logs and run as they're configured
+	if (cfg.DockerContainer != "" || cfg.KubeSelector != "") && (len(cfg.LogPath) > 0 || cfg.JournaldUnit != "" || cfg.SyslogListen != "" || cfg.Stdin || cfg.Interactive || cfg.Pty || cfg.SnapshotDir != "" || cfg.CrashDir != "" || cfg.OutputPath != "" || cfg.Passthrough || len(cfg.Env) > 0 || cfg.EnvFile != "" || cfg.User != "" || cfg.Group != "" || cfg.Chdir != "" || cfg.Umask != "" || cfg.LimitNofile != "" || cfg.LimitCore != "" || cfg.LimitNproc != "" || cfg.LimitMemlock != "" || cfg.LimitStack != "" || cfg.LimitAs != "" || cfg.Cgroup != "" || cfg.Init) {
+		return errors.New("kelthuzad: DockerContainer and KubeSelector can't be used with LogPath, JournaldUnit, SyslogListen, Stdin, Interactive, Pty, SnapshotDir, CrashDir, OutputPath, Passthrough, Env, EnvFile, User, Group, Chdir, Umask, LimitNofile, LimitCore, LimitNproc, LimitMemlock, LimitStack, LimitAs, Cgroup nor Init")
+	}
+	if cfg.Shell && cfg.CmdPath == "" {
+		return errors.New("kelthuzad: Shell can be used only with CmdPath")
+	}
+	if len(cfg.Argv) > 0 && cfg.Argv[0] == "" {
+		return errors.New("kelthuzad: Argv must start with the command")
+	}
+
+	// catch a malformed time before it never comes
+	for _, spec := range cfg.FreezeWindows {
+		if _, err := parseWindow(spec); err != nil {
+			return fmt.Errorf("kelthuzad: FreezeWindows: %w", err)
+		}
+	}
+	for _, spec := range cfg.RestartAt {
+		if _, err := parseClock(spec); err != nil {
+			return fmt.Errorf("kelthuzad: RestartAt: %w", err)
+		}
+	}
+	for _, spec := range cfg.RestartCron {
+		c, err := parseCron(spec)
+		if err != nil {
+			return fmt.Errorf("kelthuzad: RestartCron: %w", err)
+		}
+		if c.next(time.Now()).IsZero() {
+			return fmt.Errorf("kelthuzad: RestartCron: %v never comes", spec)
+		}
+	}
+
+	for _, types := range [][]string{cfg.WebhookEvents, cfg.SlackEvents, cfg.EmailEvents} {
+		for _, typ := range types {
+			if !eventTypes[typ] {
+				return fmt.Errorf("kelthuzad: WebhookEvents, SlackEvents and EmailEvents must be spawn, ready, match, fail, kill, respawn, give-up or breaker-open, not %v", typ)
+			}
+		}
+	}
+	for _, spec := range cfg.EventSinks {
+		kind, _, err := parseEventSink(spec)
+		if err != nil {
+			return fmt.Errorf("kelthuzad: EventSinks: %w", err)
+		}
+		if kind == "metrics" && cfg.APIAddr == "" {
+			return errors.New("kelthuzad: the metrics of EventSinks need APIAddr to be served on")
+		}
+	}
+
+	if cfg.BreakerRestarts < 0 || cfg.BreakerWindow <= 0 || cfg.BreakerCooldown <= 0 {
+		return errors.New("kelthuzad: BreakerRestarts must not be negative and BreakerWindow and BreakerCooldown must be positive")
+	}
+	if cfg.RestartBudget < 0 {
+		return errors.New("kelthuzad: RestartBudget must not be negative")
+	}
+	if cfg.OTLPInterval <= 0 {
+		return errors.New("kelthuzad: OTLPInterval must be positive")
+	}
+	if cfg.StatsdInterval <= 0 {
+		return errors.New("kelthuzad: StatsdInterval must be positive")
+	}
+
+	if mode, err := strconv.ParseUint(cfg.SocketMode, 8, 32); err != nil || mode > 0777 {
+		return fmt.Errorf("kelthuzad: SocketMode %v isn't an octal mode", cfg.SocketMode)
+	}
+
+	// the delay must not shrink on consecutive respawns
+	if cfg.Multiplier < 1 {
+		return errors.New("kelthuzad: Multiplier must be at least 1")
+	}
+	if cfg.ResetAfter < 0 {
+		return errors.New("kelthuzad: ResetAfter must not be negative")
+	}
+	if cfg.Jitter < 0 || cfg.Jitter > 100 {
+		return errors.New("kelthuzad: Jitter must be between 0 and 100")
+	}
 
-	return kel
+	// catch a malformed glob before nothing matches it silently
+	for _, path := range cfg.LogPath {
+		if _, err := filepath.Match(path, ""); err != nil {
+			return fmt.Errorf("kelthuzad: LogPath %v: %w", path, err)
+		}
+	}
+
+	// only one of them is monitored
+	if cfg.JournaldUnit != "" && len(cfg.LogPath) > 0 {
+		return errors.New("kelthuzad: JournaldUnit can't be used with LogPath")
+	}
+	if cfg.SyslogListen != "" && (len(cfg.LogPath) > 0 || cfg.JournaldUnit != "") {
+		return errors.New("kelthuzad: SyslogListen can't be used with LogPath nor JournaldUnit")
+	}
+	if cfg.Stdin && (len(cfg.LogPath) > 0 || cfg.JournaldUnit != "" || cfg.SyslogListen != "") {
+		return errors.New("kelthuzad: Stdin can't be used with LogPath, JournaldUnit nor SyslogListen")
+	}
+	if cfg.ContextLines < 0 {
+		return errors.New("kelthuzad: ContextLines must not be negative")
+	}
+	if cfg.CrashLines < 0 || cfg.CrashKeep < 1 {
+		return errors.New("kelthuzad: CrashLines must not be negative and CrashKeep must be at least 1")
+	}
+	if cfg.SnapshotWait < 0 {
+		return errors.New("kelthuzad: SnapshotWait must not be negative")
+	}
+	for name, hook := range map[string]string{"PreRestart": cfg.PreRestart, "PostRestart": cfg.PostRestart, "OnGiveUp": cfg.OnGiveUp, "SnapshotCommand": cfg.SnapshotCommand} {
+		_, _, err := renderCommand(name, hook, event{})
+		if err != nil {
+			return err
+		}
+	}
+	if (len(cfg.DependsOn) > 0 || cfg.RestartGroup != "") && cfg.Join == "" {
+		return errors.New("kelthuzad: DependsOn and RestartGroup need Join")
+	}
+	if cfg.JoinInterval <= 0 {
+		return errors.New("kelthuzad: JoinInterval must be positive")
+	}
+	if cfg.WaitTimeout < 0 {
+		return errors.New("kelthuzad: WaitTimeout must not be negative")
+	}
+	for _, addr := range cfg.WaitForPort {
+		_, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("kelthuzad: WaitForPort %v must be host:port", addr)
+		}
+	}
+	if cfg.Interactive && cfg.Stdin {
+		return errors.New("kelthuzad: Interactive can't be used with Stdin")
+	}
+
+	// the terminal is where the output is monitored, and it echoes the pings by itself
+	if cfg.Pty && !ptySupported {
+		return errors.New("kelthuzad: Pty isn't supported on this platform")
+	}
+	if cfg.Pty && (len(cfg.LogPath) > 0 || cfg.JournaldUnit != "" || cfg.SyslogListen != "" || cfg.Stdin || cfg.PingInterval > 0) {
+		return errors.New("kelthuzad: Pty can't be used with LogPath, JournaldUnit, SyslogListen, Stdin nor PingInterval")
+	}
+	// only the output comes back from the remote host, where the local limits mean nothing
+	if cfg.SSH != "" && (cfg.DockerContainer != "" || cfg.KubeSelector != "" || len(cfg.LogPath) > 0 || cfg.JournaldUnit != "" || cfg.SyslogListen != "" || cfg.Stdin || cfg.Interactive || cfg.Pty || cfg.PingInterval > 0 || cfg.MaxMemory != 0 || cfg.MaxCPU != 0 || cfg.SnapshotDir != "" || cfg.CrashDir != "" || len(cfg.Env) > 0 || cfg.EnvFile != "" || cfg.User != "" || cfg.Group != "" || cfg.Chdir != "" || cfg.Umask != "" || cfg.LimitNofile != "" || cfg.LimitCore != "" || cfg.LimitNproc != "" || cfg.LimitMemlock != "" || cfg.LimitStack != "" || cfg.LimitAs != "" || cfg.Cgroup != "" || cfg.Init || cfg.ChildPidFile != "") {
+		return errors.New("kelthuzad: SSH can't be used with DockerContainer, KubeSelector, LogPath, JournaldUnit, SyslogListen, Stdin, Interactive, Pty, PingInterval, MaxMemory, MaxCPU, SnapshotDir, CrashDir, Env, EnvFile, User, Group, Chdir, Umask, LimitNofile, LimitCore, LimitNproc, LimitMemlock, LimitStack, LimitAs, Cgroup, Init nor ChildPidFile")
+	}
+
+	// the pods have their own election and stdin is read by the first leader only
+	if cfg.LeaderLock != "" && (cfg.KubeSelector != "" || cfg.Stdin || cfg.Interactive) {
+		return errors.New("kelthuzad: LeaderLock can't be used with KubeSelector, Stdin nor Interactive")
+	}
+
+	// the token has to come back on the streams of the process
+	if cfg.PingInterval < 0 || cfg.PingTimeout <= 0 || cfg.PingMisses <= 0 {
+		return errors.New("kelthuzad: PingInterval must not be negative and PingTimeout and PingMisses must be positive")
+	}
+	if cfg.PingInterval > 0 && (len(cfg.LogPath) > 0 || cfg.JournaldUnit != "" || cfg.SyslogListen != "" || cfg.Stdin || cfg.DockerContainer != "" || cfg.KubeSelector != "") {
+		return errors.New("kelthuzad: PingInterval can't be used with LogPath, JournaldUnit, SyslogListen, Stdin, DockerContainer nor KubeSelector")
+	}
+
+	// the log, the journal and syslog have the output already
+	if cfg.OutputPath != "" && (len(cfg.LogPath) > 0 || cfg.JournaldUnit != "" || cfg.SyslogListen != "") {
+		return errors.New("kelthuzad: OutputPath can't be used with LogPath, JournaldUnit nor SyslogListen")
+	}
+	if cfg.Passthrough && (cfg.Quiet || len(cfg.LogPath) > 0 || cfg.JournaldUnit != "" || cfg.SyslogListen != "") {
+		return errors.New("kelthuzad: Passthrough can't be used with Quiet, LogPath, JournaldUnit nor SyslogListen")
+	}
+	if cfg.OutputPath != "" && cfg.OutputMaxSize < 1 {
+		return errors.New("kelthuzad: OutputMaxSize must be at least 1")
+	}
+
+	// the trailing arguments only make sense for CmdPath and Argv
+	if (cfg.RawCommand != "" || cfg.DockerContainer != "" || cfg.KubeSelector != "") && len(cfg.Args.Rest) > 0 {
+		return errors.New("kelthuzad: the trailing arguments can't be used with RawCommand, DockerContainer nor KubeSelector")
+	}
+
+	return nil
 }
 
-// spawn executes the command from k.opt.CmdPath and assigns it into k's cmd field.
-func (k *Kelthuzad) spawn() {
-	k.isSpawning = false
+// proc is a spawned process, and gen tells it from the ones spawned before and after.
+// It never changes once spawned but how it exited, so it can be shared without the lock.
+type proc struct {
+	// cmd is nil for a container
+	cmd   *exec.Cmd
+	group *procGroup
+	pid   int
+	// done is closed as soon as the process exits
+	done chan struct{}
+	gen  int
+	// code and state tell how it exited, which are set before done is closed
+	code  int
+	state string
+	// stdin is where the pings and the forwarded lines are written, which is nil without them
+	stdin *os.File
+}
+
+// spawn starts the command from w.argv or w.config().RawCommand, or the container, and makes it the current process of a new generation.
+// It waits for the files and the ports first, the process is watched until ctx is done, and nothing is started once ctx is done.
+func (w *Watchdog) spawn(ctx context.Context) error {
+	err := w.waitFor(ctx)
+	if err != nil {
+		return err
+	}
+
+	var p *proc
+	if w.docker != nil {
+		p, err = w.startContainer(ctx)
+	} else {
+		p, err = w.startCommand(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	w.writeChildPid(p.pid)
+	w.notify("spawn", "", "")
+
+	w.mu.Lock()
+	restarts := w.restarts
+	w.mu.Unlock()
+	if restarts > 0 {
+		w.notify("respawn", "", "")
+		go w.runHook(w.config().PostRestart, w.event("post-restart", "", ""))
+		w.telemetry.stage("ready", attribute.Int("process.pid", p.pid))
+	}
+	// the heartbeat is waited for once it's ready
+	if w.ready != nil {
+		w.startReadiness(ctx, p)
+	} else {
+		w.notify("ready", "", "")
+		w.telemetry.end(nil)
+		w.sdReady(p.pid)
+		w.startHeartbeat(ctx, p)
+	}
+
+	go w.watch(ctx, p)
+	return nil
+}
 
+// startCommand starts the command from w.argv or w.config().RawCommand as the current process.
+func (w *Watchdog) startCommand(ctx context.Context) (*proc, error) {
+	cfg := w.config()
 	var cmd *exec.Cmd
-	if k.opt.CmdPath != "" {
-		cmd = exec.Command(k.opt.CmdPath)
+	if len(w.argv) > 0 {
+		cmd = exec.Command(w.argv[0], w.argv[1:]...)
 	} else {
-		cmd = exec.Command("bash", "-lc", k.opt.RawCommand+" 2>&1")
+		raw := cfg.RawCommand
+		if cfg.Streams == "stdout" {
+			// the shell merges stderr into stdout unless the streams are picked explicitly
+			raw += " 2>&1"
+		}
+		cmd = shellCommand(raw)
+	}
+
+	env, err := w.environ()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Env = env
+	cmd.Dir = cfg.Chdir
+
+	var writers []*os.File
+	var stdin, stdinReader *os.File
+	if len(cfg.LogPath) == 0 && cfg.JournaldUnit == "" && cfg.SyslogListen == "" && !cfg.Stdin {
+		// get the pipes before it starts and hand them over to monitorStdout to monitor the streams
+		outputs, pws, err := w.pipe(cmd)
+		if err != nil {
+			return nil, fmt.Errorf("kelthuzad: spawn pipe: %w", err)
+		}
+
+		for i, o := range outputs {
+			select {
+			case w.outputs <- o:
+			case <-ctx.Done():
+				for _, o := range outputs[i:] {
+					o.file.Close()
+				}
+				for _, pw := range pws {
+					pw.Close()
+				}
+				return nil, ctx.Err()
+			}
+		}
+		writers = pws
+
+		// the lines written to the master are the input of the terminal
+		if cfg.Pty {
+			stdin = outputs[0].file
+		}
+	}
+	if !cfg.Pty && (w.pingLine != nil || cfg.Interactive || cfg.SSH != "") {
+		stdinReader, stdin, err = os.Pipe()
+		if err != nil {
+			return nil, fmt.Errorf("kelthuzad: spawn stdin: %w", err)
+		}
+		cmd.Stdin = stdinReader
+	}
+
+	// start it under the lock, so it's either seen by Run stopping everything or not started at all
+	var leaf *cgroup
+	w.mu.Lock()
+	if ctx.Err() == nil {
+		prepare(cmd, w.cred)
+		if cfg.Pty {
+			attachPty(cmd)
+		}
+		if w.cgroup != nil {
+			leaf, err = w.cgroup.place(cmd)
+		}
+		if err == nil {
+			err = startOwned(cmd, w.umask, w.limits)
+		}
+		if leaf != nil {
+			leaf.placed(err == nil)
+		}
+	} else {
+		err = ctx.Err()
+	}
+
+	// the child has its own copy of the pipes, so close ours to get EOF when it's done
+	for _, pw := range writers {
+		pw.Close()
+	}
+	if stdinReader != nil {
+		stdinReader.Close()
 	}
+	if err != nil {
+		if stdinReader != nil {
+			stdin.Close()
+		}
+		w.mu.Unlock()
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("kelthuzad: spawn Start: %w", err)
+	}
+
+	// the group is what gets killed along with all descendants of the process
+	group, groupErr := newProcGroup(cmd, leaf)
+	p := &proc{cmd: cmd, group: group, pid: cmd.Process.Pid, stdin: stdin}
+	w.publish(p)
+	w.mu.Unlock()
+
+	w.log.logf("SYSTEM", record{Level: "info", Event: "spawn", Pid: p.pid}, "%v is spawned", p.pid)
+	w.log.debugf("SYSTEM", record{Event: "spawn", Pid: p.pid}, "%v is spawned by %q", p.pid, cmd.Args)
+	if groupErr != nil {
+		w.log.logf("SYSTEM", record{Level: "warn", Event: "error", Pid: p.pid}, "w.spawn procGroup %v", groupErr)
+	}
+	return p, nil
+}
+
+// publish makes the started p the current process of a new generation, which starts over.
+// w.mu must be held.
+func (w *Watchdog) publish(p *proc) {
+	w.gen++
+	p.gen = w.gen
+	p.done = make(chan struct{})
+	w.proc = p
+	w.spawning = false
+	w.spawnedAt = time.Now()
+	w.readyAt = time.Time{}
+	w.matches = nil
+	w.lines = nil
+}
+
+// watch waits for p to exit, then respawns it according to w.config().Restart
+// unless ctx is done or it's being replaced by someone who killed it.
+func (w *Watchdog) watch(ctx context.Context, p *proc) {
+	if p.cmd != nil {
+		p.cmd.Wait()
+		disown(p.cmd)
+		p.code = exitCode(p.cmd.ProcessState)
+		p.state = p.cmd.ProcessState.String()
+		// the master of the terminal is closed by its reader once it reads all the output
+		if p.stdin != nil && !w.config().Pty {
+			p.stdin.Close()
+		}
+	} else if !w.waitContainer(ctx, p) {
+		return
+	}
+
+	// whoever waits for p.done may spawn the next one, which must not lose its timers or group to this one
+	w.stopReadiness()
+	w.stopHeartbeat()
+	if p.group != nil {
+		p.group.close()
+	}
+	w.removeChildPid(p.pid)
+	w.mu.Lock()
+	w.exitCode = p.code
+	spawnedAt := w.spawnedAt
+	w.mu.Unlock()
+	// the next one may dump its core at the same path
+	w.archiveCrash(p, spawnedAt)
+	close(p.done)
+	w.log.logf("SYSTEM", record{Level: "info", Event: "exit", Pid: p.pid}, "%v is done! %v", p.pid, p.state)
+
+	// the one which killed it respawns it
+	uptime := w.healthyUptime()
+	if ctx.Err() != nil || !w.claim(p) {
+		return
+	}
+
+	if !w.shouldRestart(p.code) {
+		w.log.logf("SYSTEM", record{Level: "info", Event: "stop", Pid: p.pid}, "%v is not respawned with the exit code %v, stopping...", p.pid, p.code)
+		w.stop(nil)
+		return
+	}
+
+	w.record(p, "exit", "exit-code", p.state, "")
+	if !w.waitBreaker(ctx, p.pid) || !w.spend(ctx, p.pid, "exit") {
+		return
+	}
+	w.telemetry.begin("exit", "exit-code", p.pid, p.state, "")
+	w.runHook(w.config().PreRestart, w.event("pre-restart", "", ""))
+	w.respawn(ctx, uptime)
+}
+
+// claim makes the caller the only one replacing p, and reports whether it did.
+// It fails when p isn't the latest process anymore or someone else is replacing it already.
+func (w *Watchdog) claim(p *proc) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if p == nil || w.proc != p || w.spawning {
+		return false
+	}
+	w.spawning = true
+	return true
+}
+
+// config returns the config in effect, which Reload replaces as a whole, so a caller reading several options
+// should keep what it returns rather than calling it for each of them.
+func (w *Watchdog) config() *Config {
+	return w.cfg.Load()
+}
+
+// current returns the process which is running and isn't being replaced, or nil.
+func (w *Watchdog) current() *proc {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.proc == nil || w.spawning || isClosed(w.proc.done) {
+		return nil
+	}
+	return w.proc
+}
+
+// latest returns the process spawned last, which may be gone already, or nil before the first one.
+func (w *Watchdog) latest() *proc {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.proc
+}
+
+// respawn spawns the process which has been running for uptime again after the delay, unless it was respawned too often.
+// It gives up the respawn when ctx is done during the delay.
+func (w *Watchdog) respawn(ctx context.Context, uptime time.Duration) {
+	cfg := w.config()
+	if cfg.MaxRestart > 0 {
+		// forget the respawns which are out of the window
+		window := time.Duration(cfg.Window) * time.Second
+		for len(w.history) > 0 && time.Since(w.history[0]) > window {
+			w.history = w.history[1:]
+		}
+
+		if len(w.history) >= cfg.MaxRestart {
+			w.telemetry.end(ErrGiveUp)
+			w.giveUp(fmt.Sprintf("respawned %v times within %v seconds", len(w.history), cfg.Window))
+			return
+		}
+		w.history = append(w.history, time.Now())
+	}
+
+	// wait to avoid being with flooded with respawning
+	delay := w.backoff.Load().next(uptime)
+	w.log.logf("SYSTEM", record{Level: "info", Event: "wait"}, "Waiting %v...", delay)
+	w.telemetry.stage("backoff", attribute.Float64("kelthuzad.delay", delay.Seconds()))
+	if !sleep(ctx, delay) {
+		w.telemetry.end(ctx.Err())
+		return
+	}
+
+	w.mu.Lock()
+	w.restarts++
+	w.mu.Unlock()
+	w.telemetry.stage("spawn")
+	err := w.spawn(ctx)
+	if err != nil {
+		w.telemetry.end(err)
+	}
+	if err != nil && ctx.Err() == nil {
+		w.stop(err)
+	}
+}
+
+// giveUp stops respawning for good, telling why: it notifies, runs w.config().OnGiveUp and makes Run return ErrGiveUp.
+func (w *Watchdog) giveUp(why string) {
+	w.log.logf("SYSTEM", record{Level: "error", Event: "give-up"}, "%v, giving up...", why)
+	w.notify("give-up", "", "")
+	w.notifier.Load().wait()
+	w.runHook(w.config().OnGiveUp, w.event("give-up", "", ""))
+
+	w.stop(ErrGiveUp)
+}
+
+// sleep pauses for d and reports whether it wasn't interrupted by ctx.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
 
-	if k.opt.LogPath == "" {
-		// get the stdout pipe before it starts and assign it into k.stdout to monitor stdout
-		stdout, err := cmd.StdoutPipe()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// stop makes Run return err, and only the first one counts.
+func (w *Watchdog) stop(err error) {
+	select {
+	case w.stopped <- err:
+	default:
+	}
+}
+
+// shouldRestart reports whether the process which exited by itself with code must be respawned.
+// RestartOnCodes decides it if given, otherwise the restart policy does with SuccessCodes.
+func (w *Watchdog) shouldRestart(code int) bool {
+	cfg := w.config()
+	if len(cfg.RestartOnCodes) > 0 {
+		return containsCode(cfg.RestartOnCodes, code)
+	}
+
+	switch cfg.Restart {
+	case "never":
+		return false
+	case "on-failure":
+		return !containsCode(cfg.SuccessCodes, code)
+	default:
+		return true
+	}
+}
+
+// exitCode returns the exit code of state, which is 128 plus the signal when it was killed by a signal as shells do.
+func exitCode(state *os.ProcessState) int {
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+
+	return state.ExitCode()
+}
+
+// containsCode reports whether codes contains code.
+func containsCode(codes []int, code int) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pipe connects the streams chosen by w.config().Streams to pipes, or all of them to a pseudo-terminal by w.config().Pty, before cmd starts,
+// and returns the reading ends and the writing ones.
+// The writing ends must be closed after cmd starts, and a reading end gets EOF once every process holding it exits.
+// Both streams share a pipe unless they're passed through, which tells which stream a line came from.
+func (w *Watchdog) pipe(cmd *exec.Cmd) ([]output, []*os.File, error) {
+	if w.config().Pty {
+		master, tty, err := openPty()
 		if err != nil {
-			log.Fatalln("[FATAL] k.spawn stdout", err)
+			return nil, nil, err
 		}
+		cmd.Stdin = tty
+		cmd.Stdout = tty
+		cmd.Stderr = tty
+		return []output{{file: master, stream: "pty"}}, []*os.File{tty}, nil
+	}
 
-		k.stdout = stdout
+	streams := []string{"stdout"}
+	switch {
+	case w.config().Streams == "stderr":
+		streams = []string{"stderr"}
+	case w.config().Streams == "both" && w.config().Passthrough:
+		streams = []string{"stdout", "stderr"}
 	}
 
-	// this block is necessary when killing a subprocess properly
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-	go func() {
-		err := cmd.Start()
-		log.Printf("[SYSTEM] %v is spawned\n", cmd.Process.Pid)
+	var outputs []output
+	var writers []*os.File
+	for _, stream := range streams {
+		r, pw, err := os.Pipe()
 		if err != nil {
-			log.Fatalln("[FATAL] k.spawn Start", err)
+			for i := range outputs {
+				outputs[i].file.Close()
+				writers[i].Close()
+			}
+			return nil, nil, err
 		}
-		cmd.Wait()
-		log.Printf("[SYSTEM] %v is done!\n", cmd.Process.Pid)
+		outputs = append(outputs, output{file: r, stream: stream})
+		writers = append(writers, pw)
 
-		time.Sleep(time.Duration(k.opt.Delay+5) * time.Second)
-		if k.isSpawning == false {
-			k.spawn()
+		if stream == "stderr" {
+			cmd.Stderr = pw
+		} else {
+			cmd.Stdout = pw
 		}
-	}()
+	}
+	if w.config().Streams == "both" && !w.config().Passthrough {
+		cmd.Stderr = cmd.Stdout
+	}
 
-	// return the created Cmd struct
-	k.cmd = cmd
+	return outputs, writers, nil
 }
 
-// kill kills current k.cmd.
-func (k *Kelthuzad) kill() {
-	pgid, err := syscall.Getpgid(k.cmd.Process.Pid)
-	if err == nil {
-		syscall.Kill(-pgid, 15)
-	} else {
-		log.Println("[SYSTEM] the proecss was alreday terminated", err)
+// kill terminates p gracefully, and returns once it has exited.
+// It asks the process group to exit and kills it if it doesn't exit within the grace period.
+func (w *Watchdog) kill(p *proc) {
+	// nothing to do if it has exited already
+	if p == nil || isClosed(p.done) {
+		return
+	}
+	if p.cmd == nil {
+		w.stopContainer(p)
+		return
 	}
+
+	pid := p.pid
+	w.notify("kill", "", "")
+	if p.group == nil {
+		// the group is unknown, so there's nothing but the process itself to kill
+		p.cmd.Process.Kill()
+		<-p.done
+		return
+	}
+
+	err := p.group.terminate()
+	if err != nil {
+		w.log.logf("SYSTEM", record{Level: "info", Event: "kill", Pid: pid}, "the proecss was alreday terminated %v", err)
+		p.cmd.Process.Kill()
+		<-p.done
+		return
+	}
+
+	select {
+	case <-p.done:
+	case <-time.After(time.Duration(w.config().Grace) * time.Second):
+		w.log.logf("SYSTEM", record{Level: "warn", Event: "kill", Pid: pid}, "%v didn't exit in %v seconds, killing...", pid, w.config().Grace)
+		p.group.kill()
+		<-p.done
+	}
+}
+
+// ExitCode returns the exit code of the last process, which is -1 until any exits.
+// The process killed by a signal exits with 128 plus the signal.
+func (w *Watchdog) ExitCode() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.exitCode
+}
+
+// Signal sends sig to the process and all of its descendants, like tini does.
+func (w *Watchdog) Signal(sig os.Signal) error {
+	p := w.latest()
+	if p == nil || isClosed(p.done) {
+		return errors.New("kelthuzad: the process isn't running")
+	}
+	if p.cmd == nil {
+		return w.signalContainer(sig)
+	}
+	if p.group == nil {
+		return p.cmd.Process.Signal(sig)
+	}
+
+	return p.group.signal(sig)
+}
+
+// event returns the event of typ about the latest process.
+func (w *Watchdog) event(typ string, line string, pattern string) event {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	host, _ := os.Hostname()
+	e := event{
+		Type:      typ,
+		Service:   w.name,
+		Host:      host,
+		Line:      line,
+		Pattern:   pattern,
+		Restarts:  w.restarts,
+		Timestamp: time.Now(),
+	}
+	if typ == "fail" {
+		e.Context = w.recent.last(w.config().ContextLines)
+	}
+	if w.proc != nil {
+		e.Pid = w.proc.pid
+	}
+	return e
+}
+
+// notify sends the event of typ about the latest process to the sinks.
+func (w *Watchdog) notify(typ string, line string, pattern string) {
+	w.notifier.Load().notify(w.event(typ, line, pattern))
+}
+
+// check checks whether the line matches with the w.pattern and the w.rule, and has the actuator respawn the process if so.
+// The line doesn't fail the process which is being replaced already.
+func (w *Watchdog) check(ctx context.Context, line string) {
+	w.checkMatched(ctx, line, nil)
 }
 
-// check checks whether the line matches with the k.pattern.
-func (k *Kelthuzad) check(line string) {
-	// if the line contains the k.pattern
-	if k.pattern.MatchString(line) {
-		// notify it
-		log.Printf("[FAIL] %v -> %v\n", line, k.opt.Pattern)
+// checkMatched checks line as check does, by m matched ahead unless it's nil or stale.
+func (w *Watchdog) checkMatched(ctx context.Context, line string, m *prematched) {
+	cfg := w.config()
+
+	// the echo of a ping is just for kelthuzad
+	if w.echoed(line) {
+		return
+	}
+	w.copyLine(line)
+
+	p := w.current()
+	w.mu.Lock()
+	pattern, rule, criteria, excludes, heartbeat, capture := w.pattern, w.rule, w.criteria, w.excludes, w.heartbeat, w.capture
+	w.mu.Unlock()
+	if capture != nil {
+		capture.WriteString(line + "\n")
+	}
+	w.recent.add(line)
+
+	// the detectors see every line as it is, and the Go plugins check it right here within the budget
+	w.feed(line)
+	budget := time.Duration(cfg.PluginBudget) * time.Millisecond
+	for _, g := range w.goPlugins {
+		failed, reason, err := g.check(line, budget)
+		if err != nil && err != errBusy {
+			w.log.logf("SYSTEM", record{Level: "warn", Event: "detector"}, "%v %v", g, err)
+		}
+		if failed {
+			var captures map[string]string
+			if reason != "" {
+				captures = map[string]string{"reason": reason}
+			}
+			w.detected(ctx, g.String(), "plugin", line, captures)
+		}
+	}
+
+	// the lines of the process in the order of the sequence fail it
+	if p != nil && w.sequence != nil && w.sequence.advance(p.pid, line, time.Now()) {
+		w.detected(ctx, w.sequence.String(), "sequence", line, nil)
+	}
+
+	// the process is still alive
+	if p != nil && heartbeat != nil && heartbeat.MatchString(line) {
+		w.log.debugf("SYSTEM", record{Event: "heartbeat", Pid: p.pid, Line: line}, "%v beats by %v", p.pid, line)
+		w.resetHeartbeat()
+	}
 
-		// kill the sick one
-		k.kill()
+	// the process gets ready
+	if p != nil && w.ready != nil && !w.isReady() && w.ready.MatchString(line) {
+		w.markReady(ctx, p)
+	}
 
-		k.isSpawning = true
+	// if the latest lines contain the w.pattern and aren't benign, unless the detection is paused
+	w.mu.Lock()
+	text := w.window(line)
+	w.seen++
+	var matched bool
+	var captures map[string]string
+	excluded := -1
+	switch {
+	case w.paused:
+	case m != nil && m.pattern == pattern && m.rule == rule && m.excludes == excludes:
+		excluded, matched, captures = m.excluded, m.matched, m.captures
+	default:
+		excluded = excludes.match(text)
+		if excluded < 0 {
+			matched, captures = detect(pattern, rule, text, line)
+		}
+	}
+	var failed bool
+	if matched {
+		// the lines which matched once don't count again
+		w.lines = nil
+		failed = w.countMatch()
+	}
+	// a flood of the same error mustn't queue up the respawns, either while respawning or right after that
+	cooling := w.restarts > 0 && time.Since(w.spawnedAt) < time.Duration(cfg.Cooldown)*time.Second
+	matches := len(w.matches)
+	var pid int
+	if w.proc != nil {
+		pid = w.proc.pid
+	}
+	w.mu.Unlock()
 
-		// wait to avoid being with flooded with respawning
-		log.Printf("[SYSTEM] Waiting %v seconds...\n", k.opt.Delay)
-		time.Sleep(time.Second * time.Duration(k.opt.Delay))
+	if excluded >= 0 {
+		w.metrics.matched("exclude", excludes.patterns[excluded])
+		w.log.debugf("MATCH", record{Event: "exclude", Pid: pid, Line: text, Pattern: excludes.patterns[excluded]}, "%v is excluded by %v", text, excludes.patterns[excluded])
+	}
+	if matched {
+		w.metrics.matched("pattern", criteria)
+		e := w.event("match", text, criteria)
+		e.Captures = captures
+		w.notifier.Load().notify(e)
 
-		// respawn the normal one
-		k.spawn()
+		switch {
+		case !failed:
+			w.log.logf("MATCH", record{Level: "warn", Event: "match", Pid: pid, Line: text, Pattern: criteria, Captures: captures}, "%v -> %v (%v/%v)", text, criteria, matches, cfg.FailThreshold)
+		case p == nil || cooling:
+			w.log.logf("MATCH", record{Level: "warn", Event: "match", Pid: pid, Line: text, Pattern: criteria, Captures: captures}, "%v -> %v (%v/%v), not failing while respawning or cooling down", text, criteria, matches, cfg.FailThreshold)
+		default:
+			w.failLater(p, "regex-match", text, criteria, captures)
+		}
 
 		// if the Quiet flag isn't set, also print normal lines
-	} else if k.opt.Quiet == false {
-		log.Println(line)
+	} else if cfg.Quiet == false && !cfg.Passthrough {
+		w.log.output(line, pid, classify(w.severities, line))
 	}
 }
 
-// monitorLog monitors the specific log with tail and checks any changes whenever log populated.
-func (k *Kelthuzad) monitorLog() {
-	// get the Tail struct for monitoring the last part of the log
-	t, err := tail.TailFile(k.opt.LogPath, tail.Config{Follow: true, Location: &tail.SeekInfo{Offset: 0, Whence: os.SEEK_END}})
-	if err != nil {
-		log.Fatalln("[FATAL] k.monitorLog tail", err)
+// capture returns the named groups which re captured from text, or nil if it has none.
+func capture(re matcher, text string) map[string]string {
+	match := re.FindStringSubmatch(text)
+	if match == nil {
+		return nil
 	}
 
-	// monitor the log
-	for line := range t.Lines {
-		k.check(line.Text)
+	var captures map[string]string
+	for i, name := range re.SubexpNames() {
+		if name == "" || i >= len(match) {
+			continue
+		}
+		if captures == nil {
+			captures = make(map[string]string)
+		}
+		captures[name] = match[i]
 	}
+	return captures
 }
 
-// monitorStdout monitors the stdout of the process and checks it.
-func (k *Kelthuzad) monitorStdout() {
+// window appends line to the latest lines and returns up to MultilineLines of them joined by newlines.
+// w.mu must be held.
+func (w *Watchdog) window(line string) string {
+	w.lines = append(w.lines, line)
+	if n := len(w.lines) - w.config().MultilineLines; n > 0 {
+		w.lines = w.lines[n:]
+	}
+
+	return strings.Join(w.lines, "\n")
+}
+
+// countMatch counts a match of the current process and reports whether enough matches are within the fail window.
+// w.mu must be held.
+func (w *Watchdog) countMatch() bool {
+	window := time.Duration(w.config().FailWindow) * time.Second
+	for len(w.matches) > 0 && time.Since(w.matches[0]) > window {
+		w.matches = w.matches[1:]
+	}
+	w.matches = append(w.matches, time.Now())
+
+	return len(w.matches) >= w.config().FailThreshold
+}
+
+// fail kills the sick p which printed line matching with pattern, and respawns a normal one unless ctx is done.
+// The named groups captured from line tell why, and nothing happens when p is gone or being replaced already, so a process fails only once.
+// cause classifies the failure, which is regex-match, detector, plugin, sequence, probe-failure or resource-limit.
+func (w *Watchdog) fail(ctx context.Context, p *proc, cause string, line string, pattern string, captures map[string]string) {
+	pid := p.pid
+
+	// just tell what it would do, and count the failures from scratch
+	if w.config().DryRun {
+		w.log.logf("DRYRUN", record{Level: "warn", Event: "fail", Pid: pid, Line: line, Pattern: pattern, Captures: captures}, "%v -> %v, would kill %v and respawn it", line, pattern, pid)
+		w.mu.Lock()
+		w.matches = nil
+		w.mu.Unlock()
+		return
+	}
+
+	// the restart waits for the end of the freeze window
+	if until, frozen := w.frozen(time.Now()); frozen {
+		w.postpone(ctx, p, until, "fail", cause, line, pattern, captures)
+		return
+	}
+
+	if !w.claim(p) {
+		return
+	}
+
+	// notify it
+	w.log.logf("FAIL", record{Level: "error", Event: "fail", Pid: pid, Line: line, Pattern: pattern, Captures: captures}, "%v -> %v", line, pattern)
+	e := w.event("fail", line, pattern)
+	e.Cause = cause
+	e.Captures = captures
+	w.notifier.Load().notify(e)
+
+	w.restart(ctx, p, "fail", cause, line, pattern, captures)
+}
+
+// restart kills p for reason classified as cause and respawns a normal one unless ctx is done.
+// The caller must have claimed p.
+func (w *Watchdog) restart(ctx context.Context, p *proc, reason string, cause string, line string, pattern string, captures map[string]string) {
+	// the sick one keeps running and being monitored while the breaker is open
+	if !w.allowRestart(reason) {
+		w.log.logf("SYSTEM", record{Level: "warn", Event: "breaker", Pid: p.pid}, "%v isn't restarted while the breaker is open", p.pid)
+		w.mu.Lock()
+		w.spawning = false
+		w.matches = nil
+		w.mu.Unlock()
+		return
+	}
+	if !w.spend(ctx, p.pid, reason) {
+		w.mu.Lock()
+		w.spawning = false
+		w.matches = nil
+		w.mu.Unlock()
+		return
+	}
+	w.telemetry.begin(reason, cause, p.pid, line, pattern)
+
+	// kill the sick one, whose diagnostics are taken first if it's failed
+	e := w.event("pre-restart", line, pattern)
+	e.Cause = cause
+	e.Captures = captures
+	if reason == "fail" {
+		e.Context = w.recent.last(w.config().ContextLines)
+		w.snapshot(ctx, p, e)
+	}
+	w.runHook(w.config().PreRestart, e)
+	w.telemetry.stage("kill")
+	w.kill(p)
+	w.record(p, reason, cause, line, pattern)
+
+	// respawn the normal one
+	w.respawn(ctx, w.healthyUptime())
+}
+
+// monitorStdout monitors the streams of every spawned process and checks them until ctx is done.
+// The streams of a dead process are read until its descendants holding them exit as well, then closed.
+// The readers queue the lines, which are matched ahead by the workers if there are many, and checked in the order they came.
+func (w *Watchdog) monitorStdout(ctx context.Context) {
+	if w.sink != nil {
+		defer w.sink.close()
+	}
+
+	lines := make(chan string, w.config().QueueSize)
+	direct, ahead := lines, (<-chan *prematched)(nil)
+	if w.config().Matchers > 1 {
+		direct, ahead = nil, w.matchAhead(ctx, lines)
+	}
 	for {
-		// monitor the stdout
-		scanner := bufio.NewScanner(k.stdout)
-		for scanner.Scan() {
-			k.check(scanner.Text())
+		select {
+		case o := <-w.outputs:
+			go w.readOutput(ctx, o, lines)
+		case line := <-direct:
+			w.consume(ctx, line, nil)
+		case m := <-ahead:
+			select {
+			case <-m.done:
+			case <-ctx.Done():
+				return
+			}
+			w.consume(ctx, m.line, m)
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
-// Monitor monitors appropriate one depending on LogPath option.
-func (k *Kelthuzad) Monitor() {
-	if k.opt.LogPath != "" {
-		log.Println("[SYSTEM] monitoring log...")
-		k.monitorLog()
+// consume keeps line of the output before checking it, by m matched ahead unless it's nil.
+func (w *Watchdog) consume(ctx context.Context, line string, m *prematched) {
+	if w.sink != nil {
+		err := w.sink.write(line)
+		if err != nil {
+			w.log.logf("SYSTEM", record{Level: "warn", Event: "output"}, "output %v", err)
+		}
+	}
+
+	w.checkMatched(ctx, line, m)
+}
+
+// readOutput sends the lines of o until EOF or ctx is done, and closes it.
+// The lines are dropped rather than waiting while lines is full if QueueFull tells so.
+func (w *Watchdog) readOutput(ctx context.Context, o output, lines chan<- string) {
+	r := o.file
+	defer r.Close()
+
+	reader := newLineReader(r, w.config().MaxLineSize)
+	// the drops are told at most every second, which come and go quickly under the load
+	dropped := 0
+	var droppedAt time.Time
+	for {
+		line, truncated, err := reader.next()
+		if err != nil {
+			if dropped > 0 {
+				w.log.logf("SYSTEM", record{Level: "warn", Event: "drop"}, "dropped %v lines of %v while the queue was full", dropped, o.stream)
+			}
+			if r == os.Stdin && ctx.Err() == nil {
+				w.log.logf("SYSTEM", record{Level: "warn", Event: "monitor"}, "stdin is closed, so nothing is monitored anymore")
+			}
+			return
+		}
+		if truncated {
+			w.log.logf("SYSTEM", record{Level: "warn", Event: "truncate"}, "a line over %v bytes is truncated", w.config().MaxLineSize)
+		}
+		line = cleanLine(w.config(), line)
+		if w.config().Passthrough {
+			w.passthrough(o.stream, line)
+		}
+
+		if w.config().QueueFull == "drop" {
+			if ctx.Err() != nil {
+				return
+			}
+			select {
+			case lines <- line:
+				if dropped > 0 && time.Since(droppedAt) >= time.Second {
+					w.log.logf("SYSTEM", record{Level: "warn", Event: "drop"}, "dropped %v lines of %v while the queue was full", dropped, o.stream)
+					dropped = 0
+				}
+			default:
+				if dropped == 0 {
+					w.log.logf("SYSTEM", record{Level: "warn", Event: "drop"}, "the queue of the lines is full, dropping the lines of %v...", o.stream)
+					droppedAt = time.Now()
+				}
+				dropped++
+			}
+			continue
+		}
+		select {
+		case lines <- line:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// monitor monitors appropriate one depending on LogPath, JournaldUnit, SyslogListen, DockerContainer and Stdin options until ctx is done.
+func (w *Watchdog) monitor(ctx context.Context) {
+	if len(w.config().LogPath) > 0 {
+		w.monitorLogs(ctx)
+	} else if w.config().JournaldUnit != "" {
+		w.monitorJournald(ctx)
+	} else if w.syslog != nil {
+		w.monitorSyslog(ctx)
+	} else if w.docker != nil {
+		w.monitorContainer(ctx)
+	} else if w.config().Stdin {
+		// stdin is monitored as the output of every process, which is never piped
+		w.log.logf("SYSTEM", record{Level: "info", Event: "monitor"}, "monitoring stdin...")
+		w.outputs <- output{file: os.Stdin, stream: "stdin"}
+		w.monitorStdout(ctx)
+	} else if w.config().Pty {
+		w.log.logf("SYSTEM", record{Level: "info", Event: "monitor"}, "monitoring the pseudo-terminal...")
+		w.monitorStdout(ctx)
 	} else {
-		log.Println("[SYSTEM] monitoring stdout...")
-		k.monitorStdout()
+		w.log.logf("SYSTEM", record{Level: "info", Event: "monitor"}, "monitoring stdout...")
+		w.monitorStdout(ctx)
+	}
+}
+
+// Run spawns the process and monitors it until ctx is done or the watchdog stops respawning.
+// The process is always killed before it returns but the container, which is left running as it was found,
+// and ErrGiveUp is returned when it gave up respawning.
+// With LeaderLock, it does so only while leading the others sharing the lock.
+func (w *Watchdog) Run(ctx context.Context) error {
+	// the spans and the metrics left are exported on the way out
+	defer w.telemetry.shutdown()
+
+	// the other tools find kelthuzad by it to signal him
+	if w.config().PidFile != "" {
+		pid := os.Getpid()
+		err := writePidFile(w.config().PidFile, pid)
+		if err != nil {
+			return fmt.Errorf("kelthuzad: writePidFile: %w", err)
+		}
+		defer removePidFile(w.config().PidFile, pid)
+	}
+
+	// the pods are respawned by their controller, so there's nothing to spawn
+	if w.config().KubeSelector != "" {
+		return w.runKube(ctx)
+	}
+	if w.elector != nil {
+		return w.runElected(ctx)
 	}
+	return w.supervise(ctx)
 }
 
-func main() {
-	// initialize empty options
-	opt := &opts{}
+// supervise spawns the process and monitors it until ctx is done or the watchdog stops respawning.
+func (w *Watchdog) supervise(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	// set the log flags
-	log.SetFlags(log.Ltime | log.LstdFlags)
+	// adopt the orphans before any process is spawned
+	if w.config().Init {
+		err := becomeSubreaper()
+		if err != nil {
+			return err
+		}
+	}
 
-	// parse the arguments
-	_, err := flags.Parse(opt)
+	// listen first, so the address in use doesn't leave the process spawned, and close the listeners on the way out
+	// whether or not the servers got to them
+	loopers := []func(context.Context){w.monitor, w.actuate, w.probe, w.ping, w.forwardStdin, w.watchResources, w.watchRate, w.schedule, w.sdWatchdog, w.reap, w.join, w.restartOnRequest, w.runTees, w.emitStatsd}
+	if w.config().Cgroup != "" {
+		var err error
+		w.cgroup, err = newCgroup(w.config())
+		if err != nil {
+			return fmt.Errorf("kelthuzad: newCgroup: %w", err)
+		}
+		defer w.cgroup.remove()
+	}
+	if w.config().SyslogListen != "" {
+		var err error
+		w.syslog, err = w.listenSyslog()
+		if err != nil {
+			return fmt.Errorf("kelthuzad: listenSyslog: %w", err)
+		}
+		defer w.syslog.packet.Close()
+		defer w.syslog.stream.Close()
+	}
+	for _, d := range w.detectors {
+		d := d
+		loopers = append(loopers, func(ctx context.Context) {
+			w.runDetector(ctx, d)
+		})
+	}
+	if w.config().APIAddr != "" {
+		ln, err := listen(w.config().APIAddr)
+		if err != nil {
+			return fmt.Errorf("kelthuzad: listenAPI: %w", err)
+		}
+		defer ln.Close()
+		loopers = append(loopers, func(ctx context.Context) {
+			w.serveAPI(ctx, ln)
+		})
+	}
+	if w.config().ControlSocket != "" {
+		ln, err := w.listenControl()
+		if err != nil {
+			return fmt.Errorf("kelthuzad: listenControl: %w", err)
+		}
+		defer ln.Close()
+		loopers = append(loopers, func(ctx context.Context) {
+			w.serveControl(ctx, ln)
+		})
+	}
+	if w.config().GRPCAddr != "" {
+		ln, err := listen(w.config().GRPCAddr)
+		if err != nil {
+			return fmt.Errorf("kelthuzad: listenGRPC: %w", err)
+		}
+		defer ln.Close()
+		loopers = append(loopers, func(ctx context.Context) {
+			w.serveGRPC(ctx, ln)
+		})
+	}
+
+	err := w.spawn(ctx)
 	if err != nil {
-		os.Exit(1)
+		return err
 	}
 
-	// make sure that one of these options to be specified
-	if (opt.CmdPath == "") == (opt.RawCommand == "") {
-		log.Fatalln("[FATAL] You must specify one of CmdPath, RawCommand!")
+	// monitor the output, probe the process, watch its resources and rate, and serve the API side by side
+	var loops sync.WaitGroup
+	for _, loop := range loopers {
+		loops.Add(1)
+		go func(loop func(context.Context)) {
+			defer loops.Done()
+			loop(ctx)
+		}(loop)
 	}
 
-	// get a kelthuzad object
-	kel := New(opt)
+	select {
+	case <-ctx.Done():
+	case err = <-w.stopped:
+	}
 
-	// handle an interrupt for terminate children process and itself gracefully
-	signalChan := make(chan os.Signal)
-	signal.Notify(signalChan, os.Interrupt)
-	go func() {
-		<-signalChan
-		log.Print("[SYSTEM] recieved an interrupt, stopping...\n\n")
-		kel.kill()
-		os.Exit(0)
-	}()
+	// stop monitoring and make sure the process doesn't outlive the watchdog
+	sdNotify("STOPPING=1")
+	cancel()
+	if w.docker == nil {
+		w.kill(w.latest())
+	}
+	loops.Wait()
 
-	// start monitoring
-	kel.Monitor()
+	return err
 }
@@ -0,0 +1,312 @@
+package kelthuzad
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// podInterval is how often the pods matching the selector are listed again to follow the new ones.
+const podInterval = 5 * time.Second
+
+// namespaceFile has the namespace of the pod which kelthuzad runs in.
+const namespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// podLine is a line of the logs of a pod.
+type podLine struct {
+	name string
+	uid  string
+	text string
+}
+
+// podFollower follows the logs of a pod.
+type podFollower struct {
+	cancel  context.CancelFunc
+	matches []time.Time
+	deleted bool
+	recent  *ring
+}
+
+// newKubeClient returns the client of the cluster which kelthuzad runs in, or the one of kubeconfig.
+func newKubeClient(kubeconfig string) (kubernetes.Interface, error) {
+	var cfg *rest.Config
+	var err error
+	if kubeconfig != "" {
+		cfg, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	} else {
+		cfg, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return kubernetes.NewForConfig(cfg)
+}
+
+// kubeNamespace returns the namespace of the pods, which is the one kelthuzad runs in unless given.
+func (w *Watchdog) kubeNamespace() string {
+	if w.config().KubeNamespace != "" {
+		return w.config().KubeNamespace
+	}
+	if b, err := os.ReadFile(namespaceFile); err == nil {
+		return strings.TrimSpace(string(b))
+	}
+	return "default"
+}
+
+// runKube watches the logs of the pods matching KubeSelector and deletes the failing ones for their controller to respawn,
+// while it leads the replicas of kelthuzad by the lease of KubeLease, until ctx is done.
+func (w *Watchdog) runKube(ctx context.Context) error {
+	client, err := newKubeClient(w.config().Kubeconfig)
+	if err != nil {
+		return fmt.Errorf("kelthuzad: kubernetes client: %w", err)
+	}
+	namespace := w.kubeNamespace()
+
+	// the pod name tells which replica is leading, and the pid tells apart the ones out of the cluster
+	host, _ := os.Hostname()
+	identity := host + "_" + strconv.Itoa(os.Getpid())
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: w.config().KubeLease, Namespace: namespace},
+		Client:     client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+
+	// losing the lead stops acting, and the lead is tried again unless ctx is done
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			LeaseDuration:   15 * time.Second,
+			RenewDeadline:   10 * time.Second,
+			RetryPeriod:     2 * time.Second,
+			ReleaseOnCancel: true,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					w.log.logf("SYSTEM", record{Level: "info", Event: "leader"}, "%v leads, monitoring the pods of %v in %v...", identity, w.config().KubeSelector, namespace)
+					w.watchPods(ctx, client, namespace)
+				},
+				OnStoppedLeading: func() {
+					w.log.logf("SYSTEM", record{Level: "info", Event: "leader"}, "%v doesn't lead anymore", identity)
+				},
+				OnNewLeader: func(leader string) {
+					if leader != identity {
+						w.log.logf("SYSTEM", record{Level: "info", Event: "leader"}, "%v leads, waiting...", leader)
+					}
+				},
+			},
+		})
+	}
+
+	return nil
+}
+
+// watchPods follows the logs of the running pods matching KubeSelector, and checks each line of them until ctx is done.
+func (w *Watchdog) watchPods(ctx context.Context, client kubernetes.Interface, namespace string) {
+	pods := client.CoreV1().Pods(namespace)
+	lines := make(chan podLine)
+	gone := make(chan string)
+	followers := make(map[string]*podFollower)
+	since := time.Now()
+	resolve := func() {
+		list, err := pods.List(ctx, metav1.ListOptions{LabelSelector: w.config().KubeSelector})
+		if err != nil {
+			if ctx.Err() == nil {
+				w.log.logf("SYSTEM", record{Level: "warn", Event: "kubernetes"}, "list pods %v", err)
+			}
+			return
+		}
+
+		for i := range list.Items {
+			pod := &list.Items[i]
+			uid := string(pod.UID)
+			if followers[uid] != nil || pod.Status.Phase != corev1.PodRunning || pod.DeletionTimestamp != nil {
+				continue
+			}
+
+			// only the pods which are there from the start have the past lines
+			from := pod.CreationTimestamp.Time
+			if from.Before(since) {
+				from = since
+			}
+			followCtx, cancel := context.WithCancel(ctx)
+			followers[uid] = &podFollower{cancel: cancel, recent: newRing(w.config().ContextLines)}
+			go w.followPod(followCtx, pods, pod, from, lines, gone)
+		}
+	}
+
+	resolve()
+	ticker := time.NewTicker(podInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case line := <-lines:
+			if f := followers[line.uid]; f != nil {
+				w.checkPod(ctx, pods, f, line)
+			}
+		case uid := <-gone:
+			if f := followers[uid]; f != nil {
+				f.cancel()
+				delete(followers, uid)
+			}
+		case <-ticker.C:
+			resolve()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// followPod sends the lines of the logs of pod since from until the pod is gone or ctx is done, and tells gone about it.
+// The logs end whenever the container restarts, so they're followed again from the last line seen.
+func (w *Watchdog) followPod(ctx context.Context, pods corev1client.PodInterface, pod *corev1.Pod, from time.Time, lines chan<- podLine, gone chan<- string) {
+	defer func() {
+		select {
+		case gone <- string(pod.UID):
+		case <-ctx.Done():
+		}
+	}()
+
+	container := w.config().KubeContainer
+	if container == "" && len(pod.Spec.Containers) > 0 {
+		container = pod.Spec.Containers[0].Name
+	}
+
+	w.log.logf("SYSTEM", record{Level: "info", Event: "monitor"}, "monitoring %v/%v...", pod.Name, container)
+	for {
+		opts := &corev1.PodLogOptions{Container: container, Follow: true, Timestamps: true, SinceTime: &metav1.Time{Time: from}}
+		stream, err := pods.GetLogs(pod.Name, opts).Stream(ctx)
+		if err == nil {
+			reader := newLineReader(stream, w.config().MaxLineSize)
+			for {
+				line, truncated, err := reader.next()
+				if err != nil {
+					break
+				}
+				if truncated {
+					w.log.logf("SYSTEM", record{Level: "warn", Event: "truncate"}, "a line over %v bytes is truncated", w.config().MaxLineSize)
+				}
+
+				// the lines since from are there again when the logs are followed again, which don't count twice
+				stamp, text := line, ""
+				if i := strings.IndexByte(line, ' '); i >= 0 {
+					stamp, text = line[:i], line[i+1:]
+				}
+				if at, err := time.Parse(time.RFC3339Nano, stamp); err == nil {
+					if !at.After(from) {
+						continue
+					}
+					from = at
+				}
+
+				select {
+				case lines <- podLine{name: pod.Name, uid: string(pod.UID), text: cleanLine(w.config(), text)}:
+				case <-ctx.Done():
+					stream.Close()
+					return
+				}
+			}
+			stream.Close()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		// the same name may be another pod already
+		current, err := pods.Get(ctx, pod.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) || (err == nil && (current.UID != pod.UID || current.DeletionTimestamp != nil)) {
+			w.log.logf("SYSTEM", record{Level: "info", Event: "exit"}, "%v is gone", pod.Name)
+			return
+		}
+		if !sleep(ctx, containerRetry) {
+			return
+		}
+	}
+}
+
+// checkPod checks whether the line of the pod followed by f matches with the w.pattern and the w.rule, and deletes the pod if so.
+func (w *Watchdog) checkPod(ctx context.Context, pods corev1client.PodInterface, f *podFollower, line podLine) {
+	cfg := w.config()
+	w.mu.Lock()
+	pattern, rule, criteria, excludes := w.pattern, w.rule, w.criteria, w.excludes
+	w.mu.Unlock()
+	f.recent.add(line.text)
+
+	var matched bool
+	var captures map[string]string
+	if !f.deleted {
+		if i := excludes.match(line.text); i >= 0 {
+			w.metrics.matched("exclude", excludes.patterns[i])
+		} else {
+			matched, captures = detect(pattern, rule, line.text, line.text)
+		}
+	}
+	if !matched {
+		if cfg.Quiet == false {
+			w.log.output(line.name+": "+line.text, 0, classify(w.severities, line.text))
+		}
+		return
+	}
+
+	w.metrics.matched("pattern", criteria)
+	e := w.event("match", line.text, criteria)
+	e.Pod = line.name
+	e.Captures = captures
+	w.notifier.Load().notify(e)
+
+	// every pod counts its own matches like a process does
+	window := time.Duration(cfg.FailWindow) * time.Second
+	for len(f.matches) > 0 && time.Since(f.matches[0]) > window {
+		f.matches = f.matches[1:]
+	}
+	f.matches = append(f.matches, time.Now())
+	if len(f.matches) < cfg.FailThreshold {
+		w.log.logf("MATCH", record{Level: "warn", Event: "match", Line: line.text, Pattern: criteria, Captures: captures}, "%v: %v -> %v (%v/%v)", line.name, line.text, criteria, len(f.matches), cfg.FailThreshold)
+		return
+	}
+	f.matches = nil
+
+	if cfg.DryRun {
+		w.log.logf("DRYRUN", record{Level: "warn", Event: "fail", Line: line.text, Pattern: criteria, Captures: captures}, "%v: %v -> %v, would delete %v", line.name, line.text, criteria, line.name)
+		return
+	}
+
+	w.log.logf("FAIL", record{Level: "error", Event: "fail", Line: line.text, Pattern: criteria, Captures: captures}, "%v: %v -> %v", line.name, line.text, criteria)
+	e = w.event("fail", line.text, criteria)
+	e.Pod = line.name
+	e.Cause = "regex-match"
+	e.Captures = captures
+	e.Context = f.recent.last(cfg.ContextLines)
+	w.notifier.Load().notify(e)
+	e.Type = "pre-restart"
+	w.runHook(cfg.PreRestart, e)
+
+	// the pod is respawned by its controller, and its lines which are still coming don't count anymore
+	f.deleted = true
+	grace := int64(cfg.Grace)
+	uid := types.UID(line.uid)
+	err := pods.Delete(ctx, line.name, metav1.DeleteOptions{GracePeriodSeconds: &grace, Preconditions: &metav1.Preconditions{UID: &uid}})
+	if err != nil && !apierrors.IsNotFound(err) {
+		w.log.logf("SYSTEM", record{Level: "warn", Event: "kill"}, "delete %v %v", line.name, err)
+		f.deleted = false
+		return
+	}
+
+	w.mu.Lock()
+	w.restarts++
+	w.mu.Unlock()
+	w.metrics.restarted("regex-match")
+	w.log.logf("SYSTEM", record{Level: "info", Event: "kill"}, "%v is deleted, leaving the respawn to its controller", line.name)
+}
@@ -0,0 +1,109 @@
+//go:build linux
+
+package kelthuzad
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"strconv"
+	"strings"
+)
+
+// rlimit is a resource limit to set on the process.
+type rlimit struct {
+	name     string
+	resource int
+	limit    unix.Rlimit
+}
+
+// newLimits returns the resource limits of cfg which are set, on top of the current limits of kelthuzad.
+func newLimits(cfg *Config) ([]rlimit, error) {
+	specs := []struct {
+		name     string
+		resource int
+		spec     string
+	}{
+		{"LimitNofile", unix.RLIMIT_NOFILE, cfg.LimitNofile},
+		{"LimitCore", unix.RLIMIT_CORE, cfg.LimitCore},
+		{"LimitNproc", unix.RLIMIT_NPROC, cfg.LimitNproc},
+		{"LimitMemlock", unix.RLIMIT_MEMLOCK, cfg.LimitMemlock},
+		{"LimitStack", unix.RLIMIT_STACK, cfg.LimitStack},
+		{"LimitAs", unix.RLIMIT_AS, cfg.LimitAs},
+	}
+
+	var limits []rlimit
+	for _, s := range specs {
+		if s.spec == "" {
+			continue
+		}
+		var cur unix.Rlimit
+		err := unix.Getrlimit(s.resource, &cur)
+		if err != nil {
+			return nil, fmt.Errorf("kelthuzad: %v: %w", s.name, err)
+		}
+		limit, err := parseLimit(s.spec, cur)
+		if err != nil {
+			return nil, fmt.Errorf("kelthuzad: %v: %w", s.name, err)
+		}
+		limits = append(limits, rlimit{name: s.name, resource: s.resource, limit: limit})
+	}
+
+	return limits, nil
+}
+
+// parseLimit parses soft[:hard] of numbers or unlimited, where the hard limit is kept as cur unless the soft one is over it.
+func parseLimit(spec string, cur unix.Rlimit) (unix.Rlimit, error) {
+	softSpec, hardSpec, both := strings.Cut(spec, ":")
+	soft, err := parseLimitValue(softSpec)
+	if err != nil {
+		return unix.Rlimit{}, err
+	}
+	hard := cur.Max
+	if both {
+		hard, err = parseLimitValue(hardSpec)
+		if err != nil {
+			return unix.Rlimit{}, err
+		}
+		if soft > hard {
+			return unix.Rlimit{}, fmt.Errorf("the soft limit %v is over the hard limit %v", softSpec, hardSpec)
+		}
+	} else if soft > hard {
+		hard = soft
+	}
+
+	return unix.Rlimit{Cur: soft, Max: hard}, nil
+}
+
+// parseLimitValue parses a number or unlimited.
+func parseLimitValue(s string) (uint64, error) {
+	if s == "unlimited" || s == "infinity" {
+		return unix.RLIM_INFINITY, nil
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || v >= unix.RLIM_INFINITY {
+		return 0, fmt.Errorf("%v must be a number or unlimited", s)
+	}
+	return v, nil
+}
+
+// formatLimit formats v as a number or unlimited.
+func formatLimit(v uint64) string {
+	if v == unix.RLIM_INFINITY {
+		return "unlimited"
+	}
+	return strconv.FormatUint(v, 10)
+}
+
+// setLimits sets limits on the started process of pid rather than on kelthuzad around the fork,
+// whose goroutines would run with them meanwhile, and whose children would get them back as they were.
+func setLimits(pid int, limits []rlimit) error {
+	for _, l := range limits {
+		limit := l.limit
+		err := unix.Prlimit(pid, l.resource, &limit, nil)
+		if err != nil {
+			return fmt.Errorf("kelthuzad: %v %v:%v: %w", l.name, formatLimit(l.limit.Cur), formatLimit(l.limit.Max), err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+//go:build linux
+
+package kelthuzad
+
+import (
+	"golang.org/x/sys/unix"
+	"testing"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		cur     unix.Rlimit
+		want    unix.Rlimit
+		wantErr bool
+	}{
+		{"soft only", "100", unix.Rlimit{Cur: 10, Max: 1000}, unix.Rlimit{Cur: 100, Max: 1000}, false},
+		{"soft over the hard", "2000", unix.Rlimit{Cur: 10, Max: 1000}, unix.Rlimit{Cur: 2000, Max: 2000}, false},
+		{"soft and hard", "100:200", unix.Rlimit{Cur: 10, Max: 1000}, unix.Rlimit{Cur: 100, Max: 200}, false},
+		{"equal", "200:200", unix.Rlimit{Cur: 10, Max: 1000}, unix.Rlimit{Cur: 200, Max: 200}, false},
+		{"zero", "0", unix.Rlimit{Cur: 10, Max: 1000}, unix.Rlimit{Cur: 0, Max: 1000}, false},
+		{"unlimited", "unlimited", unix.Rlimit{Cur: 10, Max: 1000}, unix.Rlimit{Cur: unix.RLIM_INFINITY, Max: unix.RLIM_INFINITY}, false},
+		{"infinity", "100:infinity", unix.Rlimit{Cur: 10, Max: 1000}, unix.Rlimit{Cur: 100, Max: unix.RLIM_INFINITY}, false},
+		{"soft over the given hard", "300:200", unix.Rlimit{Cur: 10, Max: 1000}, unix.Rlimit{}, true},
+		{"unlimited soft over the hard", "unlimited:200", unix.Rlimit{Cur: 10, Max: 1000}, unix.Rlimit{}, true},
+		{"empty", "", unix.Rlimit{Cur: 10, Max: 1000}, unix.Rlimit{}, true},
+		{"empty hard", "100:", unix.Rlimit{Cur: 10, Max: 1000}, unix.Rlimit{}, true},
+		{"negative", "-1", unix.Rlimit{Cur: 10, Max: 1000}, unix.Rlimit{}, true},
+		{"not a number", "lots", unix.Rlimit{Cur: 10, Max: 1000}, unix.Rlimit{}, true},
+		{"the infinity as a number", "18446744073709551615", unix.Rlimit{Cur: 10, Max: 1000}, unix.Rlimit{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLimit(tt.spec, tt.cur)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseLimit(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseLimit(%q) = %+v, want %+v", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+
+package kelthuzad
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// rlimit isn't supported on the other systems.
+type rlimit struct{}
+
+// newLimits returns an error when any of the resource limits is set.
+func newLimits(cfg *Config) ([]rlimit, error) {
+	if cfg.LimitNofile != "" || cfg.LimitCore != "" || cfg.LimitNproc != "" || cfg.LimitMemlock != "" || cfg.LimitStack != "" || cfg.LimitAs != "" {
+		return nil, fmt.Errorf("kelthuzad: LimitNofile, LimitCore, LimitNproc, LimitMemlock, LimitStack and LimitAs aren't supported on %v", runtime.GOOS)
+	}
+
+	return nil, nil
+}
+
+// setLimits does nothing, since there are no limits.
+func setLimits(pid int, limits []rlimit) error {
+	return nil
+}
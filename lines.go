@@ -0,0 +1,78 @@
+package kelthuzad
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// lineReader reads the lines, truncating the ones longer than max instead of failing on them as bufio.Scanner does.
+type lineReader struct {
+	r   *bufio.Reader
+	max int
+	// read is the bytes of the lines read so far, including the line endings and the truncated ones
+	read int64
+}
+
+// newLineReader returns the lineReader of r.
+func newLineReader(r io.Reader, max int) *lineReader {
+	return &lineReader{r: bufio.NewReader(r), max: max}
+}
+
+// next returns the next line without the line ending, and whether it was truncated.
+// The last line without the line ending is returned as well, and then io.EOF.
+func (l *lineReader) next() (string, bool, error) {
+	var line []byte
+	truncated := false
+	for {
+		chunk, err := l.r.ReadSlice('\n')
+		l.read += int64(len(chunk))
+		if !truncated {
+			// keep up to max, and skip the rest until the line ends, which doesn't count toward max
+			body := chunk
+			if bytes.HasSuffix(body, []byte("\n")) {
+				body = bytes.TrimSuffix(body[:len(body)-1], []byte("\r"))
+			}
+			if room := l.max - len(line); len(body) > room {
+				chunk = chunk[:room]
+				truncated = true
+			}
+			line = append(line, chunk...)
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && len(line) == 0 {
+			return "", false, err
+		}
+		break
+	}
+
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	return string(line), truncated, nil
+}
+
+// ansi matches an ANSI escape sequence: CSI such as the colors, OSC such as the titles, or the other two-byte ones.
+var ansi = regexp.MustCompile(`\x1b(?:\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(?:\x07|\x1b\\)?|[@-Z\\-_])`)
+
+// cleanLine strips the ANSI escape sequences of line, and replaces its invalid UTF-8 and control characters, as cfg tells.
+func cleanLine(cfg *Config, line string) string {
+	if cfg.StripANSI && strings.IndexByte(line, '\x1b') >= 0 {
+		line = ansi.ReplaceAllString(line, "")
+	}
+	if cfg.ReplaceInvalid {
+		line = strings.Map(func(r rune) rune {
+			if r == '\t' || !unicode.IsControl(r) {
+				return r
+			}
+			return utf8.RuneError
+		}, line)
+	}
+	return line
+}
@@ -0,0 +1,54 @@
+package kelthuzad
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLineReaderNext(t *testing.T) {
+	type line struct {
+		text      string
+		truncated bool
+	}
+	tests := []struct {
+		name  string
+		input string
+		max   int
+		want  []line
+	}{
+		{"shorter", "abc\n", 5, []line{{"abc", false}}},
+		{"exactly max", "abcde\n", 5, []line{{"abcde", false}}},
+		{"exactly max with CRLF", "abcde\r\n", 5, []line{{"abcde", false}}},
+		{"exactly max without the line ending", "abcde", 5, []line{{"abcde", false}}},
+		{"one over max", "abcdef\n", 5, []line{{"abcde", true}}},
+		{"one over max with CRLF", "abcdef\r\n", 5, []line{{"abcde", true}}},
+		{"the rest is skipped", "abcdefgh\nxy\n", 5, []line{{"abcde", true}, {"xy", false}}},
+		{"empty lines", "\n\r\n", 5, []line{{"", false}, {"", false}}},
+		{"over the buffer", strings.Repeat("a", 5000) + "\nb\n", 4096, []line{{strings.Repeat("a", 4096), true}, {"b", false}}},
+		{"exactly the buffer", strings.Repeat("a", 4096) + "\n", 4096, []line{{strings.Repeat("a", 4096), false}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLineReader(strings.NewReader(tt.input), tt.max)
+			var got []line
+			for {
+				text, truncated, err := l.next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("next() error = %v", err)
+				}
+				got = append(got, line{text, truncated})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("next() = %+v, want %+v", got, tt.want)
+			}
+			if l.read != int64(len(tt.input)) {
+				t.Errorf("read = %v, want %v", l.read, len(tt.input))
+			}
+		})
+	}
+}
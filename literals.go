@@ -0,0 +1,71 @@
+package kelthuzad
+
+// literals finds which of the literals occur in a text in one pass by Aho-Corasick.
+type literals struct {
+	n int
+	// next is the state after a byte at a state, where the failures are resolved already
+	next [][256]int32
+	// out is the indices of the literals ending at the state, including the ones of its suffixes
+	out [][]int
+}
+
+// newLiterals builds the automaton of lits, whose indices are reported by scan.
+// The empty literals never occur.
+func newLiterals(lits []string) *literals {
+	l := &literals{n: len(lits), next: make([][256]int32, 1), out: make([][]int, 1)}
+	// build the trie, where 0 is no edge but the root, which no edge goes back to
+	for i, lit := range lits {
+		if lit == "" {
+			continue
+		}
+		state := int32(0)
+		for j := 0; j < len(lit); j++ {
+			if l.next[state][lit[j]] == 0 {
+				l.next[state][lit[j]] = int32(len(l.next))
+				l.next = append(l.next, [256]int32{})
+				l.out = append(l.out, nil)
+			}
+			state = l.next[state][lit[j]]
+		}
+		l.out[state] = append(l.out[state], i)
+	}
+
+	// breadth first, a state fails to the longest proper suffix of it, whose missing edges it takes over
+	fail := make([]int32, len(l.next))
+	var queue []int32
+	for c := 0; c < 256; c++ {
+		if s := l.next[0][c]; s != 0 {
+			queue = append(queue, s)
+		}
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		l.out[state] = append(l.out[state], l.out[fail[state]]...)
+		for c := 0; c < 256; c++ {
+			s := l.next[state][c]
+			if s == 0 {
+				l.next[state][c] = l.next[fail[state]][c]
+				continue
+			}
+			fail[s] = l.next[fail[state]][c]
+			queue = append(queue, s)
+		}
+	}
+
+	return l
+}
+
+// scan reports which of the literals occur in text by their indices.
+func (l *literals) scan(text string) []bool {
+	found := make([]bool, l.n)
+	state := int32(0)
+	for i := 0; i < len(text); i++ {
+		state = l.next[state][text[i]]
+		for _, j := range l.out[state] {
+			found[j] = true
+		}
+	}
+
+	return found
+}
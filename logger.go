@@ -0,0 +1,162 @@
+package kelthuzad
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// levels are the levels of the logs and the lines of the process from the lowest.
+var levels = []string{"debug", "info", "warn", "error"}
+
+// rank returns the index of level in levels, where an unknown one is info.
+func rank(level string) int {
+	for i, l := range levels {
+		if l == level {
+			return i
+		}
+	}
+	return 1
+}
+
+// logger writes what the watchdog does, either as the text lines tagged like [SYSTEM] or as the JSON lines,
+// dropping what's lower than its level.
+type logger struct {
+	json  bool
+	mu    sync.Mutex
+	base  int
+	lower int
+}
+
+// record is a JSON line of the logger.
+type record struct {
+	Time     time.Time         `json:"time"`
+	Level    string            `json:"level"`
+	Event    string            `json:"event"`
+	Message  string            `json:"message,omitempty"`
+	Pid      int               `json:"pid,omitempty"`
+	Line     string            `json:"line,omitempty"`
+	Pattern  string            `json:"pattern,omitempty"`
+	Captures map[string]string `json:"captures,omitempty"`
+}
+
+// newLogger returns the logger writing in format, which is text or json, from the info level.
+func newLogger(format string) *logger {
+	return &logger{json: format == "json", base: 1, lower: 1}
+}
+
+// logf logs r with the message of format, which is prefixed by tag in the text lines, unless r is lower than the level.
+func (l *logger) logf(tag string, r record, format string, args ...interface{}) {
+	if !l.enabled(r.Level) {
+		return
+	}
+
+	r.Message = fmt.Sprintf(format, args...)
+	if !l.json {
+		log.Printf("[%v] %v\n", tag, r.Message)
+		return
+	}
+
+	l.encode(r)
+}
+
+// debugf logs r as logf does at the debug level.
+func (l *logger) debugf(tag string, r record, format string, args ...interface{}) {
+	r.Level = "debug"
+	l.logf(tag, r, format, args...)
+}
+
+// enabled reports whether level is logged.
+func (l *logger) enabled(level string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return rank(level) >= l.lower
+}
+
+// setLevel logs from level on, which is what toggleDebug goes back to.
+func (l *logger) setLevel(level string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.base = rank(level)
+	l.lower = l.base
+}
+
+// toggleDebug switches the level to debug, or back to the one set, which is info if it's debug, and returns the new one.
+func (l *logger) toggleDebug() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case l.lower != 0:
+		l.lower = 0
+	case l.base != 0:
+		l.lower = l.base
+	default:
+		l.lower = 1
+	}
+	return levels[l.lower]
+}
+
+// output logs a line of the process with pid as it is, unless its level is lower than the one of l.
+func (l *logger) output(line string, pid int, level string) {
+	if !l.enabled(level) {
+		return
+	}
+	if !l.json {
+		log.Println(line)
+		return
+	}
+
+	l.encode(record{Level: level, Event: "output", Pid: pid, Line: line})
+}
+
+// severity classifies the lines of the process whose pattern matches as level.
+type severity struct {
+	level   string
+	pattern *regexp.Regexp
+}
+
+// parseSeverities parses specs of LEVEL=REGEX.
+func parseSeverities(specs []string) ([]severity, error) {
+	var severities []severity
+	for _, spec := range specs {
+		level, pattern, ok := strings.Cut(spec, "=")
+		if !ok || levels[rank(level)] != level {
+			return nil, fmt.Errorf("kelthuzad: SeverityPatterns %v must be LEVEL=REGEX of debug, info, warn or error", spec)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("kelthuzad: SeverityPatterns: %w", err)
+		}
+		severities = append(severities, severity{level: level, pattern: re})
+	}
+	return severities, nil
+}
+
+// classify returns the level of the first of severities matching line, or info if none does.
+func classify(severities []severity, line string) string {
+	for _, s := range severities {
+		if s.pattern.MatchString(line) {
+			return s.level
+		}
+	}
+	return "info"
+}
+
+// encode writes r as a JSON line to where the standard logger writes.
+func (l *logger) encode(r record) {
+	r.Time = time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	enc := json.NewEncoder(log.Writer())
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(r)
+	if err != nil {
+		log.Println("[SYSTEM] l.encode", err)
+	}
+}
@@ -0,0 +1,448 @@
+package kelthuzad
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nxadm/tail"
+	"github.com/nxadm/tail/watch"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// globInterval is how often the globs of LogPath are resolved again to follow the logs which appear later.
+const globInterval = 5 * time.Second
+
+// fifoRetry is how long to wait before opening a named pipe again.
+const fifoRetry = time.Second
+
+// linkInterval is how often the symlink of a log is resolved again to follow the file it's re-pointed to.
+const linkInterval = time.Second
+
+// checkpointInterval is how often the checkpoints of the logs are saved in the state dir.
+const checkpointInterval = time.Second
+
+// logLine is a line of the log at path, followed by the checkpoint of the next line, whose offset is -1 for a pipe.
+type logLine struct {
+	path string
+	text string
+	next checkpoint
+}
+
+// monitorLogs follows every log of LogPath and checks each line of any of them until ctx is done.
+// The checkpoints of the lines checked are saved in the state dir every checkpoint interval and at last, if it's given.
+func (w *Watchdog) monitorLogs(ctx context.Context) {
+	saved, err := loadOffsets(w.config().StateDir)
+	if err != nil {
+		w.stop(fmt.Errorf("kelthuzad: monitorLogs offsets: %w", err))
+		return
+	}
+	save := func() {
+		err := saved.save()
+		if err != nil {
+			w.log.logf("SYSTEM", record{Level: "warn", Event: "monitor"}, "saving the offsets %v", err)
+		}
+	}
+	defer save()
+
+	// the interval of tail is global, which is fine since it's never reloaded
+	if w.config().TailPoll > 0 {
+		watch.POLL_DURATION = time.Duration(w.config().TailPoll) * time.Millisecond
+	}
+
+	// every log sends its lines into one channel, so that the lines are checked one by one
+	lines := make(chan logLine)
+	followed := make(map[string]bool)
+	resolve := func(start bool) {
+		for _, path := range w.config().LogPath {
+			// a plain path is followed even before it exists
+			matches := []string{path}
+			if strings.ContainsAny(path, "*?[") {
+				matches, _ = filepath.Glob(path)
+			}
+
+			for _, match := range matches {
+				if followed[match] {
+					continue
+				}
+				followed[match] = true
+
+				info, err := os.Stat(match)
+				if err == nil && info.Mode()&os.ModeNamedPipe != 0 {
+					go w.monitorFifo(ctx, match, lines)
+					continue
+				}
+				go w.monitorLog(ctx, match, w.tailFrom(match, info, start, saved), lines)
+			}
+		}
+	}
+
+	resolve(true)
+	ticker := time.NewTicker(globInterval)
+	defer ticker.Stop()
+	checkpoints := time.NewTicker(checkpointInterval)
+	defer checkpoints.Stop()
+	for {
+		select {
+		case line := <-lines:
+			w.check(ctx, cleanLine(w.config(), line.text))
+			if line.next.Offset >= 0 {
+				saved.set(line.path, line.next)
+			}
+		case <-ticker.C:
+			resolve(false)
+		case <-checkpoints.C:
+			save()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// monitorLog monitors the specific log with tail and sends any lines whenever log populated until ctx is done.
+// It starts reading where start tells, and the files a symlink at path is re-pointed to from the beginning.
+func (w *Watchdog) monitorLog(ctx context.Context, path string, start tailStart, lines chan<- logLine) {
+	if start.rotated != "" && !w.readRotated(ctx, path, start, lines) {
+		return
+	}
+
+	from := start.from
+	for w.tailLog(ctx, path, from, lines) {
+		from = nil
+	}
+}
+
+// tailLog follows the log at path from with tail until ctx is done, and reports whether it has to be followed again
+// since it's a symlink re-pointed to another file.
+func (w *Watchdog) tailLog(ctx context.Context, path string, from *tail.SeekInfo, lines chan<- logLine) bool {
+	// the file a symlink points to is followed instead,
+	// since tail watches a file by its name, whose watch of the stopped one may be still going away
+	name := path
+	target, _ := filepath.EvalSymlinks(path)
+	if target != "" {
+		name = target
+	}
+
+	// get the Tail struct for monitoring the log,
+	// which reopens the log when it's truncated or moved by the rotation,
+	// and polls it when inotify can't tell the changes
+	cfg := tail.Config{Follow: true, ReOpen: true, Poll: w.config().TailPoll > 0, MaxLineSize: w.config().MaxLineSize, Logger: log.New(tailWriter{w.log}, "", 0), Location: from}
+	t, err := tail.TailFile(name, cfg)
+	if err != nil {
+		w.stop(fmt.Errorf("kelthuzad: monitorLog tail: %w", err))
+		return false
+	}
+	// Cleanup isn't called since tail removes the watch by itself,
+	// and removing it twice would break watching the same file again
+	defer t.Stop()
+
+	if w.config().TailPoll > 0 {
+		w.log.logf("SYSTEM", record{Level: "info", Event: "monitor"}, "monitoring %v by polling every %vms...", path, w.config().TailPoll)
+	} else {
+		w.log.logf("SYSTEM", record{Level: "info", Event: "monitor"}, "monitoring %v...", path)
+	}
+
+	// the offset goes back when the log is reopened, which may be another file
+	id := identifyPath(path)
+	last := int64(-1)
+
+	links := time.NewTicker(linkInterval)
+	defer links.Stop()
+
+	// monitor the log
+	for {
+		select {
+		case line, ok := <-t.Lines:
+			// the tail died, so nothing would be detected anymore
+			if !ok {
+				err := t.Err()
+				if err == nil {
+					err = errors.New("the log is no longer followed")
+				}
+				w.stop(fmt.Errorf("kelthuzad: monitorLog tail %v: %w", path, err))
+				return false
+			}
+
+			// the head isn't all there yet while the log is short
+			if canIdentify && (line.SeekInfo.Offset < last || id.HeadSize < headSize && int64(id.HeadSize) < line.SeekInfo.Offset) {
+				id = identifyPath(path)
+			}
+			last = line.SeekInfo.Offset
+
+			select {
+			case lines <- logLine{path: path, text: line.Text, next: checkpoint{fileID: id, Offset: last}}:
+			case <-ctx.Done():
+				return false
+			}
+		case <-links.C:
+			next, err := filepath.EvalSymlinks(path)
+			if err != nil || next == target {
+				continue
+			}
+
+			// the log which didn't exist has been read by tail since it appeared
+			if target == "" {
+				target = next
+				continue
+			}
+			w.log.logf("SYSTEM", record{Level: "info", Event: "monitor"}, "%v is re-pointed to %v, following it from the beginning", path, next)
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// tailStart is where to start following a log: the rest of the file it's rotated to from the checkpoint first if any,
+// and then the log at from, or the beginning if it's nil.
+type tailStart struct {
+	rotated string
+	at      checkpoint
+	from    *tail.SeekInfo
+}
+
+// tailFrom returns where to start reading the log at path, whose info is nil if it doesn't exist.
+// It resumes at the checkpoint saved: in the same file unless it got shorter than that, or in the file it's rotated to
+// before the new one from the beginning. Otherwise only the log which is there from the start starts at TailFrom,
+// since the others are new and would miss the first lines.
+func (w *Watchdog) tailFrom(path string, info os.FileInfo, start bool, saved *offsets) tailStart {
+	if c, ok := saved.get(path); ok {
+		switch {
+		case c.fileID != (fileID{}) && !c.fileID.is(path):
+			rotated := findRotated(path, c.fileID)
+			if rotated == "" {
+				w.log.logf("SYSTEM", record{Level: "warn", Event: "monitor"}, "%v was replaced and the one read is gone, reading it from the beginning", path)
+				return tailStart{}
+			}
+			w.log.logf("SYSTEM", record{Level: "info", Event: "monitor"}, "resuming %v rotated to %v at the offset %v", path, rotated, c.Offset)
+			return tailStart{rotated: rotated, at: c}
+		case info == nil:
+			return tailStart{}
+		case info.Size() < c.Offset:
+			w.log.logf("SYSTEM", record{Level: "warn", Event: "monitor"}, "%v is shorter than the offset %v saved, reading it from the beginning", path, c.Offset)
+			return tailStart{}
+		}
+		w.log.logf("SYSTEM", record{Level: "info", Event: "monitor"}, "resuming %v at the offset %v", path, c.Offset)
+		return tailStart{from: &tail.SeekInfo{Offset: c.Offset, Whence: io.SeekStart}}
+	}
+	if !start || info == nil {
+		return tailStart{}
+	}
+
+	kind, n, _ := parseTailFrom(w.config().TailFrom)
+	switch kind {
+	case "start":
+		return tailStart{}
+	case "offset":
+		return tailStart{from: &tail.SeekInfo{Offset: n, Whence: io.SeekStart}}
+	case "lines":
+		offset, err := lastLines(path, n)
+		if err != nil {
+			w.log.logf("SYSTEM", record{Level: "warn", Event: "monitor"}, "finding the last lines of %v %v, reading it from the end", path, err)
+			break
+		}
+		return tailStart{from: &tail.SeekInfo{Offset: offset, Whence: io.SeekStart}}
+	}
+	return tailStart{from: &tail.SeekInfo{Offset: 0, Whence: io.SeekEnd}}
+}
+
+// readRotated sends the rest of the log at path, which is rotated to start.rotated, from the checkpoint,
+// and reports whether ctx isn't done.
+func (w *Watchdog) readRotated(ctx context.Context, path string, start tailStart, lines chan<- logLine) bool {
+	f, err := os.Open(start.rotated)
+	if err == nil {
+		_, err = f.Seek(start.at.Offset, io.SeekStart)
+		defer f.Close()
+	}
+	if err != nil {
+		w.log.logf("SYSTEM", record{Level: "warn", Event: "monitor"}, "reading the rest of %v %v", start.rotated, err)
+		return true
+	}
+
+	reader := newLineReader(f, w.config().MaxLineSize)
+	for {
+		line, truncated, err := reader.next()
+		if err != nil {
+			return true
+		}
+		if truncated {
+			w.log.logf("SYSTEM", record{Level: "warn", Event: "truncate"}, "a line over %v bytes is truncated", w.config().MaxLineSize)
+		}
+
+		next := checkpoint{fileID: start.at.fileID, Offset: start.at.Offset + reader.read}
+		select {
+		case lines <- logLine{path: path, text: line, next: next}:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// parseTailFrom splits spec of TailFrom into its kind and number.
+func parseTailFrom(spec string) (string, int64, error) {
+	switch spec {
+	case "", "end":
+		return "end", 0, nil
+	case "start":
+		return "start", 0, nil
+	}
+
+	kind, arg, _ := strings.Cut(spec, ":")
+	if kind != "offset" && kind != "lines" {
+		return "", 0, fmt.Errorf("%v must be end, start, offset:BYTES or lines:N", spec)
+	}
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n < 0 {
+		return "", 0, fmt.Errorf("%v must have a number which isn't negative", spec)
+	}
+	return kind, n, nil
+}
+
+// lastLinesChunk is how many bytes lastLines reads backward at once.
+const lastLinesChunk = 64 * 1024
+
+// lastLines returns the offset of the last n lines of the file at path, reading it backward from the end.
+// The last line doesn't need to end yet.
+func lastLines(path string, n int64) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return info.Size(), nil
+	}
+
+	// the newline ending the file doesn't start another line
+	end := info.Size()
+	if end > 0 {
+		last := make([]byte, 1)
+		_, err = f.ReadAt(last, end-1)
+		if err != nil {
+			return 0, err
+		}
+		if last[0] == '\n' {
+			end--
+		}
+	}
+
+	buf := make([]byte, lastLinesChunk)
+	for pos := end; pos > 0; {
+		size := int64(len(buf))
+		if pos < size {
+			size = pos
+		}
+		pos -= size
+		_, err = f.ReadAt(buf[:size], pos)
+		if err != nil {
+			return 0, err
+		}
+		for i := size - 1; i >= 0; i-- {
+			if buf[i] != '\n' {
+				continue
+			}
+			n--
+			if n == 0 {
+				return pos + i + 1, nil
+			}
+		}
+	}
+	// it has fewer lines than n
+	return 0, nil
+}
+
+// monitorFifo reads the named pipe at path and sends its lines until ctx is done.
+// The pipe is opened for writing as well, so it doesn't end while no writer has it open,
+// and it's opened again when it's replaced by another one.
+func (w *Watchdog) monitorFifo(ctx context.Context, path string, lines chan<- logLine) {
+	w.log.logf("SYSTEM", record{Level: "info", Event: "monitor"}, "monitoring the pipe %v...", path)
+	for {
+		err := w.readFifo(ctx, path, lines)
+		if ctx.Err() != nil {
+			return
+		}
+
+		w.log.logf("SYSTEM", record{Level: "warn", Event: "monitor"}, "pipe %v %v, opening again in %v...", path, err, fifoRetry)
+		if !sleep(ctx, fifoRetry) {
+			return
+		}
+	}
+}
+
+// readFifo sends the lines of the named pipe at path until it's replaced or ctx is done.
+func (w *Watchdog) readFifo(ctx context.Context, path string, lines chan<- logLine) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	opened, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// closing the pipe is what ends reading it
+	replaced := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(globInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if info, err := os.Stat(path); err != nil || !os.SameFile(opened, info) {
+					close(replaced)
+					f.Close()
+					return
+				}
+			case <-ctx.Done():
+				f.Close()
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	reader := newLineReader(f, w.config().MaxLineSize)
+	for {
+		line, truncated, err := reader.next()
+		if err != nil {
+			select {
+			case <-replaced:
+				return errors.New("is replaced")
+			default:
+				return err
+			}
+		}
+		if truncated {
+			w.log.logf("SYSTEM", record{Level: "warn", Event: "truncate"}, "a line over %v bytes is truncated", w.config().MaxLineSize)
+		}
+
+		select {
+		case lines <- logLine{path: path, text: line, next: checkpoint{Offset: -1}}:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// tailWriter writes the logs of the tail, such as reopening the rotated log, as the logs of the watchdog.
+type tailWriter struct {
+	log *logger
+}
+
+func (tw tailWriter) Write(p []byte) (int, error) {
+	tw.log.logf("SYSTEM", record{Level: "info", Event: "tail"}, "%s", strings.TrimSpace(string(p)))
+	return len(p), nil
+}
@@ -0,0 +1,402 @@
+package kelthuzad
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// event describes what happened to the process, which is the same for every sink.
+type event struct {
+	Type      string            `json:"type"`
+	Service   string            `json:"service,omitempty"`
+	Host      string            `json:"host,omitempty"`
+	Cause     string            `json:"cause,omitempty"`
+	Line      string            `json:"line,omitempty"`
+	Pattern   string            `json:"pattern,omitempty"`
+	Captures  map[string]string `json:"captures,omitempty"`
+	Context   []string          `json:"context,omitempty"`
+	Pid       int               `json:"pid"`
+	Pod       string            `json:"pod,omitempty"`
+	Restarts  int               `json:"restarts"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+// eventTypes are the types of the events.
+var eventTypes = map[string]bool{"spawn": true, "ready": true, "match": true, "fail": true, "kill": true, "respawn": true, "give-up": true, "breaker-open": true}
+
+// sender sends an event somewhere.
+type sender interface {
+	// send sends e, and returns why it couldn't
+	send(e event) error
+	// String describes where it's sent
+	String() string
+}
+
+// target is a sender of some types of the events, which is rate limited.
+// An inline one is local and quick, and is sent to in place to keep the order of the events.
+type target struct {
+	sender
+	events  map[string]bool
+	limiter *limiter
+	inline  bool
+}
+
+// notifier is the bus sending the events to the sinks, the webhooks, Slack and email.
+type notifier struct {
+	log     *logger
+	targets []*target
+	metrics *metrics
+	pending sync.WaitGroup
+}
+
+// newNotifier returns the notifier configured by cfg, which logs to log, counts to m if the metrics are a sink,
+// and broadcasts to h unless it's nil.
+func newNotifier(cfg *Config, log *logger, m *metrics, h *hub) (*notifier, error) {
+	n := &notifier{log: log}
+	client := &http.Client{Timeout: 10 * time.Second}
+	limit := func() *limiter {
+		return &limiter{limit: cfg.NotifyLimit, window: time.Duration(cfg.NotifyWindow) * time.Second}
+	}
+
+	// the templates replace what's sent to the webhooks, Slack and email
+	templates := make(map[string]*template.Template)
+	for name, text := range map[string]string{"WebhookTemplate": cfg.WebhookTemplate, "SlackTemplate": cfg.SlackTemplate, "EmailSubject": cfg.EmailSubject, "EmailTemplate": cfg.EmailTemplate} {
+		t, err := parseTemplate(name, text)
+		if err != nil {
+			return nil, err
+		}
+		templates[name] = t
+	}
+
+	for _, url := range cfg.Webhooks {
+		n.targets = append(n.targets, &target{sender: &webhook{url: url, client: client, body: templates["WebhookTemplate"]}, events: eventSet(cfg.WebhookEvents), limiter: limit()})
+	}
+	for _, url := range cfg.Slack {
+		n.targets = append(n.targets, &target{sender: &slack{url: url, client: client, text: templates["SlackTemplate"]}, events: eventSet(cfg.SlackEvents), limiter: limit()})
+	}
+
+	if len(cfg.EmailTo) > 0 {
+		if cfg.SMTPAddr == "" || cfg.EmailFrom == "" {
+			return nil, errors.New("kelthuzad: EmailTo needs SMTPAddr and EmailFrom")
+		}
+		host, _, err := net.SplitHostPort(cfg.SMTPAddr)
+		if err != nil {
+			return nil, fmt.Errorf("kelthuzad: SMTPAddr: %w", err)
+		}
+
+		m := &mail{addr: cfg.SMTPAddr, from: cfg.EmailFrom, to: cfg.EmailTo, subject: templates["EmailSubject"], body: templates["EmailTemplate"]}
+		if cfg.SMTPUser != "" {
+			m.auth = smtp.PlainAuth("", cfg.SMTPUser, cfg.SMTPPassword, host)
+		}
+		n.targets = append(n.targets, &target{sender: m, events: eventSet(cfg.EmailEvents), limiter: limit()})
+	}
+
+	// the sinks get every event without the rate limit
+	for _, spec := range cfg.EventSinks {
+		kind, arg, err := parseEventSink(spec)
+		if err != nil {
+			return nil, fmt.Errorf("kelthuzad: EventSinks: %w", err)
+		}
+
+		t := &target{limiter: &limiter{}}
+		switch kind {
+		case "stdout":
+			t.sender, t.inline = stdout{}, true
+		case "file":
+			t.sender, t.inline = &file{path: arg}, true
+		case "metrics":
+			t.sender, t.inline = m, true
+			n.metrics = m
+		case "exec":
+			t.sender = &script{command: arg, timeout: time.Duration(cfg.HookTimeout) * time.Second}
+		case "webhook":
+			t.sender = &webhook{url: arg, client: client}
+		case "kafka", "nats":
+			t.sender, err = publisher(kind, arg)
+			if err != nil {
+				return nil, fmt.Errorf("kelthuzad: EventSinks: %w", err)
+			}
+		}
+		n.targets = append(n.targets, t)
+	}
+	if h != nil {
+		n.targets = append(n.targets, &target{sender: h, limiter: &limiter{}, inline: true})
+	}
+
+	return n, nil
+}
+
+// eventSet returns the set of types, or nil which means every type.
+func eventSet(types []string) map[string]bool {
+	if len(types) == 0 {
+		return nil
+	}
+
+	set := make(map[string]bool)
+	for _, typ := range types {
+		set[typ] = true
+	}
+	return set
+}
+
+// notify sends e to every target but the inline ones in the background, so a slow target never delays respawning.
+// The events over the rate limit of a target are dropped, not to flood it while the process is flapping.
+func (n *notifier) notify(e event) {
+	for _, t := range n.targets {
+		if t.events != nil && !t.events[e.Type] {
+			continue
+		}
+		if !t.limiter.allow() {
+			n.log.logf("NOTIFY", record{Level: "warn", Event: "notify"}, "%v is over the rate limit, dropping %v", t, e.Type)
+			continue
+		}
+
+		n.pending.Add(1)
+		if t.inline {
+			n.send(t, e)
+			continue
+		}
+		go n.send(t, e)
+	}
+}
+
+// wait waits for every pending send, which is necessary before exiting.
+func (n *notifier) wait() {
+	n.pending.Wait()
+}
+
+// send sends e to t and logs when it fails.
+func (n *notifier) send(t *target, e event) {
+	defer n.pending.Done()
+
+	err := t.send(e)
+	if err != nil {
+		n.log.logf("NOTIFY", record{Level: "warn", Event: "notify"}, "%v %v", t, err)
+	}
+}
+
+// limiter allows up to limit within the sliding window, or any when limit is 0.
+type limiter struct {
+	limit  int
+	window time.Duration
+	mu     sync.Mutex
+	sent   []time.Time
+}
+
+// allow reports whether another one is allowed now, and counts it if so.
+func (l *limiter) allow() bool {
+	if l.limit <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for len(l.sent) > 0 && time.Since(l.sent[0]) > l.window {
+		l.sent = l.sent[1:]
+	}
+	if len(l.sent) >= l.limit {
+		return false
+	}
+	l.sent = append(l.sent, time.Now())
+	return true
+}
+
+// webhook posts an event as JSON, or the body rendered by the template unless it's nil.
+type webhook struct {
+	url    string
+	client *http.Client
+	body   *template.Template
+}
+
+func (h *webhook) send(e event) error {
+	if h.body != nil {
+		body, err := render(h.body, e)
+		if err != nil {
+			return err
+		}
+		return post(h.client, h.url, []byte(body))
+	}
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return post(h.client, h.url, body)
+}
+
+func (h *webhook) String() string {
+	return h.url
+}
+
+// slack posts an event to an incoming webhook of Slack as an attachment, whose text is rendered by the template unless it's nil.
+type slack struct {
+	url    string
+	client *http.Client
+	text   *template.Template
+}
+
+func (s *slack) send(e event) error {
+	text := slackText(e)
+	if s.text != nil {
+		var err error
+		text, err = render(s.text, e)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the failures are red, the respawns are green and the others are yellow
+	color := "warning"
+	switch e.Type {
+	case "fail", "give-up", "breaker-open":
+		color = "danger"
+	case "respawn":
+		color = "good"
+	}
+
+	fields := []map[string]interface{}{
+		{"title": "Pid", "value": e.Pid, "short": true},
+		{"title": "Restarts", "value": e.Restarts, "short": true},
+	}
+	if e.Cause != "" {
+		fields = append(fields, map[string]interface{}{"title": "Cause", "value": e.Cause, "short": true})
+	}
+	if e.Pattern != "" {
+		fields = append(fields, map[string]interface{}{"title": "Pattern", "value": e.Pattern, "short": true})
+	}
+	for _, name := range captureNames(e.Captures) {
+		fields = append(fields, map[string]interface{}{"title": name, "value": e.Captures[name], "short": true})
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"attachments": []map[string]interface{}{{
+			"fallback": subject(e),
+			"color":    color,
+			"title":    subject(e),
+			"text":     text,
+			"fields":   fields,
+			"ts":       e.Timestamp.Unix(),
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	return post(s.client, s.url, body)
+}
+
+func (s *slack) String() string {
+	return "slack"
+}
+
+// slackText returns the line of e followed by its context as a code block.
+func slackText(e event) string {
+	if len(e.Context) == 0 {
+		return e.Line
+	}
+	return e.Line + "\n```\n" + strings.Join(e.Context, "\n") + "\n```"
+}
+
+// mail sends an event by email via SMTP, whose subject and body are rendered by the templates unless they're nil.
+type mail struct {
+	addr    string
+	auth    smtp.Auth
+	from    string
+	to      []string
+	subject *template.Template
+	body    *template.Template
+}
+
+func (m *mail) send(e event) error {
+	title := subject(e)
+	if m.subject != nil {
+		var err error
+		title, err = render(m.subject, e)
+		if err != nil {
+			return err
+		}
+		// a line break would end the header
+		title = strings.Join(strings.Fields(title), " ")
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %v\r\n", m.from)
+	fmt.Fprintf(&msg, "To: %v\r\n", strings.Join(m.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %v\r\n", title)
+	fmt.Fprintf(&msg, "Date: %v\r\n", e.Timestamp.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	if m.body != nil {
+		body, err := render(m.body, e)
+		if err != nil {
+			return err
+		}
+		body = strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n")
+		fmt.Fprintf(&msg, "%v\r\n", body)
+		return smtp.SendMail(m.addr, m.auth, m.from, m.to, []byte(msg.String()))
+	}
+
+	fmt.Fprintf(&msg, "Type: %v\r\nPid: %v\r\nRestarts: %v\r\n", e.Type, e.Pid, e.Restarts)
+	if e.Cause != "" {
+		fmt.Fprintf(&msg, "Cause: %v\r\n", e.Cause)
+	}
+	if e.Pattern != "" {
+		fmt.Fprintf(&msg, "Pattern: %v\r\n", e.Pattern)
+	}
+	for _, name := range captureNames(e.Captures) {
+		fmt.Fprintf(&msg, "%v: %v\r\n", name, e.Captures[name])
+	}
+	if e.Line != "" {
+		fmt.Fprintf(&msg, "\r\n%v\r\n", strings.ReplaceAll(e.Line, "\n", "\r\n"))
+	}
+	if len(e.Context) > 0 {
+		fmt.Fprintf(&msg, "\r\nThe last lines:\r\n%v\r\n", strings.Join(e.Context, "\r\n"))
+	}
+
+	return smtp.SendMail(m.addr, m.auth, m.from, m.to, []byte(msg.String()))
+}
+
+func (m *mail) String() string {
+	return "mail to " + strings.Join(m.to, ", ")
+}
+
+// captureNames returns the names of captures in order, so they're always listed the same way.
+func captureNames(captures map[string]string) []string {
+	var names []string
+	for name := range captures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// subject summarizes e in a line.
+func subject(e event) string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("[kelthuzad] %v of %v on %v", e.Type, e.Pid, host)
+}
+
+// post posts body as JSON to url, and returns an error unless it succeeds.
+func post(client *http.Client, url string, body []byte) error {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("responded %v", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package kelthuzad
+
+import (
+	"fmt"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sink keeps the output of the process in a file, which is rotated by its size and age.
+type sink struct {
+	file     *lumberjack.Logger
+	maxAge   time.Duration
+	openedAt time.Time
+}
+
+// newSink returns the sink configured by cfg, or nil when OutputPath isn't given.
+func newSink(cfg *Config) *sink {
+	if cfg.OutputPath == "" {
+		return nil
+	}
+
+	return &sink{
+		file: &lumberjack.Logger{
+			Filename:   cfg.OutputPath,
+			MaxSize:    cfg.OutputMaxSize,
+			MaxBackups: cfg.OutputMaxBackups,
+			Compress:   cfg.OutputCompress,
+		},
+		maxAge:   time.Duration(cfg.OutputMaxAge) * time.Second,
+		openedAt: time.Now(),
+	}
+}
+
+// write appends line to the file, after rotating it if it's older than the max age.
+func (s *sink) write(line string) error {
+	if s.maxAge > 0 && time.Since(s.openedAt) >= s.maxAge {
+		s.openedAt = time.Now()
+		err := s.file.Rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := s.file.Write([]byte(line + "\n"))
+	return err
+}
+
+// close closes the file.
+func (s *sink) close() error {
+	return s.file.Close()
+}
+
+// output is the reading end of a stream of the process to monitor.
+type output struct {
+	file   *os.File
+	stream string
+}
+
+// processName returns the name of the process of cfg running argv, which is the base name of the command unless it's given.
+func processName(cfg *Config, argv []string) string {
+	if cfg.Name != "" {
+		return cfg.Name
+	}
+
+	command := cfg.RawCommand
+	if cfg.Shell || len(argv) == 0 {
+		if cfg.Shell {
+			command = cfg.CmdPath
+		}
+		if fields := strings.Fields(command); len(fields) > 0 {
+			return filepath.Base(fields[0])
+		}
+		return "kelthuzad"
+	}
+	return filepath.Base(argv[0])
+}
+
+// passthrough prints line of stream to stdout prefixed by the time, the name of the process and stream, like docker-compose does.
+func (w *Watchdog) passthrough(stream string, line string) {
+	stdoutMu.Lock()
+	defer stdoutMu.Unlock()
+
+	fmt.Fprintf(os.Stdout, "%v %v %v | %v\n", time.Now().Format("2006-01-02T15:04:05.000Z07:00"), w.name, stream, line)
+}
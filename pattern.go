@@ -0,0 +1,177 @@
+package kelthuzad
+
+import (
+	"regexp"
+	"strings"
+)
+
+// matcher is a compiled pattern of the lines, which is a regexp of RE2 or PCRE, or a fixed string.
+type matcher interface {
+	MatchString(text string) bool
+	// FindStringSubmatch returns the match and the groups of the leftmost match in text, or nil if none
+	FindStringSubmatch(text string) []string
+	// SubexpNames returns the names of the groups, which are empty for the unnamed ones and the match itself
+	SubexpNames() []string
+	String() string
+}
+
+// compile compiles pattern by the flavor, the case sensitivity and whether it's a fixed string as cfg tells.
+func compile(cfg *Config, pattern string) (matcher, error) {
+	switch {
+	case cfg.FixedString:
+		return newFixed(pattern, cfg.IgnoreCase), nil
+	case cfg.RegexFlavor == "pcre":
+		return compilePCRE(pattern, cfg.IgnoreCase)
+	case cfg.IgnoreCase:
+		return regexp.Compile("(?i)" + pattern)
+	}
+	return regexp.Compile(pattern)
+}
+
+// fixed matches the lines containing s, which is much faster than a regexp.
+type fixed struct {
+	s    string
+	fold bool
+	// lower is s in lower case to be found in the lines in lower case, if fold
+	lower string
+}
+
+// newFixed returns the fixed string matcher of s, which ignores the case if fold.
+func newFixed(s string, fold bool) *fixed {
+	return &fixed{s: s, fold: fold, lower: strings.ToLower(s)}
+}
+
+func (f *fixed) MatchString(text string) bool {
+	if f.fold {
+		return strings.Contains(strings.ToLower(text), f.lower)
+	}
+	return strings.Contains(text, f.s)
+}
+
+func (f *fixed) FindStringSubmatch(text string) []string {
+	if !f.fold {
+		if strings.Contains(text, f.s) {
+			return []string{f.s}
+		}
+		return nil
+	}
+
+	lower := strings.ToLower(text)
+	i := strings.Index(lower, f.lower)
+	if i < 0 {
+		return nil
+	}
+	// the lower case of a few runes is of another length, whose match can't be sliced out of text
+	if len(lower) != len(text) {
+		return []string{f.s}
+	}
+	return []string{text[i : i+len(f.s)]}
+}
+
+func (f *fixed) SubexpNames() []string {
+	return []string{""}
+}
+
+func (f *fixed) String() string {
+	return f.s
+}
+
+// patternSet matches a line with many patterns faster than one by one.
+// The literal prefixes of them are searched at once, which no line can match without,
+// and the regexps of RE2 without any are combined into an alternation, which no line can match unless it does.
+type patternSet struct {
+	patterns []string
+	matchers []matcher
+	// prefixes are what a match of each pattern starts with, which are empty if unknown
+	prefixes []string
+	// complete tells whether a prefix is the whole of its pattern, which is a fixed string matching once it's found
+	complete []bool
+	literals *literals
+	// fold tells whether the prefixes are in lower case to be found in the lines in lower case
+	fold bool
+	rest matcher
+}
+
+// compileSet compiles every pattern of patterns as cfg tells, and returns nil without any.
+func compileSet(cfg *Config, patterns []string) (*patternSet, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+
+	s := &patternSet{patterns: patterns, fold: cfg.FixedString && cfg.IgnoreCase}
+	var alternation []string
+	for _, pattern := range patterns {
+		m, err := compile(cfg, pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		var prefix string
+		var complete bool
+		switch re := m.(type) {
+		case *fixed:
+			prefix, complete = re.s, true
+			if re.fold {
+				prefix = re.lower
+			}
+		case *regexp.Regexp:
+			// the completeness of the prefix isn't trusted, which is true of such as ^B$ as well
+			prefix, _ = re.LiteralPrefix()
+			if prefix == "" {
+				alternation = append(alternation, "(?:"+re.String()+")")
+			}
+		}
+		s.matchers = append(s.matchers, m)
+		s.prefixes = append(s.prefixes, prefix)
+		s.complete = append(s.complete, complete)
+	}
+
+	for _, prefix := range s.prefixes {
+		if prefix != "" {
+			s.literals = newLiterals(s.prefixes)
+			break
+		}
+	}
+	// one alternation is no faster than one pattern
+	if len(alternation) > 1 {
+		rest, err := regexp.Compile(strings.Join(alternation, "|"))
+		if err == nil {
+			s.rest = rest
+		}
+	}
+
+	return s, nil
+}
+
+// match returns the index of the first pattern matching text, or -1 if none does.
+func (s *patternSet) match(text string) int {
+	if s == nil {
+		return -1
+	}
+
+	var found []bool
+	if s.literals != nil {
+		scanned := text
+		if s.fold {
+			scanned = strings.ToLower(text)
+		}
+		found = s.literals.scan(scanned)
+	}
+	restOut := s.rest != nil && !s.rest.MatchString(text)
+
+	for i, m := range s.matchers {
+		switch {
+		case s.prefixes[i] != "" && !found[i]:
+			continue
+		case s.prefixes[i] == "" && restOut:
+			continue
+		case s.complete[i]:
+			return i
+		}
+		if m.MatchString(text) {
+			return i
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,84 @@
+//go:build pcre
+
+package kelthuzad
+
+import (
+	"github.com/dlclark/regexp2"
+	"strconv"
+	"time"
+)
+
+// pcreBuilt tells whether the pcre flavor is built in.
+const pcreBuilt = true
+
+// pcreTimeout bounds a match, since a backtracking one can take forever by a bad pattern.
+const pcreTimeout = time.Second
+
+// pcre is a regexp of the syntax compatible with Perl, which supports such as the lookarounds and the backreferences.
+// A match over pcreTimeout doesn't match.
+type pcre struct {
+	re      *regexp2.Regexp
+	numbers []int
+}
+
+// compilePCRE compiles pattern of PCRE, which ignores the case if ignoreCase.
+func compilePCRE(pattern string, ignoreCase bool) (matcher, error) {
+	var opts regexp2.RegexOptions
+	if ignoreCase {
+		opts |= regexp2.IgnoreCase
+	}
+	re, err := regexp2.Compile(pattern, opts)
+	if err != nil {
+		return nil, err
+	}
+	re.MatchTimeout = pcreTimeout
+
+	return &pcre{re: re, numbers: re.GetGroupNumbers()}, nil
+}
+
+func (p *pcre) MatchString(text string) bool {
+	ok, err := p.re.MatchString(text)
+	return err == nil && ok
+}
+
+func (p *pcre) FindStringSubmatch(text string) []string {
+	m, err := p.re.FindStringMatch(text)
+	if err != nil || m == nil {
+		return nil
+	}
+
+	res := make([]string, p.size())
+	for _, n := range p.numbers {
+		if g := m.GroupByNumber(n); g != nil {
+			res[n] = g.String()
+		}
+	}
+	return res
+}
+
+func (p *pcre) SubexpNames() []string {
+	names := make([]string, p.size())
+	for _, n := range p.numbers {
+		// the unnamed groups are named by their numbers
+		name := p.re.GroupNameFromNumber(n)
+		if name != strconv.Itoa(n) {
+			names[n] = name
+		}
+	}
+	return names
+}
+
+func (p *pcre) String() string {
+	return p.re.String()
+}
+
+// size returns the length of the groups including the match, which are numbered sparsely if explicitly.
+func (p *pcre) size() int {
+	size := 0
+	for _, n := range p.numbers {
+		if n+1 > size {
+			size = n + 1
+		}
+	}
+	return size
+}
@@ -0,0 +1,15 @@
+//go:build !pcre
+
+package kelthuzad
+
+import (
+	"errors"
+)
+
+// pcreBuilt tells whether the pcre flavor is built in.
+const pcreBuilt = false
+
+// compilePCRE fails, since the pcre flavor isn't built in without the pcre tag.
+func compilePCRE(string, bool) (matcher, error) {
+	return nil, errors.New("kelthuzad: the pcre flavor needs kelthuzad built with -tags pcre")
+}
@@ -0,0 +1,71 @@
+package kelthuzad
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// writePidFile writes pid to path through a temporary file, so it's never seen half written.
+func writePidFile(path string, pid int) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.WriteString(strconv.Itoa(pid) + "\n")
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+// removePidFile removes path unless it has other than pid, which someone else has written since.
+func removePidFile(path string, pid int) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if string(bytes.TrimSpace(data)) != strconv.Itoa(pid) {
+		return nil
+	}
+
+	return os.Remove(path)
+}
+
+// writeChildPid writes pid of the process to ChildPidFile if it's given.
+func (w *Watchdog) writeChildPid(pid int) {
+	if w.config().ChildPidFile == "" {
+		return
+	}
+
+	err := writePidFile(w.config().ChildPidFile, pid)
+	if err != nil {
+		w.log.logf("SYSTEM", record{Level: "warn", Event: "error", Pid: pid}, "writePidFile %v", err)
+	}
+}
+
+// removeChildPid removes ChildPidFile once the process of pid is gone.
+func (w *Watchdog) removeChildPid(pid int) {
+	if w.config().ChildPidFile == "" {
+		return
+	}
+
+	err := removePidFile(w.config().ChildPidFile, pid)
+	if err != nil {
+		w.log.logf("SYSTEM", record{Level: "warn", Event: "error", Pid: pid}, "removePidFile %v", err)
+	}
+}
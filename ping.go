@@ -0,0 +1,117 @@
+package kelthuzad
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// pingData is what the ping line can refer to, such as {{.Token}}.
+type pingData struct {
+	// Token is what must be echoed, which is unique for every ping
+	Token string
+}
+
+// parsePing parses the template of the ping line, which is nil when the pings are disabled.
+func parsePing(cfg *Config) (*template.Template, error) {
+	if cfg.PingInterval == 0 {
+		return nil, nil
+	}
+
+	t, err := template.New("ping").Parse(cfg.PingLine)
+	if err != nil {
+		return nil, fmt.Errorf("kelthuzad: PingLine: %w", err)
+	}
+	// catch a reference to what doesn't exist before spawning
+	var line strings.Builder
+	err = t.Execute(&line, pingData{Token: "kelthuzad-ping"})
+	if err != nil {
+		return nil, fmt.Errorf("kelthuzad: PingLine: %w", err)
+	}
+	if !strings.Contains(line.String(), "kelthuzad-ping") {
+		return nil, fmt.Errorf("kelthuzad: PingLine %v doesn't refer to {{.Token}}", cfg.PingLine)
+	}
+	return t, nil
+}
+
+// ping writes the ping line to the stdin of the process every ping interval until ctx is done,
+// and fails the process once it doesn't echo the token within the ping timeout in a row too often.
+func (w *Watchdog) ping(ctx context.Context) {
+	if w.pingLine == nil {
+		return
+	}
+
+	var misses, gen, n int
+	for sleep(ctx, time.Duration(w.config().PingInterval)*time.Second) {
+		// the process is being replaced, not ready yet or the detection is paused, so nothing is there to ping
+		cur := w.current()
+		if cur == nil || cur.stdin == nil || w.isPaused() || !w.isReady() {
+			continue
+		}
+		if cur.gen != gen {
+			gen = cur.gen
+			misses = 0
+		}
+
+		n++
+		token := fmt.Sprintf("kelthuzad-ping-%v", n)
+		var line strings.Builder
+		w.pingLine.Execute(&line, pingData{Token: token})
+		echo := w.expectEcho(token)
+
+		// a wedged process doesn't read its stdin either, which mustn't block the pings forever
+		timeout := time.Duration(w.config().PingTimeout) * time.Second
+		cur.stdin.SetWriteDeadline(time.Now().Add(timeout))
+		_, err := cur.stdin.WriteString(line.String() + "\n")
+		if err == nil {
+			select {
+			case <-echo:
+				misses = 0
+				continue
+			case <-time.After(timeout):
+				err = fmt.Errorf("didn't echo %v in %v", token, timeout)
+			case <-cur.done:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		w.expectEcho("")
+		if isClosed(cur.done) {
+			continue
+		}
+
+		misses++
+		w.log.logf("PROBE", record{Level: "warn", Event: "probe", Pid: cur.pid}, "ping %v (%v/%v)", err, misses, w.config().PingMisses)
+		if misses >= w.config().PingMisses {
+			w.failLater(cur, "probe-failure", fmt.Sprintf("missed %v pings: %v", misses, err), "ping", nil)
+			misses = 0
+		}
+	}
+}
+
+// expectEcho waits for token to be echoed, and returns the channel closed once it is.
+// The empty token stops waiting.
+func (w *Watchdog) expectEcho(token string) <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pingToken = token
+	w.pingEcho = make(chan struct{})
+	return w.pingEcho
+}
+
+// echoed reports whether line echoes the token of the ping, which is consumed then.
+func (w *Watchdog) echoed(line string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.pingToken == "" || !strings.Contains(line, w.pingToken) {
+		return false
+	}
+	w.pingToken = ""
+	close(w.pingEcho)
+	return true
+}
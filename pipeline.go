@@ -0,0 +1,108 @@
+package kelthuzad
+
+import (
+	"context"
+)
+
+// failure is what the actuator acts on, which is a failure of p by line matching with pattern, classified as cause.
+type failure struct {
+	p        *proc
+	cause    string
+	line     string
+	pattern  string
+	captures map[string]string
+}
+
+// actuate fails the processes found failed one by one until ctx is done, so that neither killing nor the delay of respawning
+// blocks the lines, the probes nor the timers which found them.
+func (w *Watchdog) actuate(ctx context.Context) {
+	for {
+		select {
+		case f := <-w.failures:
+			w.fail(ctx, f.p, f.cause, f.line, f.pattern, f.captures)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// failLater hands the failure of p over to the actuator, unless it's acting on another one already,
+// in which case p is being replaced or already gone.
+func (w *Watchdog) failLater(p *proc, cause string, line string, pattern string, captures map[string]string) {
+	select {
+	case w.failures <- failure{p: p, cause: cause, line: line, pattern: pattern, captures: captures}:
+	default:
+		w.log.logf("MATCH", record{Level: "warn", Event: "match", Pid: p.pid, Line: line, Pattern: pattern, Captures: captures}, "%v -> %v, not failing while respawning", line, pattern)
+	}
+}
+
+// prematched is a line matched ahead by a worker, which is checked in the order it came once done.
+type prematched struct {
+	line string
+	done chan struct{}
+
+	// what it was matched with, which is stale if reloaded since
+	pattern  matcher
+	rule     *jsonRule
+	excludes *patternSet
+
+	excluded int
+	matched  bool
+	captures map[string]string
+}
+
+// matchAhead matches the lines by the workers side by side until ctx is done,
+// and returns them in the order they came, each of which is done once matched.
+func (w *Watchdog) matchAhead(ctx context.Context, lines <-chan string) <-chan *prematched {
+	ordered := make(chan *prematched, w.config().QueueSize)
+	work := make(chan *prematched, w.config().Matchers)
+	for i := 0; i < w.config().Matchers; i++ {
+		go func() {
+			for {
+				select {
+				case m := <-work:
+					w.prematch(m)
+					close(m.done)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		for {
+			select {
+			case line := <-lines:
+				// it's queued in order before any worker can get it, so the head is always being matched
+				m := &prematched{line: line, done: make(chan struct{})}
+				select {
+				case ordered <- m:
+				case <-ctx.Done():
+					return
+				}
+				select {
+				case work <- m:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ordered
+}
+
+// prematch matches m with the current patterns and rule.
+func (w *Watchdog) prematch(m *prematched) {
+	w.mu.Lock()
+	m.pattern, m.rule, m.excludes = w.pattern, w.rule, w.excludes
+	w.mu.Unlock()
+
+	m.excluded = m.excludes.match(m.line)
+	if m.excluded < 0 {
+		m.matched, m.captures = detect(m.pattern, m.rule, m.line, m.line)
+	}
+}
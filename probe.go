@@ -0,0 +1,252 @@
+package kelthuzad
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// prober checks whether the process is healthy from the outside.
+type prober interface {
+	// probe returns the reason why the process is unhealthy, or nil
+	probe(ctx context.Context) error
+	// String describes what is probed
+	String() string
+}
+
+// httpProber requests a URL and expects the status and the body.
+type httpProber struct {
+	url    string
+	status int
+	body   *regexp.Regexp
+	client *http.Client
+}
+
+// probe requests p.url and compares the response with the expected one.
+func (p *httpProber) probe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != p.status {
+		return fmt.Errorf("responded %v instead of %v", resp.Status, p.status)
+	}
+
+	if p.body != nil {
+		// only the head of the body is matched not to be flooded by a huge response
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if err != nil {
+			return err
+		}
+		if !p.body.Match(body) {
+			return fmt.Errorf("responded the body not matching with %v", p.body)
+		}
+	}
+
+	return nil
+}
+
+// String returns the probed URL.
+func (p *httpProber) String() string {
+	return p.url
+}
+
+// tcpProber connects to an address and expects it to accept the connection.
+type tcpProber struct {
+	addr   string
+	dialer *net.Dialer
+}
+
+// probe connects to p.addr and closes the connection right away.
+func (p *tcpProber) probe(ctx context.Context) error {
+	conn, err := p.dialer.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// String returns the probed address.
+func (p *tcpProber) String() string {
+	return "tcp://" + p.addr
+}
+
+// execProber runs a command string and expects it to exit with 0.
+type execProber struct {
+	command string
+	timeout time.Duration
+}
+
+// probe runs p.command, which is killed with what it started if it doesn't finish in p.timeout,
+// and tells the last line of its output if it fails.
+// What it leaves in the background doesn't keep it from finishing, and is killed once it holds the output too long.
+func (p *execProber) probe(ctx context.Context) error {
+	var out bytes.Buffer
+	cmd := shellCommand(p.command)
+	prepare(cmd, nil)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cmd.Env = os.Environ()
+	cmd.WaitDelay = outputDelay
+	err := startOwned(cmd, -1, nil)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		disown(cmd)
+		if errors.Is(err, exec.ErrWaitDelay) {
+			// it exited by itself, leaving what holds the output
+			killGroup(cmd)
+			err = nil
+		}
+		done <- err
+	}()
+
+	select {
+	case err = <-done:
+	case <-time.After(p.timeout):
+		killGroup(cmd)
+		<-done
+		return fmt.Errorf("didn't finish in %v", p.timeout)
+	case <-ctx.Done():
+		killGroup(cmd)
+		<-done
+		return ctx.Err()
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if err != nil && lines[len(lines)-1] != "" {
+		return fmt.Errorf("%w: %v", err, lines[len(lines)-1])
+	}
+	return err
+}
+
+// String returns the command string.
+func (p *execProber) String() string {
+	return "exec:" + p.command
+}
+
+// newProbers returns the probers configured by cfg.
+func newProbers(cfg *Config) ([]prober, error) {
+	var probers []prober
+	timeout := time.Duration(cfg.ProbeTimeout) * time.Second
+
+	if cfg.HTTPProbe != "" {
+		p := &httpProber{
+			url:    cfg.HTTPProbe,
+			status: cfg.ProbeStatus,
+			client: &http.Client{Timeout: timeout},
+		}
+		if cfg.ProbeBody != "" {
+			body, err := regexp.Compile(cfg.ProbeBody)
+			if err != nil {
+				return nil, err
+			}
+			p.body = body
+		}
+		probers = append(probers, p)
+	}
+
+	if cfg.TCPProbe != "" {
+		probers = append(probers, &tcpProber{addr: cfg.TCPProbe, dialer: &net.Dialer{Timeout: timeout}})
+	}
+
+	if cfg.ExecProbe != "" {
+		probers = append(probers, &execProber{command: cfg.ExecProbe, timeout: timeout})
+	}
+
+	return probers, nil
+}
+
+// probe polls every prober until ctx is done and fails the process once a prober fails in a row too often.
+func (w *Watchdog) probe(ctx context.Context) {
+	var failures []int
+	var gen int
+	for sleep(ctx, time.Duration(w.config().ProbeInterval)*time.Second) {
+		// the process is being replaced, not ready yet or the detection is paused, so nothing is there to probe
+		cur := w.current()
+		if cur == nil || w.isPaused() || !w.isReady() {
+			continue
+		}
+
+		// every process gets its own chances, and so do the reloaded probers
+		w.mu.Lock()
+		probers := w.probers
+		w.mu.Unlock()
+		if cur.gen != gen || len(failures) != len(probers) {
+			gen = cur.gen
+			failures = make([]int, len(probers))
+		}
+
+		for i, p := range probers {
+			err := p.probe(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			w.probed(i, p, err, failures[i])
+			if err == nil {
+				failures[i] = 0
+				continue
+			}
+
+			failures[i]++
+			w.log.logf("PROBE", record{Level: "warn", Event: "probe", Pid: cur.pid}, "%v %v (%v/%v)", p, err, failures[i], w.config().ProbeFailures)
+			if failures[i] >= w.config().ProbeFailures {
+				w.failLater(cur, "probe-failure", fmt.Sprintf("probe failed %v times: %v", failures[i], err), p.String(), nil)
+				failures[i] = 0
+				break
+			}
+		}
+	}
+}
+
+// probeResult is the latest result of a prober for the status.
+type probeResult struct {
+	Probe    string    `json:"probe"`
+	Healthy  bool      `json:"healthy"`
+	Failures int       `json:"failures"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// probed keeps the result of the i-th prober p, which has failed failures times in a row before err.
+func (w *Watchdog) probed(i int, p prober, err error, failures int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// the probers have been reloaded meanwhile
+	if len(w.probeRes) != len(w.probers) {
+		w.probeRes = make([]probeResult, len(w.probers))
+	}
+	if i >= len(w.probeRes) {
+		return
+	}
+	r := probeResult{Probe: p.String(), Healthy: err == nil, Time: time.Now()}
+	if err != nil {
+		r.Failures = failures + 1
+		r.Error = err.Error()
+	} else {
+		w.log.debugf("SYSTEM", record{Event: "probe"}, "%v is healthy", p)
+	}
+	w.probeRes[i] = r
+}
@@ -0,0 +1,234 @@
+//go:build !windows
+
+package kelthuzad
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// procGroup is the process group of a spawned process and all of its descendants,
+// and the cgroup holding the descendants which leave the group unless it's nil.
+type procGroup struct {
+	pgid   int
+	cgroup *cgroup
+}
+
+// credential is the user and groups which the process runs as.
+type credential = syscall.Credential
+
+// newCredential looks up the user and group by the names or the ids, and returns nil when neither is given.
+// The groups of the user go along with it, and the group overrides its primary group.
+func newCredential(username string, group string) (*credential, error) {
+	if username == "" && group == "" {
+		return nil, nil
+	}
+
+	cred := &credential{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	if username != "" {
+		u, err := user.Lookup(username)
+		if _, numErr := strconv.Atoi(username); err != nil && numErr == nil {
+			u, err = user.LookupId(username)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("kelthuzad: user %v: %w", username, err)
+		}
+
+		cred.Uid, err = parseID(u.Uid)
+		if err != nil {
+			return nil, err
+		}
+		cred.Gid, err = parseID(u.Gid)
+		if err != nil {
+			return nil, err
+		}
+
+		gids, err := u.GroupIds()
+		if err != nil {
+			return nil, fmt.Errorf("kelthuzad: groups of %v: %w", username, err)
+		}
+		for _, gid := range gids {
+			id, err := parseID(gid)
+			if err != nil {
+				return nil, err
+			}
+			cred.Groups = append(cred.Groups, id)
+		}
+	}
+
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if _, numErr := strconv.Atoi(group); err != nil && numErr == nil {
+			g, err = user.LookupGroupId(group)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("kelthuzad: group %v: %w", group, err)
+		}
+
+		cred.Gid, err = parseID(g.Gid)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return cred, nil
+}
+
+// parseID parses a uid or gid.
+func parseID(id string) (uint32, error) {
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("kelthuzad: id %v: %w", id, err)
+	}
+
+	return uint32(n), nil
+}
+
+// parseUmask parses the octal umask, and returns -1 when it's empty.
+func parseUmask(s string) (int, error) {
+	if s == "" {
+		return -1, nil
+	}
+
+	mask, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mask > 0777 {
+		return 0, fmt.Errorf("kelthuzad: umask %v isn't an octal mask", s)
+	}
+
+	return int(mask), nil
+}
+
+// startMu serializes the processes which start with their umask.
+var startMu sync.Mutex
+
+// start starts cmd with umask unless it's -1, and with limits.
+// The umask belongs to the whole process, so it's only changed while forking cmd, which inherits it,
+// and the limits are set on cmd right after it starts, which is killed if they can't be.
+func start(cmd *exec.Cmd, umask int, limits []rlimit) error {
+	if umask >= 0 {
+		startMu.Lock()
+		old := syscall.Umask(umask)
+		err := cmd.Start()
+		syscall.Umask(old)
+		startMu.Unlock()
+		if err != nil {
+			return err
+		}
+	} else if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	err := setLimits(cmd.Process.Pid, limits)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	return nil
+}
+
+// shellCommand returns the command running raw in a login shell.
+func shellCommand(raw string) *exec.Cmd {
+	return exec.Command("bash", "-lc", raw)
+}
+
+// quoteArg quotes s as a word of bash.
+func quoteArg(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// valueCommand returns the command running raw, which refers to the values of the environment variables by valueRef.
+func valueCommand(raw string) *exec.Cmd {
+	return shellCommand(raw)
+}
+
+// valueRef returns the reference to the environment variable of name, which bash expands to a word of its value
+// without parsing it.
+func valueRef(name string) string {
+	return `"${` + name + `}"`
+}
+
+// withinQuotes reports whether the command s of bash ends within single or double quotes.
+func withinQuotes(s string) bool {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			}
+		case c == '\\':
+			// the escaped character is as it is, within double quotes as well
+			i++
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		}
+	}
+	return quote != 0
+}
+
+// shellArgv returns the argv running script in /bin/sh with args as $1 and so on.
+func shellArgv(script string, args []string) []string {
+	return append([]string{"/bin/sh", "-c", script, "sh"}, args...)
+}
+
+// prepare makes cmd start in a new process group, which is necessary when killing a subprocess properly.
+// It also runs as cred unless cred is nil.
+func prepare(cmd *exec.Cmd, cred *credential) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: cred}
+}
+
+// killGroup kills the started cmd, which leads its own process group by prepare, along with the rest of the group.
+func killGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// newProcGroup returns the process group of the started cmd, which leads its own group by prepare, and is in cg unless it's nil.
+func newProcGroup(cmd *exec.Cmd, cg *cgroup) (*procGroup, error) {
+	return &procGroup{pgid: cmd.Process.Pid, cgroup: cg}, nil
+}
+
+// terminate asks every process of the group to exit.
+func (g *procGroup) terminate() error {
+	return g.signal(syscall.SIGTERM)
+}
+
+// signal sends sig to every process of the group and the cgroup.
+func (g *procGroup) signal(sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return fmt.Errorf("kelthuzad: %v can't be sent", sig)
+	}
+
+	err := syscall.Kill(-g.pgid, s)
+	if g.cgroup != nil && g.cgroup.signal(s) == nil {
+		err = nil
+	}
+	return err
+}
+
+// kill kills every process of the group immediately, or of the cgroup at once.
+func (g *procGroup) kill() error {
+	if g.cgroup != nil {
+		return g.cgroup.kill()
+	}
+	return syscall.Kill(-g.pgid, syscall.SIGKILL)
+}
+
+// close releases the group after its process is gone, and kills the descendants left in the cgroup.
+func (g *procGroup) close() {
+	if g.cgroup != nil {
+		g.cgroup.kill()
+		g.cgroup.remove()
+	}
+}
@@ -0,0 +1,48 @@
+//go:build !windows
+
+package kelthuzad
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestWithinQuotes(t *testing.T) {
+	tests := []struct {
+		s    string
+		want bool
+	}{
+		{``, false},
+		{`echo `, false},
+		{`echo "`, true},
+		{`echo '`, true},
+		{`echo "a" `, false},
+		{`echo 'a' `, false},
+		{`echo "it's `, true},
+		{`echo "it's" `, false},
+		{`echo 'say "hi' `, false},
+		{`echo \" `, false},
+		{`echo \' `, false},
+		{`echo "a\" `, true},
+		{`echo "a\\" `, false},
+		{`echo 'a\' `, false},
+		{`echo "a" 'b' "`, true},
+	}
+	for _, tt := range tests {
+		if got := withinQuotes(tt.s); got != tt.want {
+			t.Errorf("withinQuotes(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestQuoteArg(t *testing.T) {
+	for _, s := range []string{"", "a b", "it's", `"'"`, "$(id) `id` ${IFS}", "a\nb", `\`} {
+		out, err := exec.Command("bash", "-c", "printf %s "+quoteArg(s)).Output()
+		if err != nil {
+			t.Fatalf("quoteArg(%q) error = %v", s, err)
+		}
+		if string(out) != s {
+			t.Errorf("quoteArg(%q) = %q in bash", s, out)
+		}
+	}
+}
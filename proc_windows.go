@@ -0,0 +1,154 @@
+//go:build windows
+
+package kelthuzad
+
+import (
+	"errors"
+	"golang.org/x/sys/windows"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// procGroup is the job object holding a spawned process and all of its descendants.
+type procGroup struct {
+	pid int
+	job windows.Handle
+}
+
+// credential isn't supported, since Windows has no way to start a process as another user without the password.
+type credential struct{}
+
+// newCredential returns an error when either of the user and the group is given.
+func newCredential(username string, group string) (*credential, error) {
+	if username != "" || group != "" {
+		return nil, errors.New("kelthuzad: User and Group aren't supported on Windows")
+	}
+
+	return nil, nil
+}
+
+// parseUmask returns an error unless s is empty, since Windows has no umask.
+func parseUmask(s string) (int, error) {
+	if s != "" {
+		return 0, errors.New("kelthuzad: Umask isn't supported on Windows")
+	}
+
+	return -1, nil
+}
+
+// start starts cmd, ignoring umask and limits.
+func start(cmd *exec.Cmd, umask int, limits []rlimit) error {
+	return cmd.Start()
+}
+
+// shellCommand returns the command running raw in cmd.exe.
+func shellCommand(raw string) *exec.Cmd {
+	return exec.Command("cmd", "/C", raw)
+}
+
+// quoteArg quotes s as an argument of cmd.exe, where the double quotes can't be escaped but doubled.
+func quoteArg(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// valueCommand returns the command running raw in cmd.exe with the delayed expansion,
+// which refers to the values of the environment variables by valueRef.
+func valueCommand(raw string) *exec.Cmd {
+	return exec.Command("cmd", "/V:ON", "/C", raw)
+}
+
+// valueRef returns the reference to the environment variable of name, which the delayed expansion of cmd.exe
+// expands to an argument of its value after parsing the command, unlike %NAME%.
+func valueRef(name string) string {
+	return `"!` + name + `!"`
+}
+
+// withinQuotes reports whether the command s of cmd.exe ends within double quotes.
+func withinQuotes(s string) bool {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == '^' && !quoted:
+			// the escaped character is as it is
+			i++
+		}
+	}
+	return quoted
+}
+
+// shellArgv returns the argv running script in cmd.exe with args after it.
+func shellArgv(script string, args []string) []string {
+	return append([]string{"cmd", "/C", script}, args...)
+}
+
+// prepare makes cmd start in a new console process group, so it can receive CTRL_BREAK_EVENT on its own.
+func prepare(cmd *exec.Cmd, cred *credential) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: windows.CREATE_NEW_PROCESS_GROUP}
+}
+
+// killGroup kills the started cmd along with its descendants by taskkill, since a console process group can't be killed.
+func killGroup(cmd *exec.Cmd) error {
+	err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run()
+	if err != nil {
+		return cmd.Process.Kill()
+	}
+	return nil
+}
+
+// newProcGroup puts the started cmd into a new job object, which its descendants inherit, ignoring cg.
+func newProcGroup(cmd *exec.Cmd, cg *cgroup) (*procGroup, error) {
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// make sure the processes don't outlive kelthuzad even if it dies without cleaning up
+	info := windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION{}
+	info.BasicLimitInformation.LimitFlags = windows.JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE
+	_, err = windows.SetInformationJobObject(job, windows.JobObjectExtendedLimitInformation, uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info)))
+	if err != nil {
+		windows.CloseHandle(job)
+		return nil, err
+	}
+
+	process, err := windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE, false, uint32(cmd.Process.Pid))
+	if err != nil {
+		windows.CloseHandle(job)
+		return nil, err
+	}
+	defer windows.CloseHandle(process)
+
+	err = windows.AssignProcessToJobObject(job, process)
+	if err != nil {
+		windows.CloseHandle(job)
+		return nil, err
+	}
+
+	return &procGroup{pid: cmd.Process.Pid, job: job}, nil
+}
+
+// terminate asks the process group to exit by CTRL_BREAK_EVENT, the closest thing to SIGTERM.
+func (g *procGroup) terminate() error {
+	return windows.GenerateConsoleCtrlEvent(windows.CTRL_BREAK_EVENT, uint32(g.pid))
+}
+
+// signal isn't supported, since Windows has no signals but the console events.
+func (g *procGroup) signal(sig os.Signal) error {
+	return errors.New("kelthuzad: signals can't be sent on Windows")
+}
+
+// kill kills every process of the job immediately.
+func (g *procGroup) kill() error {
+	return windows.TerminateJobObject(g.job, 1)
+}
+
+// close releases the job object after its processes are gone.
+func (g *procGroup) close() {
+	windows.CloseHandle(g.job)
+}
@@ -0,0 +1,38 @@
+//go:build !windows
+
+package kelthuzad
+
+import (
+	"github.com/creack/pty"
+	"os"
+	"os/exec"
+)
+
+// ptySupported tells whether the process can run under a pseudo-terminal.
+const ptySupported = true
+
+// openPty opens a pseudo-terminal of 80x24, and returns its master, which kelthuzad reads and writes,
+// and its terminal for the process.
+func openPty() (*os.File, *os.File, error) {
+	master, tty, err := pty.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = pty.Setsize(tty, &pty.Winsize{Rows: 24, Cols: 80})
+	if err != nil {
+		master.Close()
+		tty.Close()
+		return nil, nil, err
+	}
+	return master, tty, nil
+}
+
+// attachPty makes cmd prepared lead a new session, whose controlling terminal is its stdin.
+// The session leader leads its own process group as well.
+func attachPty(cmd *exec.Cmd) {
+	cmd.SysProcAttr.Setpgid = false
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0
+}
@@ -0,0 +1,19 @@
+package kelthuzad
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// ptySupported tells whether the process can run under a pseudo-terminal.
+const ptySupported = false
+
+// openPty fails, since a pseudo-terminal isn't supported on Windows.
+func openPty() (*os.File, *os.File, error) {
+	return nil, nil, errors.New("a pseudo-terminal isn't supported on Windows")
+}
+
+// attachPty does nothing on Windows.
+func attachPty(cmd *exec.Cmd) {
+}
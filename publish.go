@@ -0,0 +1,106 @@
+package kelthuzad
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+	"strings"
+	"sync"
+	"time"
+)
+
+// publishers are the Kafka and NATS sinks by the spec, which are shared by the notifiers before and after a reload
+// to keep their connections.
+var publishers = struct {
+	sync.Mutex
+	m map[string]sender
+}{m: make(map[string]sender)}
+
+// publisher returns the sink of kind, which is kafka or nats, publishing to arg of BROKERS/TOPIC or SERVERS/SUBJECT.
+func publisher(kind string, arg string) (sender, error) {
+	i := strings.LastIndex(arg, "/")
+	if i <= 0 || i == len(arg)-1 {
+		return nil, fmt.Errorf("%v:%v must be %v:SERVER[,SERVER...]/%v", kind, arg, kind, map[string]string{"kafka": "TOPIC", "nats": "SUBJECT"}[kind])
+	}
+	servers, to := strings.Split(arg[:i], ","), arg[i+1:]
+
+	publishers.Lock()
+	defer publishers.Unlock()
+
+	spec := kind + ":" + arg
+	if s, ok := publishers.m[spec]; ok {
+		return s, nil
+	}
+	var s sender
+	if kind == "kafka" {
+		s = &kafkaSink{writer: &kafka.Writer{
+			Addr:         kafka.TCP(servers...),
+			Topic:        to,
+			Balancer:     &kafka.Hash{},
+			BatchTimeout: 10 * time.Millisecond,
+			RequiredAcks: kafka.RequireOne,
+			WriteTimeout: 10 * time.Second,
+		}}
+	} else {
+		s = &natsSink{servers: strings.Join(servers, ","), subject: to}
+	}
+	publishers.m[spec] = s
+	return s, nil
+}
+
+// kafkaSink produces an event to a topic of Kafka as JSON, keyed by the service to keep its events in order.
+type kafkaSink struct {
+	writer *kafka.Writer
+}
+
+func (k *kafkaSink) send(e event) error {
+	value, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return k.writer.WriteMessages(ctx, kafka.Message{Key: []byte(e.Service), Value: value})
+}
+
+func (k *kafkaSink) String() string {
+	return "kafka topic " + k.writer.Topic
+}
+
+// natsSink publishes an event to a subject of NATS as JSON, connecting on the first one and reconnecting by itself.
+type natsSink struct {
+	servers string
+	subject string
+
+	mu   sync.Mutex
+	conn *nats.Conn
+}
+
+func (n *natsSink) send(e event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conn == nil {
+		conn, err := nats.Connect(n.servers, nats.Name("kelthuzad"), nats.MaxReconnects(-1))
+		if err != nil {
+			return err
+		}
+		n.conn = conn
+	}
+	err = n.conn.Publish(n.subject, data)
+	if err != nil {
+		return err
+	}
+	return n.conn.FlushTimeout(10 * time.Second)
+}
+
+func (n *natsSink) String() string {
+	return "nats subject " + n.subject
+}
@@ -0,0 +1,65 @@
+package kelthuzad
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// watchRate measures the lines per second of the process until ctx is done,
+// and fails it once the rate stays over MaxRate or under MinRate for the rate period, such as a flood or a silence.
+func (w *Watchdog) watchRate(ctx context.Context) {
+	var out time.Time
+	var lastAt time.Time
+	var gen int
+	for sleep(ctx, time.Duration(w.config().RateInterval)*time.Second) {
+		if w.config().MaxRate == 0 && w.config().MinRate == 0 {
+			continue
+		}
+
+		// the process is being replaced or the detection is paused, so nothing is there to measure
+		now := time.Now()
+		cur := w.current()
+		w.mu.Lock()
+		seen := w.seen
+		w.seen = 0
+		w.mu.Unlock()
+		if cur == nil || w.isPaused() {
+			out = time.Time{}
+			lastAt = time.Time{}
+			continue
+		}
+
+		// every process starts over, and the first interval of it only starts measuring
+		if cur.gen != gen || lastAt.IsZero() {
+			gen = cur.gen
+			out = time.Time{}
+			lastAt = now
+			continue
+		}
+		rate := float64(seen) / now.Sub(lastAt).Seconds()
+		lastAt = now
+
+		// tell why it's out of the bounds, or go back to normal
+		var reason string
+		if w.config().MaxRate > 0 && rate > w.config().MaxRate {
+			reason = fmt.Sprintf("rate %.1f lines/s is over %v lines/s", rate, w.config().MaxRate)
+		} else if w.config().MinRate > 0 && rate < w.config().MinRate {
+			reason = fmt.Sprintf("rate %.1f lines/s is under %v lines/s", rate, w.config().MinRate)
+		}
+		if reason == "" {
+			out = time.Time{}
+			continue
+		}
+		if out.IsZero() {
+			out = now
+		}
+
+		period := time.Duration(w.config().RatePeriod) * time.Second
+		w.log.logf("RATE", record{Level: "warn", Event: "rate", Pid: cur.pid}, "%v for %v/%v", reason, now.Sub(out).Round(time.Second), period)
+		if now.Sub(out) >= period {
+			w.failLater(cur, "resource-limit", fmt.Sprintf("%v for %v", reason, period), "rate", nil)
+			out = time.Time{}
+		}
+	}
+}
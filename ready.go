@@ -0,0 +1,86 @@
+package kelthuzad
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// startReadiness starts the timer which fails p when it isn't ready in time.
+func (w *Watchdog) startReadiness(ctx context.Context, p *proc) {
+	if w.ready == nil {
+		return
+	}
+
+	timeout := time.Duration(w.config().ReadyTimeout) * time.Second
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.readyTimer = time.AfterFunc(timeout, func() {
+		// the timer could fire while p is being replaced, or right after it got ready
+		if ctx.Err() != nil || w.current() != p || w.isReady() {
+			return
+		}
+
+		// the detection is paused, so just wait for another timeout
+		if w.isPaused() {
+			w.mu.Lock()
+			w.readyTimer.Reset(timeout)
+			w.mu.Unlock()
+			return
+		}
+
+		w.failLater(p, "probe-failure", fmt.Sprintf("not ready in %v", timeout), w.config().ReadyPattern, nil)
+	})
+}
+
+// markReady marks p ready, after which it's probed and waited for the heartbeat.
+// It does nothing if p is ready already or isn't the latest process anymore.
+func (w *Watchdog) markReady(ctx context.Context, p *proc) {
+	w.mu.Lock()
+	if w.proc != p || !w.readyAt.IsZero() {
+		w.mu.Unlock()
+		return
+	}
+	if w.readyTimer != nil {
+		w.readyTimer.Stop()
+	}
+	w.readyAt = time.Now()
+	w.mu.Unlock()
+
+	pid := p.pid
+	w.log.logf("SYSTEM", record{Level: "info", Event: "ready", Pid: pid}, "%v is ready", pid)
+	w.notify("ready", "", "")
+	w.telemetry.end(nil)
+	w.sdReady(pid)
+	w.startHeartbeat(ctx, p)
+}
+
+// stopReadiness stops waiting for the process which is gone to get ready.
+func (w *Watchdog) stopReadiness() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.readyTimer != nil {
+		w.readyTimer.Stop()
+	}
+}
+
+// isReady reports whether the process is ready, which it always is without ReadyPattern.
+func (w *Watchdog) isReady() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.ready == nil || !w.readyAt.IsZero()
+}
+
+// healthyUptime returns how long the process has been healthy, which doesn't start until it's ready.
+func (w *Watchdog) healthyUptime() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.ready == nil {
+		return time.Since(w.spawnedAt)
+	}
+	if w.readyAt.IsZero() {
+		return 0
+	}
+	return time.Since(w.readyAt)
+}
@@ -0,0 +1,38 @@
+package kelthuzad
+
+import (
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// outputDelay is how long a command is waited for its output once it exits, which a process it left may hold open.
+const outputDelay = 5 * time.Second
+
+// owned are the pids of the processes started by the watchdog, which are waited by their own Cmd and never reaped.
+var owned = struct {
+	sync.Mutex
+	pids map[int]bool
+}{pids: make(map[int]bool)}
+
+// startOwned starts cmd with umask unless it's -1 and with limits, and keeps it away from the reaper until it's disowned.
+func startOwned(cmd *exec.Cmd, umask int, limits []rlimit) error {
+	owned.Lock()
+	defer owned.Unlock()
+
+	err := start(cmd, umask, limits)
+	if err != nil {
+		return err
+	}
+	owned.pids[cmd.Process.Pid] = true
+
+	return nil
+}
+
+// disown forgets cmd which has been waited.
+func disown(cmd *exec.Cmd) {
+	owned.Lock()
+	defer owned.Unlock()
+
+	delete(owned.pids, cmd.Process.Pid)
+}
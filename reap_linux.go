@@ -0,0 +1,99 @@
+//go:build linux
+
+package kelthuzad
+
+import (
+	"bytes"
+	"context"
+	"golang.org/x/sys/unix"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// becomeSubreaper makes the orphaned descendants children of kelthuzad, as if it's PID 1.
+func becomeSubreaper() error {
+	return unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0)
+}
+
+// reap reaps the orphaned zombies whenever a child exits until ctx is done.
+func (w *Watchdog) reap(ctx context.Context) {
+	if !w.config().Init {
+		return
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGCHLD)
+	defer signal.Stop(sigs)
+
+	// the signals of the children exiting at once are merged, so look around once in a while as well
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sigs:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		for _, pid := range reapZombies() {
+			w.log.logf("SYSTEM", record{Level: "info", Event: "reap", Pid: pid}, "%v is reaped", pid)
+		}
+	}
+}
+
+// reapZombies waits for every zombie child which isn't owned, and returns their pids.
+func reapZombies() []int {
+	owned.Lock()
+	defer owned.Unlock()
+
+	stats, _ := filepath.Glob("/proc/[0-9]*/stat")
+	ppid := os.Getpid()
+	var reaped []int
+	for _, stat := range stats {
+		pid, state, parent, ok := readStat(stat)
+		if !ok || parent != ppid || state != 'Z' || owned.pids[pid] {
+			continue
+		}
+
+		var ws syscall.WaitStatus
+		n, err := syscall.Wait4(pid, &ws, syscall.WNOHANG, nil)
+		if err == nil && n == pid {
+			reaped = append(reaped, pid)
+		}
+	}
+
+	return reaped
+}
+
+// readStat reads the pid, the state and the parent pid from the stat file of a process.
+func readStat(path string) (int, byte, int, bool) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+
+	// the command may contain spaces and parentheses, so the fields are after the last parenthesis
+	i, j := bytes.LastIndexByte(b, ')'), bytes.IndexByte(b, '(')
+	if j < 0 || i < j {
+		return 0, 0, 0, false
+	}
+	pid, err := strconv.Atoi(string(bytes.TrimSpace(b[:j])))
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	fields := bytes.Fields(b[i+1:])
+	if len(fields) < 2 || len(fields[0]) != 1 {
+		return 0, 0, 0, false
+	}
+	ppid, err := strconv.Atoi(string(fields[1]))
+	if err != nil {
+		return 0, 0, 0, false
+	}
+
+	return pid, fields[0][0], ppid, true
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package kelthuzad
+
+import (
+	"context"
+	"errors"
+)
+
+// becomeSubreaper returns an error, since only Linux can make a process the subreaper.
+func becomeSubreaper() error {
+	return errors.New("kelthuzad: Init is only supported on Linux")
+}
+
+// reap does nothing, since Init isn't supported.
+func (w *Watchdog) reap(ctx context.Context) {}
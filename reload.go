@@ -0,0 +1,189 @@
+package kelthuzad
+
+import (
+	"errors"
+)
+
+// Reload applies cfg to the running watchdog without respawning a healthy process.
+// The options about what to spawn and where to monitor and serve are kept, since they can't change while running.
+func (w *Watchdog) Reload(cfg *Config) error {
+	cur := w.config()
+
+	// keep what can't change while running
+	next := *cfg
+	next.CmdPath = cur.CmdPath
+	next.RawCommand = cur.RawCommand
+	next.Shell = cur.Shell
+	next.Argv = cur.Argv
+	next.SSH = cur.SSH
+	next.SSHOptions = cur.SSHOptions
+	next.Detectors = cur.Detectors
+	next.CustomDetectors = cur.CustomDetectors
+	next.GoPlugins = cur.GoPlugins
+	next.Args = cur.Args
+	next.LogPath = cur.LogPath
+	next.TailFrom = cur.TailFrom
+	next.TailPoll = cur.TailPoll
+	next.StateDir = cur.StateDir
+	next.JournaldUnit = cur.JournaldUnit
+	next.SyslogListen = cur.SyslogListen
+	next.Stdin = cur.Stdin
+	next.Interactive = cur.Interactive
+	next.Pty = cur.Pty
+	next.ContextLines = cur.ContextLines
+	next.CrashDir = cur.CrashDir
+	next.CrashLines = cur.CrashLines
+	next.DockerContainer = cur.DockerContainer
+	next.DockerHost = cur.DockerHost
+	next.KubeSelector = cur.KubeSelector
+	next.KubeNamespace = cur.KubeNamespace
+	next.KubeContainer = cur.KubeContainer
+	next.KubeLease = cur.KubeLease
+	next.LeaderLock = cur.LeaderLock
+	next.Kubeconfig = cur.Kubeconfig
+	next.Streams = cur.Streams
+	next.QueueSize = cur.QueueSize
+	next.QueueFull = cur.QueueFull
+	next.Matchers = cur.Matchers
+	next.Passthrough = cur.Passthrough
+	next.Name = cur.Name
+	next.APIAddr = cur.APIAddr
+	next.Join = cur.Join
+	next.JoinInterval = cur.JoinInterval
+	next.JoinToken = cur.JoinToken
+	next.GRPCAddr = cur.GRPCAddr
+	next.ControlSocket = cur.ControlSocket
+	next.SocketMode = cur.SocketMode
+	next.Journal = cur.Journal
+	next.PidFile = cur.PidFile
+	next.ChildPidFile = cur.ChildPidFile
+	next.MaxLineSize = cur.MaxLineSize
+	next.StripANSI = cur.StripANSI
+	next.ReplaceInvalid = cur.ReplaceInvalid
+	next.Init = cur.Init
+	next.BreakerRestarts = cur.BreakerRestarts
+	next.BreakerWindow = cur.BreakerWindow
+	next.BreakerCooldown = cur.BreakerCooldown
+	next.RestartBudget = cur.RestartBudget
+	next.BudgetExhausted = cur.BudgetExhausted
+	next.Cgroup = cur.Cgroup
+	next.CgroupMemory = cur.CgroupMemory
+	next.CgroupCPU = cur.CgroupCPU
+	next.OutputPath = cur.OutputPath
+	next.OutputMaxSize = cur.OutputMaxSize
+	next.OutputMaxAge = cur.OutputMaxAge
+	next.OutputMaxBackups = cur.OutputMaxBackups
+	next.OutputCompress = cur.OutputCompress
+	next.Tee = cur.Tee
+	next.OTLPEndpoint = cur.OTLPEndpoint
+	next.OTLPHeaders = cur.OTLPHeaders
+	next.OTLPInterval = cur.OTLPInterval
+	next.StatsdAddr = cur.StatsdAddr
+	next.StatsdPrefix = cur.StatsdPrefix
+	next.StatsdTags = cur.StatsdTags
+	next.StatsdInterval = cur.StatsdInterval
+	next.LogFormat = cur.LogFormat
+	next.LogLevel = cur.LogLevel
+	next.SeverityPatterns = cur.SeverityPatterns
+	next.PingInterval = cur.PingInterval
+	next.PingLine = cur.PingLine
+	next.ReadyPattern = cur.ReadyPattern
+	next.Sequence = cur.Sequence
+	next.SequenceWindow = cur.SequenceWindow
+	next.ReadyTimeout = cur.ReadyTimeout
+	next.Reloader = cur.Reloader
+
+	// what's installed is the merged config, whose pinned options may have been rejected by themselves
+	err := next.validate()
+	if err != nil {
+		return err
+	}
+
+	var pattern, heartbeat matcher
+	if next.Pattern != "" {
+		pattern, err = compile(&next, next.Pattern)
+		if err != nil {
+			return err
+		}
+	}
+	excludes, err := compileSet(&next, next.ExcludePatterns)
+	if err != nil {
+		return err
+	}
+	rule, err := compileRule(&next)
+	if err != nil {
+		return err
+	}
+	if next.HeartbeatPattern != "" {
+		heartbeat, err = compile(&next, next.HeartbeatPattern)
+		if err != nil {
+			return err
+		}
+	}
+	probers, err := newProbers(&next)
+	if err != nil {
+		return err
+	}
+	env, err := newEnv(&next)
+	if err != nil {
+		return err
+	}
+	cred, err := newCredential(next.User, next.Group)
+	if err != nil {
+		return err
+	}
+	umask, err := parseUmask(next.Umask)
+	if err != nil {
+		return err
+	}
+	limits, err := newLimits(&next)
+	if err != nil {
+		return err
+	}
+	notifier, err := newNotifier(&next, w.log, w.metrics, w.hub)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.cfg.Store(&next)
+	w.pattern = pattern
+	w.excludes = excludes
+	w.rule = rule
+	w.criteria = criteria(next.Pattern, rule)
+	w.heartbeat = heartbeat
+	w.probers = probers
+	w.probeRes = nil
+	w.env = env
+	w.cred = cred
+	w.umask = umask
+	w.limits = limits
+	// the delay growing while the process keeps failing goes on unless the backoff itself changed
+	if next.Delay != cur.Delay || next.MaxDelay != cur.MaxDelay || next.Multiplier != cur.Multiplier || next.ResetAfter != cur.ResetAfter || next.Jitter != cur.Jitter {
+		w.backoff.Store(newBackoff(&next))
+	}
+	w.notifier.Store(notifier)
+	// the process which is ready waits for the heartbeat added, not for the one removed, and for as long as the new timeout
+	if (next.HeartbeatPattern == "") != (cur.HeartbeatPattern == "") || next.HeartbeatTimeout != cur.HeartbeatTimeout {
+		w.armHeartbeat()
+	}
+	w.mu.Unlock()
+
+	w.log.logf("SYSTEM", record{Level: "info", Event: "reload"}, "the config is reloaded")
+	return nil
+}
+
+// reload reloads the config from Reloader.
+func (w *Watchdog) reload() error {
+	reloader := w.config().Reloader
+	if reloader == nil {
+		return errors.New("kelthuzad: the config isn't reloadable")
+	}
+
+	cfg, err := reloader()
+	if err != nil {
+		return err
+	}
+
+	return w.Reload(cfg)
+}
@@ -0,0 +1,122 @@
+package kelthuzad
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// Verdict is what a line replayed by Replay did to the detection.
+type Verdict struct {
+	// Number is the number of the line from 1
+	Number int
+	// Line is the latest lines which matched, joined by newlines
+	Line string
+	// Pattern describes what matched
+	Pattern string
+	// Captures are the named groups and the fields of JSON which matched, or the reason of a Go plugin
+	Captures map[string]string
+	// Matches is how many matches are counted toward FailThreshold
+	Matches int
+	// Failed is whether it would have triggered a restart
+	Failed bool
+}
+
+// Replay runs the lines of r through the pattern, the exclude patterns, the JSON fields and the Go plugins of cfg
+// as if the process printed them all at once, and calls report with every line which matched.
+// The matches start over after every failure as the respawned process does, and it returns how many lines are read.
+func Replay(cfg *Config, r io.Reader, report func(Verdict)) (int, error) {
+	// the lines stand for the process, which doesn't have to be given
+	given := *cfg
+	if given.CmdPath == "" && given.RawCommand == "" && len(given.Argv) == 0 && given.DockerContainer == "" && given.KubeSelector == "" {
+		given.RawCommand = "replay"
+	}
+	err := given.validate()
+	if err != nil {
+		return 0, err
+	}
+
+	var pattern matcher
+	if cfg.Pattern != "" {
+		pattern, err = compile(cfg, cfg.Pattern)
+		if err != nil {
+			return 0, err
+		}
+	}
+	excludes, err := compileSet(cfg, cfg.ExcludePatterns)
+	if err != nil {
+		return 0, err
+	}
+	rule, err := compileRule(cfg)
+	if err != nil {
+		return 0, err
+	}
+	goPlugins, err := loadGoPlugins(cfg.GoPlugins)
+	if err != nil {
+		return 0, err
+	}
+	if pattern == nil && rule == nil && len(goPlugins) == 0 {
+		return 0, errors.New("kelthuzad: Replay needs Pattern, JSONFields, Rule or GoPlugins, since the rest needs the process running")
+	}
+	criteria := criteria(cfg.Pattern, rule)
+
+	reader := newLineReader(r, cfg.MaxLineSize)
+	budget := time.Duration(cfg.PluginBudget) * time.Millisecond
+	var lines []string
+	var matches int
+	n := 0
+	for {
+		line, _, err := reader.next()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		line = cleanLine(cfg, line)
+		n++
+
+		// a Go plugin fails the process right away by itself
+		failed := false
+		for _, g := range goPlugins {
+			ok, reason, _ := g.check(line, budget)
+			if !ok {
+				continue
+			}
+			var captures map[string]string
+			if reason != "" {
+				captures = map[string]string{"reason": reason}
+			}
+			report(Verdict{Number: n, Line: line, Pattern: g.String(), Captures: captures, Failed: true})
+			failed = true
+			break
+		}
+		if failed {
+			lines, matches = nil, 0
+			continue
+		}
+
+		lines = append(lines, line)
+		if over := len(lines) - cfg.MultilineLines; over > 0 {
+			lines = lines[over:]
+		}
+		text := strings.Join(lines, "\n")
+		if excludes.match(text) >= 0 {
+			continue
+		}
+		matched, captures := detect(pattern, rule, text, line)
+		if !matched {
+			continue
+		}
+
+		// the lines which matched once don't count again
+		lines = nil
+		matches++
+		v := Verdict{Number: n, Line: text, Pattern: criteria, Captures: captures, Matches: matches, Failed: matches >= cfg.FailThreshold}
+		report(v)
+		if v.Failed {
+			matches = 0
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package kelthuzad
+
+import (
+	"context"
+	"fmt"
+	"github.com/shirou/gopsutil/v3/process"
+	"time"
+)
+
+// usage is the resource usage of a process and its descendants.
+type usage struct {
+	// rss is the resident memory in bytes
+	rss uint64
+	// cpu is the user and system time in seconds
+	cpu float64
+}
+
+// measure sums up the usage of the process of pid and all of its descendants.
+func measure(ctx context.Context, pid int) (usage, error) {
+	p, err := process.NewProcessWithContext(ctx, int32(pid))
+	if err != nil {
+		return usage{}, err
+	}
+
+	var u usage
+	queue := []*process.Process{p}
+	for len(queue) > 0 {
+		p, queue = queue[0], queue[1:]
+
+		// a descendant may be gone in the meantime, which just doesn't count
+		mem, err := p.MemoryInfoWithContext(ctx)
+		if err == nil {
+			u.rss += mem.RSS
+		}
+		times, err := p.TimesWithContext(ctx)
+		if err == nil {
+			u.cpu += times.User + times.System
+		}
+
+		children, _ := p.ChildrenWithContext(ctx)
+		queue = append(queue, children...)
+	}
+
+	return u, nil
+}
+
+// watchResources samples the usage of the process until ctx is done,
+// and fails it once the memory or the CPU stays over the limit for the resource period.
+func (w *Watchdog) watchResources(ctx context.Context) {
+	var over time.Time
+	var last usage
+	var lastAt time.Time
+	var gen int
+	for sleep(ctx, time.Duration(w.config().ResourceInterval)*time.Second) {
+		if w.config().MaxMemory == 0 && w.config().MaxCPU == 0 {
+			continue
+		}
+
+		// the process is being replaced or the detection is paused, so nothing is there to sample
+		cur := w.current()
+		if cur == nil || w.isPaused() {
+			over = time.Time{}
+			continue
+		}
+
+		// every process starts over
+		now := time.Now()
+		u, err := measure(ctx, cur.pid)
+		if err != nil {
+			continue
+		}
+		if cur.gen != gen {
+			gen = cur.gen
+			over = time.Time{}
+			lastAt = time.Time{}
+		}
+		var cpu float64
+		if !lastAt.IsZero() {
+			cpu = (u.cpu - last.cpu) / now.Sub(lastAt).Seconds() * 100
+		}
+		last, lastAt = u, now
+
+		// tell why it's over the limit, or go back to normal
+		var reason string
+		memory := int(u.rss / 1024 / 1024)
+		if w.config().MaxMemory > 0 && memory > w.config().MaxMemory {
+			reason = fmt.Sprintf("memory %vMB is over %vMB", memory, w.config().MaxMemory)
+		} else if w.config().MaxCPU > 0 && cpu > float64(w.config().MaxCPU) {
+			reason = fmt.Sprintf("CPU %.0f%% is over %v%%", cpu, w.config().MaxCPU)
+		}
+		if reason == "" {
+			over = time.Time{}
+			continue
+		}
+		if over.IsZero() {
+			over = now
+		}
+
+		period := time.Duration(w.config().ResourcePeriod) * time.Second
+		w.log.logf("RESOURCE", record{Level: "warn", Event: "resource", Pid: cur.pid}, "%v for %v/%v", reason, now.Sub(over).Round(time.Second), period)
+		if now.Sub(over) >= period {
+			w.failLater(cur, "resource-limit", fmt.Sprintf("%v for %v", reason, period), "resource", nil)
+			over = time.Time{}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package kelthuzad
+
+import (
+	"sync"
+)
+
+// ring keeps the latest lines up to its size, which does nothing when it's nil.
+type ring struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+// newRing returns the ring of size, or nil if it's 0.
+func newRing(size int) *ring {
+	if size <= 0 {
+		return nil
+	}
+	return &ring{lines: make([]string, size)}
+}
+
+// add keeps line, forgetting the oldest one if it's full.
+func (r *ring) add(line string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % len(r.lines)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// last returns the last n lines kept from the oldest one.
+func (r *ring) last(n int) []string {
+	if r == nil || n <= 0 {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	lines := append(append([]string{}, r.lines[r.next:]...), r.lines[:r.next]...)
+	if !r.full {
+		lines = lines[len(lines)-r.next:]
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
@@ -0,0 +1,311 @@
+package kelthuzad
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ruleNode is a condition of the expression of Rule on a line.
+type ruleNode interface {
+	// eval reports whether l meets the condition, and puts what it captured into values if so
+	eval(l *ruleLine, values map[string]string) bool
+}
+
+// ruleLine is a line being evaluated, whose JSON is decoded once the fields need it.
+type ruleLine struct {
+	text    string
+	object  map[string]interface{}
+	decoded bool
+}
+
+// json returns the object of JSON of the line, or nil if it isn't one.
+func (l *ruleLine) json() map[string]interface{} {
+	if !l.decoded {
+		l.object, l.decoded = decodeObject(l.text), true
+	}
+	return l.object
+}
+
+// orNode meets either of the conditions, capturing what the first met one does.
+type orNode struct {
+	left, right ruleNode
+}
+
+func (n *orNode) eval(l *ruleLine, values map[string]string) bool {
+	for _, node := range []ruleNode{n.left, n.right} {
+		captured := make(map[string]string)
+		if node.eval(l, captured) {
+			for name, value := range captured {
+				values[name] = value
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// andNode meets both of the conditions.
+type andNode struct {
+	left, right ruleNode
+}
+
+func (n *andNode) eval(l *ruleLine, values map[string]string) bool {
+	return n.left.eval(l, values) && n.right.eval(l, values)
+}
+
+// notNode meets what the condition doesn't, capturing nothing.
+type notNode struct {
+	node ruleNode
+}
+
+func (n *notNode) eval(l *ruleLine, values map[string]string) bool {
+	return !n.node.eval(l, make(map[string]string))
+}
+
+// regexNode meets the line matching re, capturing its named groups.
+type regexNode struct {
+	re matcher
+}
+
+func (n *regexNode) eval(l *ruleLine, values map[string]string) bool {
+	if !n.re.MatchString(l.text) {
+		return false
+	}
+	for name, value := range capture(n.re, l.text) {
+		values[name] = value
+	}
+	return true
+}
+
+// fieldNode meets the line of JSON whose field is equal to value or matches re by op, capturing the field.
+// A missing field is equal to nothing.
+type fieldNode struct {
+	field jsonField
+	op    string
+	value string
+}
+
+func (n *fieldNode) eval(l *ruleLine, values map[string]string) bool {
+	object := l.json()
+	if object == nil {
+		return false
+	}
+	value, ok := lookup(object, n.field.path)
+	var met bool
+	switch n.op {
+	case "==":
+		met = ok && value == n.value
+	case "!=":
+		met = !ok || value != n.value
+	case "=~":
+		met = ok && n.field.re.MatchString(value)
+	case "!~":
+		met = !ok || !n.field.re.MatchString(value)
+	}
+	if met && ok {
+		values[n.field.name] = value
+	}
+	return met
+}
+
+// ruleToken is a token of the expression, whose kind is (, ), regex, string, word, op or the end.
+type ruleToken struct {
+	kind string
+	text string
+	pos  int
+}
+
+// ruleParser parses the expression of Rule by the precedence of NOT, AND and OR, compiling the regexes as cfg tells.
+type ruleParser struct {
+	cfg    *Config
+	tokens []ruleToken
+	i      int
+}
+
+// compileRuleExpr compiles expr of Rule, which combines /REGEX/ of a line and json.FIELD ==, !=, =~ or !~ of a line of JSON
+// by AND, OR, NOT and the parentheses.
+func compileRuleExpr(cfg *Config, expr string) (ruleNode, error) {
+	tokens, err := tokenizeRule(expr)
+	if err != nil {
+		return nil, fmt.Errorf("kelthuzad: Rule %v: %w", expr, err)
+	}
+	p := &ruleParser{cfg: cfg, tokens: tokens}
+	node, err := p.or()
+	if err == nil && p.peek().kind != "end" {
+		err = fmt.Errorf("unexpected %v at %v", p.peek().text, p.peek().pos)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("kelthuzad: Rule %v: %w", expr, err)
+	}
+	return node, nil
+}
+
+// tokenizeRule splits expr into the tokens ending with the end.
+func tokenizeRule(expr string) ([]ruleToken, error) {
+	var tokens []ruleToken
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, ruleToken{kind: string(c), text: string(c), pos: i})
+			i++
+		case c == '/' || c == '"':
+			text, n, err := quoted(expr[i:])
+			if err != nil {
+				return nil, fmt.Errorf("%v at %v", err, i)
+			}
+			kind := "regex"
+			if c == '"' {
+				kind = "string"
+			}
+			tokens = append(tokens, ruleToken{kind: kind, text: text, pos: i})
+			i += n
+		case strings.HasPrefix(expr[i:], "&&") || strings.HasPrefix(expr[i:], "||") || strings.HasPrefix(expr[i:], "==") ||
+			strings.HasPrefix(expr[i:], "!=") || strings.HasPrefix(expr[i:], "=~") || strings.HasPrefix(expr[i:], "!~"):
+			tokens = append(tokens, ruleToken{kind: "op", text: expr[i : i+2], pos: i})
+			i += 2
+		case c == '!':
+			tokens = append(tokens, ruleToken{kind: "op", text: "!", pos: i})
+			i++
+		default:
+			j := i
+			for j < len(expr) && !strings.ContainsRune(" \t\n()/\"&|=!~", rune(expr[j])) {
+				j++
+			}
+			if j == i {
+				return nil, fmt.Errorf("unexpected %c at %v", c, i)
+			}
+			tokens = append(tokens, ruleToken{kind: "word", text: expr[i:j], pos: i})
+			i = j
+		}
+	}
+	return append(tokens, ruleToken{kind: "end", text: "the end", pos: len(expr)}), nil
+}
+
+// quoted returns the text between the quote starting s and the next one, where only the quote and the backslash
+// are unescaped in a string and only the slash in a regex, and how many bytes it took.
+func quoted(s string) (string, int, error) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == quote:
+			return b.String(), i + 1, nil
+		case s[i] == '\\' && i+1 < len(s) && (s[i+1] == quote || (quote == '"' && s[i+1] == '\\')):
+			b.WriteByte(s[i+1])
+			i++
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated %c", quote)
+}
+
+func (p *ruleParser) peek() ruleToken {
+	return p.tokens[p.i]
+}
+
+func (p *ruleParser) next() ruleToken {
+	t := p.tokens[p.i]
+	if t.kind != "end" {
+		p.i++
+	}
+	return t
+}
+
+// keyword reports whether the next token is the keyword, which is case-insensitive, or the operator, and takes it if so.
+func (p *ruleParser) keyword(keyword string, op string) bool {
+	t := p.peek()
+	if (t.kind == "word" && strings.EqualFold(t.text, keyword)) || (t.kind == "op" && t.text == op) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *ruleParser) or() (ruleNode, error) {
+	left, err := p.and()
+	for err == nil && p.keyword("OR", "||") {
+		var right ruleNode
+		right, err = p.and()
+		left = &orNode{left: left, right: right}
+	}
+	return left, err
+}
+
+func (p *ruleParser) and() (ruleNode, error) {
+	left, err := p.not()
+	for err == nil && p.keyword("AND", "&&") {
+		var right ruleNode
+		right, err = p.not()
+		left = &andNode{left: left, right: right}
+	}
+	return left, err
+}
+
+func (p *ruleParser) not() (ruleNode, error) {
+	if p.keyword("NOT", "!") {
+		node, err := p.not()
+		return &notNode{node: node}, err
+	}
+	return p.primary()
+}
+
+func (p *ruleParser) primary() (ruleNode, error) {
+	t := p.next()
+	switch {
+	case t.kind == "(":
+		node, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if end := p.next(); end.kind != ")" {
+			return nil, fmt.Errorf("expected ) at %v", end.pos)
+		}
+		return node, nil
+	case t.kind == "regex":
+		re, err := compile(p.cfg, t.text)
+		if err != nil {
+			return nil, fmt.Errorf("/%v/: %w", t.text, err)
+		}
+		return &regexNode{re: re}, nil
+	case t.kind == "word" && strings.HasPrefix(t.text, "json.") && len(t.text) > len("json."):
+		return p.field(strings.TrimPrefix(t.text, "json."))
+	}
+	return nil, fmt.Errorf("expected /REGEX/, json.FIELD, NOT or ( at %v, not %v", t.pos, t.text)
+}
+
+// field parses the comparison of the field of name.
+func (p *ruleParser) field(name string) (ruleNode, error) {
+	n := &fieldNode{field: jsonField{name: name, path: strings.Split(name, ".")}}
+	op := p.next()
+	value := p.next()
+	switch {
+	case op.kind != "op" || (op.text != "==" && op.text != "!=" && op.text != "=~" && op.text != "!~"):
+		return nil, fmt.Errorf("expected ==, !=, =~ or !~ after json.%v at %v", name, op.pos)
+	case op.text[1] == '~' && value.kind == "regex":
+		re, err := compile(p.cfg, value.text)
+		if err != nil {
+			return nil, fmt.Errorf("/%v/: %w", value.text, err)
+		}
+		n.field.re = re
+	case op.text[1] == '=' && (value.kind == "string" || (value.kind == "word" && !isKeyword(value.text))):
+		n.value = value.text
+	default:
+		return nil, fmt.Errorf("expected the value of json.%v %v at %v, not %v", name, op.text, value.pos, value.text)
+	}
+	n.op = op.text
+	return n, nil
+}
+
+// isKeyword reports whether word is AND, OR or NOT in any case.
+func isKeyword(word string) bool {
+	for _, keyword := range []string{"AND", "OR", "NOT"} {
+		if strings.EqualFold(word, keyword) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package kelthuzad
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompileRuleExpr(t *testing.T) {
+	tests := []struct {
+		name         string
+		expr         string
+		line         string
+		want         bool
+		wantCaptures map[string]string
+	}{
+		{"AND before OR, the left", `/a/ OR /b/ AND /c/`, "a", true, nil},
+		{"AND before OR, the right", `/a/ OR /b/ AND /c/`, "b", false, nil},
+		{"AND before OR, both", `/a/ OR /b/ AND /c/`, "bc", true, nil},
+		{"the operators", `/a/ || /b/ && /c/`, "b", false, nil},
+		{"NOT before AND", `NOT /a/ AND /b/`, "b", true, nil},
+		{"NOT before AND, negated", `NOT /a/ AND /b/`, "ab", false, nil},
+		{"NOT by !", `!/a/ && /b/`, "ab", false, nil},
+		{"double NOT", `NOT NOT /a/`, "a", true, nil},
+		{"parentheses", `(/a/ OR /b/) AND /c/`, "a", false, nil},
+		{"parentheses met", `(/a/ OR /b/) AND /c/`, "ac", true, nil},
+		{"keywords in any case", `/a/ and not /b/`, "a", true, nil},
+		{"escaped slash", `/a\/b/`, "a/b", true, nil},
+		{"other escapes are of the regex", `/^\d+$/`, "42", true, nil},
+		{"escaped quote", `json.msg == "say \"hi\""`, `{"msg":"say \"hi\""}`, true, map[string]string{"msg": `say "hi"`}},
+		{"escaped backslash", `json.path == "C:\\x"`, `{"path":"C:\\x"}`, true, map[string]string{"path": `C:\x`}},
+		{"word", `json.level == error`, `{"level":"error"}`, true, map[string]string{"level": "error"}},
+		{"not equal", `json.level != error`, `{"level":"info"}`, true, map[string]string{"level": "info"}},
+		{"missing field is not equal", `json.level != error`, `{}`, true, map[string]string{}},
+		{"not JSON", `json.level != error`, "level error", false, nil},
+		{"nested field", `json.err.code =~ /^5/`, `{"err":{"code":"503"}}`, true, map[string]string{"err.code": "503"}},
+		{"not matching", `json.level !~ /warn|error/`, `{"level":"info"}`, true, map[string]string{"level": "info"}},
+		{"captures of the met one", `/(?P<code>\d+)/ OR /x(?P<name>\w+)/`, "xyz", true, map[string]string{"name": "yz"}},
+		{"captures of both", `/(?P<code>\d+)/ AND json.level == error`, `{"level":"error","n":1}`, true, map[string]string{"code": "1", "level": "error"}},
+		{"nothing captured by NOT", `NOT /(?P<code>\d+)/`, "x", true, map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := compileRuleExpr(&Config{}, tt.expr)
+			if err != nil {
+				t.Fatalf("compileRuleExpr(%q) error = %v", tt.expr, err)
+			}
+			captures := make(map[string]string)
+			if got := node.eval(&ruleLine{text: tt.line}, captures); got != tt.want {
+				t.Errorf("eval(%q) = %v, want %v", tt.line, got, tt.want)
+			}
+			if tt.wantCaptures != nil && !reflect.DeepEqual(captures, tt.wantCaptures) {
+				t.Errorf("captures = %v, want %v", captures, tt.wantCaptures)
+			}
+		})
+	}
+}
+
+func TestCompileRuleExprError(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    string
+		wantErr string
+	}{
+		{"unterminated regex", `/abc`, "unterminated / at 0"},
+		{"unterminated string", `json.msg == "abc`, `unterminated " at 12`},
+		{"escaped end of regex", `/a\/`, "unterminated / at 0"},
+		{"escaped end of string", `json.msg == "a\"`, `unterminated " at 12`},
+		{"missing operand", `/a/ AND`, "expected /REGEX/, json.FIELD, NOT or ( at 7, not the end"},
+		{"missing parenthesis", `(/a/`, "expected ) at 4"},
+		{"extra parenthesis", `/a/)`, "unexpected ) at 3"},
+		{"missing operator", `/a/ /b/`, "unexpected b at 4"},
+		{"single ampersand", `/a/ & /b/`, "unexpected & at 4"},
+		{"empty", ``, "expected /REGEX/, json.FIELD, NOT or ( at 0, not the end"},
+		{"bare word", `error`, "expected /REGEX/, json.FIELD, NOT or ( at 0, not error"},
+		{"missing comparison", `json.level`, "expected ==, !=, =~ or !~ after json.level at 10"},
+		{"keyword as value", `json.level == AND`, "expected the value of json.level == at 14, not AND"},
+		{"string to match", `json.level =~ "x"`, "expected the value of json.level =~ at 14, not x"},
+		{"regex to compare", `json.level == /x/`, "expected the value of json.level == at 14, not x"},
+		{"invalid regex", `/(/`, "/(/: "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileRuleExpr(&Config{}, tt.expr)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("compileRuleExpr(%q) error = %v, want %v", tt.expr, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package kelthuzad
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// window is a time window of every day from start until end in minutes of the day, which spans midnight if end is before start.
+type window struct {
+	start int
+	end   int
+}
+
+// parseClock parses HH:MM into the minutes of the day.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("%v must be HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseWindow parses HH:MM-HH:MM into a window.
+func parseWindow(s string) (window, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return window{}, fmt.Errorf("%v must be HH:MM-HH:MM", s)
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return window{}, err
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return window{}, err
+	}
+
+	return window{start: start, end: end}, nil
+}
+
+// contains reports whether the minute of the day m is in win.
+func (win window) contains(m int) bool {
+	if win.start <= win.end {
+		return win.start <= m && m < win.end
+	}
+	return m >= win.start || m < win.end
+}
+
+// nextAt returns the first time after now at the minute of the day m in the location of now.
+func nextAt(now time.Time, m int) time.Time {
+	t := time.Date(now.Year(), now.Month(), now.Day(), m/60, m%60, 0, 0, now.Location())
+	if !t.After(now) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t
+}
+
+// frozen reports whether now is in any of FreezeWindows, and returns the end of the latest one.
+func (w *Watchdog) frozen(now time.Time) (time.Time, bool) {
+	m := now.Hour()*60 + now.Minute()
+	var until time.Time
+	for _, spec := range w.config().FreezeWindows {
+		win, err := parseWindow(spec)
+		if err != nil || !win.contains(m) {
+			continue
+		}
+		if end := nextAt(now, win.end); end.After(until) {
+			until = end
+		}
+	}
+
+	return until, !until.IsZero()
+}
+
+// postpone queues the restart of p for reason classified as cause until the freeze window is over, unless it's queued already.
+// The failure is notified right away, and p is restarted then unless it's gone or being replaced in the meantime.
+func (w *Watchdog) postpone(ctx context.Context, p *proc, until time.Time, reason string, cause string, line string, pattern string, captures map[string]string) {
+	w.mu.Lock()
+	queued := w.queued == p
+	w.queued = p
+	w.matches = nil
+	w.mu.Unlock()
+
+	if queued {
+		w.log.logf("MATCH", record{Level: "warn", Event: "match", Pid: p.pid, Line: line, Pattern: pattern, Captures: captures}, "%v -> %v, the restart is queued already", line, pattern)
+		return
+	}
+	if reason == "fail" {
+		w.log.logf("FAIL", record{Level: "error", Event: "fail", Pid: p.pid, Line: line, Pattern: pattern, Captures: captures}, "%v -> %v, restarting after the freeze window at %v", line, pattern, until.Format("15:04"))
+		e := w.event("fail", line, pattern)
+		e.Cause = cause
+		e.Captures = captures
+		w.notifier.Load().notify(e)
+	} else {
+		w.log.logf("SYSTEM", record{Level: "info", Event: reason, Pid: p.pid}, "restarting %v after the freeze window at %v", p.pid, until.Format("15:04"))
+	}
+
+	// the windows can follow each other
+	go func() {
+		for {
+			if !sleep(ctx, time.Until(until)) {
+				return
+			}
+			var frozen bool
+			until, frozen = w.frozen(time.Now())
+			if !frozen {
+				break
+			}
+		}
+
+		w.mu.Lock()
+		if w.queued == p {
+			w.queued = nil
+		}
+		w.mu.Unlock()
+		if !w.claim(p) {
+			return
+		}
+		w.log.logf("SYSTEM", record{Level: "info", Event: reason, Pid: p.pid}, "the freeze window is over, restarting %v...", p.pid)
+		w.restart(ctx, p, reason, cause, line, pattern, captures)
+	}()
+}
+
+// nextRestart returns the first time after now of RestartAt and RestartCron, or zero if none.
+func (w *Watchdog) nextRestart(now time.Time) time.Time {
+	var at time.Time
+	earlier := func(t time.Time) {
+		if !t.IsZero() && (at.IsZero() || t.Before(at)) {
+			at = t
+		}
+	}
+	for _, spec := range w.config().RestartAt {
+		if m, err := parseClock(spec); err == nil {
+			earlier(nextAt(now, m))
+		}
+	}
+	for _, spec := range w.config().RestartCron {
+		if c, err := parseCron(spec); err == nil {
+			earlier(c.next(now))
+		}
+	}
+
+	return at
+}
+
+// schedule restarts the process preventively at every time of RestartAt and RestartCron until ctx is done, unless it's frozen.
+func (w *Watchdog) schedule(ctx context.Context) {
+	for {
+		at := w.nextRestart(time.Now())
+
+		// look again every minute, since the times can be reloaded
+		wait := time.Minute
+		if !at.IsZero() && time.Until(at) <= wait {
+			wait = time.Until(at)
+		} else {
+			at = time.Time{}
+		}
+		if !sleep(ctx, wait) {
+			return
+		}
+		if at.IsZero() {
+			continue
+		}
+
+		p := w.current()
+		if p == nil {
+			continue
+		}
+		if w.config().DryRun {
+			w.log.logf("DRYRUN", record{Level: "warn", Event: "scheduled", Pid: p.pid}, "would restart %v on schedule", p.pid)
+			continue
+		}
+		if until, frozen := w.frozen(time.Now()); frozen {
+			w.postpone(ctx, p, until, "scheduled", "scheduled", "", "", nil)
+			continue
+		}
+		if !w.claim(p) {
+			continue
+		}
+		w.log.logf("SYSTEM", record{Level: "info", Event: "scheduled", Pid: p.pid}, "restarting %v on schedule...", p.pid)
+		w.restart(ctx, p, "scheduled", "scheduled", "", "", nil)
+	}
+}
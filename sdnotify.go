@@ -0,0 +1,64 @@
+package kelthuzad
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends state to systemd, and does nothing unless it's run as Type=notify with NOTIFY_SOCKET.
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+
+	// the socket starting with @ is in the abstract namespace
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdReady tells systemd that the process of pid is ready, and so is kelthuzad.
+func (w *Watchdog) sdReady(pid int) {
+	err := sdNotify("READY=1\nSTATUS=" + strconv.Itoa(pid) + " is ready")
+	if err != nil {
+		w.log.logf("SYSTEM", record{Level: "warn", Event: "sd_notify"}, "sd_notify %v", err)
+	}
+}
+
+// sdWatchdog sends the keepalives to the watchdog of systemd while the process is running and ready until ctx is done.
+// It does nothing unless WatchdogSec of the unit is set.
+func (w *Watchdog) sdWatchdog(ctx context.Context) {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	// keep alive twice in the interval as systemd recommends
+	interval := time.Duration(usec) * time.Microsecond / 2
+	for sleep(ctx, interval) {
+		if w.current() == nil || !w.isReady() {
+			continue
+		}
+
+		err := sdNotify("WATCHDOG=1")
+		if err != nil {
+			w.log.logf("SYSTEM", record{Level: "warn", Event: "sd_notify"}, "sd_notify %v", err)
+		}
+	}
+}
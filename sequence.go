@@ -0,0 +1,71 @@
+package kelthuzad
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sequence detects a failure once the lines match its steps in order within the window from the first one,
+// which is tracked for every process, so a respawned one starts over.
+type sequence struct {
+	steps  []matcher
+	window time.Duration
+
+	mu    sync.Mutex
+	pid   int
+	next  int
+	began time.Time
+}
+
+// newSequence compiles cfg.Sequence as cfg tells, and returns nil without it.
+func newSequence(cfg *Config) (*sequence, error) {
+	if len(cfg.Sequence) == 0 {
+		return nil, nil
+	}
+
+	s := &sequence{window: time.Duration(cfg.SequenceWindow) * time.Second}
+	for _, step := range cfg.Sequence {
+		re, err := compile(cfg, step)
+		if err != nil {
+			return nil, fmt.Errorf("kelthuzad: Sequence %v: %w", step, err)
+		}
+		s.steps = append(s.steps, re)
+	}
+	return s, nil
+}
+
+// advance moves on by line of the process of pid at now, and reports whether it's the last step.
+// The steps start over when the window is over, and from the first one again when it matches instead of the next one.
+func (s *sequence) advance(pid int, line string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if pid != s.pid || (s.next > 0 && now.Sub(s.began) > s.window) {
+		s.pid, s.next = pid, 0
+	}
+	switch {
+	case s.steps[s.next].MatchString(line):
+		if s.next == 0 {
+			s.began = now
+		}
+		s.next++
+	case s.next > 0 && s.steps[0].MatchString(line):
+		s.began, s.next = now, 1
+	}
+	if s.next < len(s.steps) {
+		return false
+	}
+	s.next = 0
+	return true
+}
+
+// String describes the steps joined by -> and the window.
+func (s *sequence) String() string {
+	var steps []string
+	for _, step := range s.steps {
+		steps = append(steps, step.String())
+	}
+	return fmt.Sprintf("%v within %v", strings.Join(steps, " -> "), s.window)
+}
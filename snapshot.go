@@ -0,0 +1,143 @@
+package kelthuzad
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// snapshotSignals are the signals of SnapshotSignal, which make the process dump its stacks.
+var snapshotSignals = map[string]syscall.Signal{"SIGQUIT": syscall.SIGQUIT, "SIGABRT": syscall.SIGABRT}
+
+// snapshot collects the diagnostics of the sick p into a new directory of SnapshotDir before it's killed for e:
+// the event, the status and the open files of /proc where it's there, the output of SnapshotCommand,
+// and the output of the process for SnapshotWait after SnapshotSignal.
+func (w *Watchdog) snapshot(ctx context.Context, p *proc, e event) {
+	if w.config().SnapshotDir == "" || p.cmd == nil || isClosed(p.done) {
+		return
+	}
+
+	dir := filepath.Join(w.config().SnapshotDir, fmt.Sprintf("%v-%v", e.Timestamp.UTC().Format("20060102T150405.000Z"), p.pid))
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		w.log.logf("SYSTEM", record{Level: "warn", Event: "snapshot", Pid: p.pid}, "snapshot %v", err)
+		return
+	}
+	w.log.logf("SYSTEM", record{Level: "info", Event: "snapshot", Pid: p.pid}, "taking a snapshot of %v into %v...", p.pid, dir)
+	write := func(name string, data []byte) {
+		err := os.WriteFile(filepath.Join(dir, name), data, 0644)
+		if err != nil {
+			w.log.logf("SYSTEM", record{Level: "warn", Event: "snapshot", Pid: p.pid}, "snapshot %v", err)
+		}
+	}
+
+	body, _ := json.MarshalIndent(e, "", "  ")
+	write("event.json", append(body, '\n'))
+	status, err := os.ReadFile(fmt.Sprintf("/proc/%v/status", p.pid))
+	if err == nil {
+		write("status", status)
+		write("fds", openFiles(p.pid))
+	}
+
+	if w.config().SnapshotCommand != "" {
+		w.runSnapshot(p, e, dir)
+	}
+
+	sig, ok := snapshotSignals[w.config().SnapshotSignal]
+	if !ok {
+		return
+	}
+	out, err := os.Create(filepath.Join(dir, "output"))
+	if err != nil {
+		w.log.logf("SYSTEM", record{Level: "warn", Event: "snapshot", Pid: p.pid}, "snapshot %v", err)
+		return
+	}
+	defer out.Close()
+
+	// the dump comes out on the monitored streams, which keep being read after the process exits by the signal
+	w.mu.Lock()
+	w.capture = out
+	w.mu.Unlock()
+	err = p.cmd.Process.Signal(sig)
+	if err != nil {
+		w.log.logf("SYSTEM", record{Level: "warn", Event: "snapshot", Pid: p.pid}, "snapshot %v %v", sig, err)
+	} else {
+		sleep(ctx, time.Duration(w.config().SnapshotWait)*time.Second)
+	}
+	w.mu.Lock()
+	w.capture = nil
+	w.mu.Unlock()
+}
+
+// openFiles returns what the open files of the process of pid are, one by one as "fd -> target".
+func openFiles(pid int) []byte {
+	dir := fmt.Sprintf("/proc/%v/fd", pid)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return []byte(err.Error() + "\n")
+	}
+
+	var fds strings.Builder
+	for _, entry := range entries {
+		target, err := os.Readlink(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			target = err.Error()
+		}
+		fmt.Fprintf(&fds, "%v -> %v\n", entry.Name(), target)
+	}
+	return []byte(fds.String())
+}
+
+// runSnapshot runs SnapshotCommand in dir with the environment of the hooks and KELTHUZAD_SNAPSHOT_DIR,
+// and keeps its output in the file command. It's killed with what it started if it runs longer than the hook timeout.
+func (w *Watchdog) runSnapshot(p *proc, e event, dir string) {
+	out, err := os.Create(filepath.Join(dir, "command"))
+	if err != nil {
+		w.log.logf("SYSTEM", record{Level: "warn", Event: "snapshot", Pid: p.pid}, "snapshot %v", err)
+		return
+	}
+	defer out.Close()
+
+	command, values, err := renderCommand("SnapshotCommand", w.config().SnapshotCommand, e)
+	if err != nil {
+		w.log.logf("SYSTEM", record{Level: "warn", Event: "snapshot", Pid: p.pid}, "snapshot command %v", err)
+		return
+	}
+
+	cmd := valueCommand(command)
+	prepare(cmd, nil)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.Dir = dir
+	cmd.Env = append(append(hookEnv(e), values...), "KELTHUZAD_SNAPSHOT_DIR="+dir)
+	cmd.WaitDelay = outputDelay
+	err = startOwned(cmd, -1, nil)
+	if err != nil {
+		w.log.logf("SYSTEM", record{Level: "warn", Event: "snapshot", Pid: p.pid}, "snapshot command %v", err)
+		return
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		disown(cmd)
+		done <- err
+	}()
+
+	timeout := time.Duration(w.config().HookTimeout) * time.Second
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		killGroup(cmd)
+		<-done
+		err = fmt.Errorf("didn't finish in %v", timeout)
+	}
+	if err != nil {
+		w.log.logf("SYSTEM", record{Level: "warn", Event: "snapshot", Pid: p.pid}, "snapshot command %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package kelthuzad
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// serveControl serves the line protocol of the control socket on ln until ctx is done.
+// Every line is a command of STATUS, RESTART, PAUSE, RESUME or RELOAD, which is answered by a line of OK or ERR followed by the detail.
+func (w *Watchdog) serveControl(ctx context.Context, ln net.Listener) {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	w.log.logf("SYSTEM", record{Level: "info", Event: "api"}, "serving the control socket on %v...", w.config().ControlSocket)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				w.stop(fmt.Errorf("kelthuzad: serveControl: %w", err))
+			}
+			return
+		}
+
+		go w.handleControl(ctx, conn)
+	}
+}
+
+// handleControl answers the commands of conn until it's closed.
+func (w *Watchdog) handleControl(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		command := strings.ToUpper(strings.TrimSpace(scanner.Text()))
+		if command == "" {
+			continue
+		}
+
+		_, err := fmt.Fprintln(conn, w.command(ctx, command))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// command runs command and returns the answer.
+func (w *Watchdog) command(ctx context.Context, command string) string {
+	switch command {
+	case "STATUS":
+	case "RESTART":
+		if !w.restartManually(ctx, "the API") {
+			return "ERR the process is being respawned already"
+		}
+	case "PAUSE":
+		w.setPaused(true)
+	case "RESUME":
+		w.setPaused(false)
+	case "RELOAD":
+		err := w.reload()
+		if err != nil {
+			return "ERR " + strings.ReplaceAll(err.Error(), "\n", " ")
+		}
+	default:
+		return "ERR unknown command " + command
+	}
+
+	// every command answers the status after it as KEY=VALUE pairs, which the shell can read
+	s := w.status()
+	answer := fmt.Sprintf("OK pid=%v running=%v ready=%v paused=%v uptime=%v restarts=%v", s.Pid, s.Running, s.Ready, s.Paused, s.Uptime, s.Restarts)
+	if s.Breaker != "" {
+		answer += " breaker=" + s.Breaker
+	}
+	return answer
+}
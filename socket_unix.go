@@ -0,0 +1,39 @@
+//go:build !windows
+
+package kelthuzad
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// listenControl listens on the control socket, which only the ones permitted by its mode can connect to.
+func (w *Watchdog) listenControl() (net.Listener, error) {
+	mode, err := strconv.ParseUint(w.config().SocketMode, 8, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	// a socket left by a crashed watchdog would block listening
+	path := w.config().ControlSocket
+	os.Remove(path)
+
+	// the socket is created with the mode already, so nobody else can connect in the meantime
+	startMu.Lock()
+	old := syscall.Umask(0777 &^ int(mode))
+	ln, err := net.Listen("unix", path)
+	syscall.Umask(old)
+	startMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(path, os.FileMode(mode))
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
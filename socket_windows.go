@@ -0,0 +1,13 @@
+//go:build windows
+
+package kelthuzad
+
+import (
+	"errors"
+	"net"
+)
+
+// listenControl returns an error, since the mode of a file can't tell who can connect to the socket on Windows.
+func (w *Watchdog) listenControl() (net.Listener, error) {
+	return nil, errors.New("ControlSocket isn't supported on Windows")
+}
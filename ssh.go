@@ -0,0 +1,47 @@
+package kelthuzad
+
+import (
+	"strconv"
+	"strings"
+)
+
+// sshWrapper runs the command of $1 on the remote host, and kills everything of the session once the connection is gone,
+// which closes the stdin of the session, or by SIGKILL after the grace period of $2 if it doesn't exit by SIGTERM.
+// The remote shell has no job control, so the session is the process group which kill 0 kills.
+// The stdin is handed to the watcher by 3, since a background job gets /dev/null otherwise.
+const sshWrapper = `exec 3<&0
+eval "$1" </dev/null 3<&- & pid=$!
+(trap '' TERM; cat <&3 >/dev/null; kill -TERM 0; sleep "$2"; kill -KILL 0) >/dev/null 2>&1 & watcher=$!
+wait "$pid"; code=$?
+kill "$watcher" 2>/dev/null
+exit "$code"`
+
+// sshArgv returns the argv running argv, or cfg.RawCommand if it's empty, on cfg.SSH by ssh.
+// The stdin of ssh must be kept open as long as the remote command is to run.
+func sshArgv(cfg *Config, argv []string) []string {
+	command := cfg.RawCommand
+	if cfg.Streams == "stdout" {
+		// the remote shell merges stderr into stdout as the local one does
+		command += " 2>&1"
+	}
+	if len(argv) > 0 {
+		var words []string
+		for _, arg := range argv {
+			words = append(words, shellQuote(arg))
+		}
+		command = strings.Join(words, " ")
+	}
+
+	// it must never ask for a password, and notices the connection lost by itself
+	ssh := []string{"ssh", "-T", "-o", "BatchMode=yes", "-o", "ServerAliveInterval=15", "-o", "ServerAliveCountMax=3"}
+	for _, option := range cfg.SSHOptions {
+		ssh = append(ssh, "-o", option)
+	}
+	remote := "sh -c " + shellQuote(sshWrapper) + " kelthuzad " + shellQuote(command) + " " + strconv.Itoa(cfg.Grace)
+	return append(ssh, cfg.SSH, remote)
+}
+
+// shellQuote quotes s as a word of a POSIX shell, which the remote one is regardless of the local platform.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
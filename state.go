@@ -0,0 +1,170 @@
+package kelthuzad
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+)
+
+// offsetsFile is the file of the offsets in the state dir.
+const offsetsFile = "offsets.json"
+
+// headSize is how many bytes of the head of a file its identity has the checksum of.
+const headSize = 64
+
+// fileID is the identity of a file, which stays the same while it's moved and differs from the one recreated at its path.
+// It's zero where it's unknown.
+type fileID struct {
+	Dev uint64 `json:"dev"`
+	Ino uint64 `json:"ino"`
+	// Head is the checksum of the first HeadSize bytes, which tells the file reusing the inode of a deleted one
+	Head     uint32 `json:"head"`
+	HeadSize int    `json:"headSize"`
+}
+
+// identifyPath returns the identity of the file at path, which is zero if it's unknown.
+func identifyPath(path string) fileID {
+	f, err := os.Open(path)
+	if err != nil {
+		return fileID{}
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fileID{}
+	}
+	id, ok := identify(info)
+	if !ok {
+		return fileID{}
+	}
+
+	id.Head, id.HeadSize = checksumHead(f, headSize)
+	return id
+}
+
+// is reports whether the file at path is of id, as far as the head id has the checksum of.
+func (id fileID) is(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	other, ok := identify(info)
+	if !ok || other.Dev != id.Dev || other.Ino != id.Ino {
+		return false
+	}
+
+	sum, n := checksumHead(f, id.HeadSize)
+	return n == id.HeadSize && sum == id.Head
+}
+
+// checksumHead returns the checksum of the first size bytes of f, and how many of them it has.
+func checksumHead(f *os.File, size int) (uint32, int) {
+	head := make([]byte, size)
+	n, _ := f.ReadAt(head, 0)
+	return crc32.ChecksumIEEE(head[:n]), n
+}
+
+// checkpoint is where a log was read up to: the offset of the next line in the file of the identity.
+type checkpoint struct {
+	fileID
+	Offset int64 `json:"offset"`
+}
+
+// offsets are the checkpoints of the logs by their paths, which are kept in the state dir across the restarts of kelthuzad.
+// They're used by one goroutine.
+type offsets struct {
+	path  string
+	byLog map[string]checkpoint
+	dirty bool
+}
+
+// loadOffsets loads the offsets kept in dir, which are nil without dir.
+func loadOffsets(dir string) (*offsets, error) {
+	if dir == "" {
+		return nil, nil
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	o := &offsets{path: filepath.Join(dir, offsetsFile), byLog: make(map[string]checkpoint)}
+	b, err := os.ReadFile(o.path)
+	if os.IsNotExist(err) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &o.byLog)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", o.path, err)
+	}
+	return o, nil
+}
+
+// get returns the checkpoint of the log at path, and whether it's kept.
+func (o *offsets) get(path string) (checkpoint, bool) {
+	if o == nil {
+		return checkpoint{}, false
+	}
+	c, ok := o.byLog[path]
+	return c, ok
+}
+
+// set sets the checkpoint of the log at path, which is saved later.
+func (o *offsets) set(path string, c checkpoint) {
+	if o == nil || o.byLog[path] == c {
+		return
+	}
+	o.byLog[path] = c
+	o.dirty = true
+}
+
+// save writes the offsets if they're changed since saved, replacing the file at once not to leave it half written.
+func (o *offsets) save() error {
+	if o == nil || !o.dirty {
+		return nil
+	}
+
+	b, err := json.Marshal(o.byLog)
+	if err != nil {
+		return err
+	}
+	tmp := o.path + ".tmp"
+	err = os.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, o.path)
+	if err != nil {
+		return err
+	}
+	o.dirty = false
+	return nil
+}
+
+// findRotated returns the path of the file of id in the directory of the log at path, which it's rotated to, or empty if it's gone.
+func findRotated(path string, id fileID) string {
+	dir := filepath.Dir(path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		if rotated := filepath.Join(dir, entry.Name()); id.is(rotated) {
+			return rotated
+		}
+	}
+	return ""
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+
+package kelthuzad
+
+import (
+	"os"
+	"syscall"
+)
+
+// canIdentify tells whether the files can be identified.
+const canIdentify = true
+
+// identify returns the identity of the file of info, which is the device and the inode.
+func identify(info os.FileInfo) (fileID, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, false
+	}
+	return fileID{Dev: uint64(st.Dev), Ino: uint64(st.Ino)}, true
+}
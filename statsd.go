@@ -0,0 +1,172 @@
+package kelthuzad
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsdPacket is the bytes of a datagram to statsd, which fits in the MTU of Ethernet.
+const statsdPacket = 1432
+
+// statsd sums up the restarts by the cause and the matches by the pattern, and sends them with the uptime of the process
+// to a statsd server every interval over UDP, tagged in the format of DogStatsD.
+type statsd struct {
+	addr   string
+	prefix string
+	tags   string
+	every  time.Duration
+
+	mu       sync.Mutex
+	restarts map[string]int
+	matches  map[patternKey]int
+}
+
+// newStatsd returns the statsd of cfg.StatsdAddr for the process of name, or nil without it.
+func newStatsd(cfg *Config, name string) (*statsd, error) {
+	if cfg.StatsdAddr == "" {
+		return nil, nil
+	}
+
+	tags := []string{"service:" + tagEscaper.Replace(name)}
+	for _, tag := range cfg.StatsdTags {
+		if tag == "" || strings.ContainsAny(tag, "|,#\n") {
+			return nil, fmt.Errorf("kelthuzad: StatsdTags %q must be key:value or key without |, # nor a comma", tag)
+		}
+		tags = append(tags, tag)
+	}
+	return &statsd{
+		addr:   cfg.StatsdAddr,
+		prefix: cfg.StatsdPrefix,
+		tags:   strings.Join(tags, ","),
+		every:  time.Duration(cfg.StatsdInterval) * time.Second,
+	}, nil
+}
+
+// tagEscaper replaces what can't be in a value of a tag of DogStatsD.
+var tagEscaper = strings.NewReplacer("|", "_", ",", "_", "#", "_", "\n", "_", "\r", "_")
+
+// matched counts a match of pattern of kind.
+func (s *statsd) matched(kind string, pattern string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.matches == nil {
+		s.matches = make(map[patternKey]int)
+	}
+	s.matches[patternKey{kind, pattern}]++
+}
+
+// restarted counts a restart of cause.
+func (s *statsd) restarted(cause string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.restarts == nil {
+		s.restarts = make(map[string]int)
+	}
+	s.restarts[cause]++
+}
+
+// lines returns the metrics of the counts since the last time, which are reset, and the uptime in seconds.
+func (s *statsd) lines(uptime int) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var lines []string
+	for cause, n := range s.restarts {
+		lines = append(lines, fmt.Sprintf("%vrestart.count:%v|c|#%v,cause:%v", s.prefix, n, s.tags, tagEscaper.Replace(cause)))
+	}
+	for key, n := range s.matches {
+		lines = append(lines, fmt.Sprintf("%vmatch.count:%v|c|#%v,kind:%v,pattern:%v", s.prefix, n, s.tags, key.kind, tagEscaper.Replace(key.pattern)))
+	}
+	sort.Strings(lines)
+	lines = append(lines, fmt.Sprintf("%vchild.uptime:%v|g|#%v", s.prefix, uptime, s.tags))
+	s.restarts = nil
+	s.matches = nil
+	return lines
+}
+
+// emitStatsd sends the metrics to statsd every StatsdInterval seconds until ctx is done, and once more on the way out.
+// A failing server is told once until it works again, and the counts of the lost datagrams are gone with them.
+func (w *Watchdog) emitStatsd(ctx context.Context) {
+	s := w.statsd
+	if s == nil {
+		return
+	}
+
+	ticker := time.NewTicker(s.every)
+	defer ticker.Stop()
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	var failing bool
+	for {
+		var done bool
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			done = true
+		}
+
+		var err error
+		if conn == nil {
+			conn, err = net.Dial("udp", s.addr)
+		}
+		if err == nil {
+			err = sendStatsd(conn, s.lines(w.status().Uptime))
+		}
+		switch {
+		case err != nil && !failing:
+			w.log.logf("SYSTEM", record{Level: "warn", Event: "statsd"}, "statsd %v, retrying every %v", err, s.every)
+			failing = true
+		case err == nil && failing:
+			w.log.logf("SYSTEM", record{Level: "info", Event: "statsd"}, "sending to statsd %v again", s.addr)
+			failing = false
+		}
+		if err != nil && conn != nil {
+			// dial again by the next interval
+			conn.Close()
+			conn = nil
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// sendStatsd writes lines to conn, as many in a datagram as fit.
+func sendStatsd(conn net.Conn, lines []string) error {
+	var packet []byte
+	for i, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > statsdPacket {
+			_, err := conn.Write(packet)
+			if err != nil {
+				return err
+			}
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+		if i == len(lines)-1 {
+			_, err := conn.Write(packet)
+			return err
+		}
+	}
+	return nil
+}
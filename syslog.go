@@ -0,0 +1,295 @@
+package kelthuzad
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// syslogRetry is how long to wait before accepting again when accepting a connection fails.
+const syslogRetry = time.Second
+
+// syslogMaxDatagram is the largest message of syslog over UDP.
+const syslogMaxDatagram = 65535
+
+// syslogServer receives syslog on the address of SyslogListen over both UDP and TCP.
+type syslogServer struct {
+	packet net.PacketConn
+	stream net.Listener
+}
+
+// listenSyslog listens on w.config().SyslogListen over UDP and TCP.
+func (w *Watchdog) listenSyslog() (*syslogServer, error) {
+	packet, err := net.ListenPacket("udp", w.config().SyslogListen)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := net.Listen("tcp", w.config().SyslogListen)
+	if err != nil {
+		packet.Close()
+		return nil, err
+	}
+
+	return &syslogServer{packet: packet, stream: stream}, nil
+}
+
+// syslogMessage is a message of syslog, which is from the app of the host.
+type syslogMessage struct {
+	host string
+	app  string
+	pid  string
+	text string
+}
+
+// lines returns the lines of m prefixed by its source as "host app[pid]: ", so the pattern can tell the sources apart.
+func (m syslogMessage) lines() []string {
+	prefix := m.host
+	if m.app != "" {
+		prefix += " " + m.app
+		if m.pid != "" {
+			prefix += "[" + m.pid + "]"
+		}
+	}
+	prefix += ": "
+
+	var lines []string
+	for _, line := range strings.Split(strings.TrimRight(m.text, "\r\n"), "\n") {
+		lines = append(lines, prefix+strings.TrimSuffix(line, "\r"))
+	}
+	return lines
+}
+
+// monitorSyslog checks each line of the messages received by w.syslog until ctx is done.
+func (w *Watchdog) monitorSyslog(ctx context.Context) {
+	w.log.logf("SYSTEM", record{Level: "info", Event: "monitor"}, "monitoring syslog on %v...", w.config().SyslogListen)
+
+	// every connection sends its messages into one channel, so that the lines are checked one by one
+	messages := make(chan syslogMessage)
+	go w.receiveSyslog(ctx, messages)
+	go w.acceptSyslog(ctx, messages)
+	for {
+		select {
+		case m := <-messages:
+			for _, line := range m.lines() {
+				if len(line) > w.config().MaxLineSize {
+					w.log.logf("SYSTEM", record{Level: "warn", Event: "truncate"}, "a line over %v bytes is truncated", w.config().MaxLineSize)
+					line = line[:w.config().MaxLineSize]
+				}
+				w.check(ctx, cleanLine(w.config(), line))
+			}
+		case <-ctx.Done():
+			w.syslog.packet.Close()
+			w.syslog.stream.Close()
+			return
+		}
+	}
+}
+
+// receiveSyslog sends the messages over UDP, each of which is a datagram, until ctx is done.
+func (w *Watchdog) receiveSyslog(ctx context.Context, messages chan<- syslogMessage) {
+	buf := make([]byte, syslogMaxDatagram)
+	for {
+		n, addr, err := w.syslog.packet.ReadFrom(buf)
+		if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			w.log.logf("SYSTEM", record{Level: "warn", Event: "syslog"}, "receive %v", err)
+			continue
+		}
+
+		select {
+		case messages <- parseSyslog(string(buf[:n]), addrHost(addr)):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// acceptSyslog serves every connection over TCP until ctx is done.
+func (w *Watchdog) acceptSyslog(ctx context.Context, messages chan<- syslogMessage) {
+	for {
+		conn, err := w.syslog.stream.Accept()
+		if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			w.log.logf("SYSTEM", record{Level: "warn", Event: "syslog"}, "accept %v", err)
+			if !sleep(ctx, syslogRetry) {
+				return
+			}
+			continue
+		}
+
+		go w.readSyslog(ctx, conn, messages)
+	}
+}
+
+// readSyslog sends the messages of conn until it's closed or ctx is done.
+func (w *Watchdog) readSyslog(ctx context.Context, conn net.Conn, messages chan<- syslogMessage) {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	from := addrHost(conn.RemoteAddr())
+	reader := newLineReader(conn, w.config().MaxLineSize)
+	for {
+		text, err := reader.nextFrame()
+		if err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				w.log.logf("SYSTEM", record{Level: "warn", Event: "syslog"}, "read from %v %v", from, err)
+			}
+			return
+		}
+
+		select {
+		case messages <- parseSyslog(text, from):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// nextFrame returns the next message, which is framed by its length in octets and a space before it as RFC 6587 does,
+// or by a newline as the older senders do.
+func (l *lineReader) nextFrame() (string, error) {
+	b, err := l.r.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	if b[0] < '0' || b[0] > '9' {
+		line, _, err := l.next()
+		return line, err
+	}
+
+	length, err := l.r.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+	if err != nil {
+		return "", fmt.Errorf("malformed frame length %q", length)
+	}
+
+	// keep up to max, and skip the rest of the message
+	keep := n
+	if keep > l.max {
+		keep = l.max
+	}
+	msg := make([]byte, keep)
+	_, err = io.ReadFull(l.r, msg)
+	if err == nil {
+		_, err = l.r.Discard(n - keep)
+	}
+	return string(msg), err
+}
+
+// addrHost returns the host of addr.
+func addrHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// parseSyslog parses msg of RFC 5424 or RFC 3164, which is from the host unless msg tells its own.
+// The priority is dropped, and the pattern matches the severity in the text if need be.
+func parseSyslog(msg string, host string) syslogMessage {
+	m := syslogMessage{host: host}
+	if strings.HasPrefix(msg, "<") {
+		if i := strings.IndexByte(msg, '>'); i > 0 && i <= 4 {
+			msg = msg[i+1:]
+		}
+	}
+
+	if strings.HasPrefix(msg, "1 ") {
+		parse5424(msg[2:], &m)
+	} else {
+		parse3164(msg, &m)
+	}
+	return m
+}
+
+// parse5424 parses msg after the version as RFC 5424 does into m, which is
+// TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG, and - is a nil value.
+func parse5424(msg string, m *syslogMessage) {
+	fields := strings.SplitN(msg, " ", 6)
+	if len(fields) < 6 {
+		m.text = msg
+		return
+	}
+	if fields[1] != "-" {
+		m.host = fields[1]
+	}
+	if fields[2] != "-" {
+		m.app = fields[2]
+	}
+	if fields[3] != "-" {
+		m.pid = fields[3]
+	}
+
+	// skip the structured data, whose values can have ] escaped by \ in the quotes
+	rest := fields[5]
+	if strings.HasPrefix(rest, "-") {
+		rest = rest[1:]
+	} else {
+		quoted := false
+		i := 0
+	elements:
+		for ; i < len(rest); i++ {
+			switch c := rest[i]; {
+			case c == '\\' && quoted:
+				i++
+			case c == '"':
+				quoted = !quoted
+			case c == ']' && !quoted && (i+1 == len(rest) || rest[i+1] != '['):
+				i++
+				break elements
+			}
+		}
+		rest = rest[i:]
+	}
+	m.text = strings.TrimPrefix(strings.TrimPrefix(rest, " "), "\ufeff")
+}
+
+// parse3164 parses msg as RFC 3164 does into m, which is TIMESTAMP HOSTNAME TAG[PID]: MSG.
+// The senders often drop the timestamp and the hostname, and what's left is the message then.
+func parse3164(msg string, m *syslogMessage) {
+	if len(msg) > 16 && msg[15] == ' ' {
+		if _, err := time.Parse(time.Stamp, msg[:15]); err == nil {
+			msg = msg[16:]
+
+			// the tag can come right after the timestamp
+			if i := strings.IndexByte(msg, ' '); i > 0 && !strings.ContainsAny(msg[:i], "[:") {
+				m.host = msg[:i]
+				msg = msg[i+1:]
+			}
+		}
+	}
+
+	m.text = msg
+	i := strings.IndexAny(msg, "[: ")
+	if i <= 0 {
+		return
+	}
+	app, pid, rest := msg[:i], "", msg[i:]
+	if rest[0] == '[' {
+		j := strings.IndexByte(rest, ']')
+		if j < 0 {
+			return
+		}
+		pid, rest = rest[1:j], rest[j+1:]
+	}
+	if !strings.HasPrefix(rest, ":") {
+		return
+	}
+	m.app, m.pid, m.text = app, pid, strings.TrimPrefix(rest[1:], " ")
+}
@@ -0,0 +1,262 @@
+package kelthuzad
+
+import (
+	"context"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// teeQueue is the lines queued for a tee target, over which they're dropped rather than blocking the monitoring.
+const teeQueue = 1024
+
+// teeWriter writes the lines to a tee target.
+type teeWriter interface {
+	// write writes line, connecting to the target again if it's been lost.
+	write(line string) error
+	// close closes the target, which is connected again by the next write.
+	close() error
+}
+
+// tee copies the lines of the output to a target, which is shipped in the background.
+type tee struct {
+	spec   string
+	writer teeWriter
+	lines  chan string
+
+	mu      sync.Mutex
+	dropped int
+}
+
+// newTees returns the tees of cfg.Tee for the process of name.
+func newTees(cfg *Config, name string) ([]*tee, error) {
+	var tees []*tee
+	for _, spec := range cfg.Tee {
+		writer, err := newTeeWriter(spec, name)
+		if err != nil {
+			return nil, fmt.Errorf("kelthuzad: Tee: %w", err)
+		}
+		tees = append(tees, &tee{spec: spec, writer: writer, lines: make(chan string, teeQueue)})
+	}
+	return tees, nil
+}
+
+// newTeeWriter returns the writer of spec, which is file:PATH, udp:HOST:PORT, tcp:HOST:PORT,
+// syslog:udp://HOST:PORT, syslog:tcp://HOST:PORT or kafka:BROKER[,BROKER...]/TOPIC.
+func newTeeWriter(spec string, name string) (teeWriter, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch {
+	case arg == "":
+	case kind == "file":
+		return &fileTee{path: arg}, nil
+	case kind == "udp" || kind == "tcp":
+		return &netTee{network: kind, addr: arg}, nil
+	case kind == "syslog":
+		u, err := url.Parse(arg)
+		if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+			return nil, fmt.Errorf("%v must be syslog:udp://HOST:PORT or syslog:tcp://HOST:PORT", spec)
+		}
+		host, _ := os.Hostname()
+		return &netTee{network: u.Scheme, addr: u.Host, syslog: true, host: host, app: name, pid: os.Getpid()}, nil
+	case kind == "kafka":
+		brokers, topic, ok := strings.Cut(arg, "/")
+		if !ok || brokers == "" || topic == "" {
+			return nil, fmt.Errorf("%v must be kafka:BROKER[,BROKER...]/TOPIC", spec)
+		}
+		return newKafkaTee(strings.Split(brokers, ","), topic), nil
+	}
+	return nil, fmt.Errorf("%v must be file:PATH, udp:HOST:PORT, tcp:HOST:PORT, syslog:udp://HOST:PORT, syslog:tcp://HOST:PORT or kafka:BROKERS/TOPIC", spec)
+}
+
+// copyLine queues line for every tee, dropping it for the ones which can't keep up.
+func (w *Watchdog) copyLine(line string) {
+	for _, t := range w.tees {
+		select {
+		case t.lines <- line:
+		default:
+			t.mu.Lock()
+			t.dropped++
+			t.mu.Unlock()
+		}
+	}
+}
+
+// runTees ships the lines queued for every tee until ctx is done, then closes the targets.
+func (w *Watchdog) runTees(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, t := range w.tees {
+		wg.Add(1)
+		go func(t *tee) {
+			defer wg.Done()
+			w.ship(ctx, t)
+		}(t)
+	}
+	wg.Wait()
+}
+
+// ship writes the lines queued for t until ctx is done.
+// A failing target is told once until it works again, which is when the lines dropped meanwhile are told as well.
+func (w *Watchdog) ship(ctx context.Context, t *tee) {
+	defer t.writer.close()
+
+	var failing bool
+	for {
+		select {
+		case line := <-t.lines:
+			err := t.writer.write(line)
+			t.mu.Lock()
+			if err != nil {
+				t.dropped++
+			}
+			dropped := t.dropped
+			if err == nil {
+				t.dropped = 0
+			}
+			t.mu.Unlock()
+
+			switch {
+			case err != nil && !failing:
+				w.log.logf("SYSTEM", record{Level: "warn", Event: "tee"}, "tee %v %v, dropping the lines until it works again", t.spec, err)
+				failing = true
+			case err == nil && dropped > 0:
+				w.log.logf("SYSTEM", record{Level: "warn", Event: "tee"}, "dropped %v lines for %v", dropped, t.spec)
+				failing = false
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fileTee appends the lines to a file.
+type fileTee struct {
+	path string
+	f    *os.File
+}
+
+func (t *fileTee) write(line string) error {
+	if t.f == nil {
+		f, err := os.OpenFile(t.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		t.f = f
+	}
+	_, err := t.f.WriteString(line + "\n")
+	return err
+}
+
+func (t *fileTee) close() error {
+	if t.f == nil {
+		return nil
+	}
+	err := t.f.Close()
+	t.f = nil
+	return err
+}
+
+// netTee sends the lines over UDP, each as a datagram, or over TCP, each ended by a newline.
+// As syslog, a line is the message of RFC 5424, which is framed by its length over TCP.
+type netTee struct {
+	network string
+	addr    string
+	syslog  bool
+	host    string
+	app     string
+	pid     int
+	conn    net.Conn
+}
+
+func (t *netTee) write(line string) error {
+	if t.conn == nil {
+		conn, err := net.DialTimeout(t.network, t.addr, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		t.conn = conn
+	}
+
+	msg := line
+	if t.syslog {
+		// user.info
+		msg = fmt.Sprintf("<14>1 %v %v %v %v - - %v", time.Now().Format(time.RFC3339Nano), t.host, t.app, t.pid, line)
+	}
+	switch {
+	case t.network == "udp":
+	case t.syslog:
+		msg = fmt.Sprintf("%v %v", len(msg), msg)
+	default:
+		msg += "\n"
+	}
+
+	t.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := t.conn.Write([]byte(msg))
+	if err != nil {
+		// connect again by the next line
+		t.close()
+	}
+	return err
+}
+
+func (t *netTee) close() error {
+	if t.conn == nil {
+		return nil
+	}
+	err := t.conn.Close()
+	t.conn = nil
+	return err
+}
+
+// kafkaTee produces the lines to a topic of Kafka in batches, whose failure is reported by the next write.
+type kafkaTee struct {
+	brokers []string
+	topic   string
+	writer  *kafka.Writer
+
+	mu  sync.Mutex
+	err error
+}
+
+func newKafkaTee(brokers []string, topic string) *kafkaTee {
+	return &kafkaTee{brokers: brokers, topic: topic}
+}
+
+func (t *kafkaTee) write(line string) error {
+	if t.writer == nil {
+		t.writer = &kafka.Writer{
+			Addr:         kafka.TCP(t.brokers...),
+			Topic:        t.topic,
+			Balancer:     &kafka.LeastBytes{},
+			BatchTimeout: 100 * time.Millisecond,
+			Async:        true,
+			Completion: func(messages []kafka.Message, err error) {
+				t.mu.Lock()
+				t.err = err
+				t.mu.Unlock()
+			},
+		}
+	}
+
+	t.mu.Lock()
+	err := t.err
+	t.err = nil
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return t.writer.WriteMessages(context.Background(), kafka.Message{Value: []byte(line)})
+}
+
+func (t *kafkaTee) close() error {
+	if t.writer == nil {
+		return nil
+	}
+	err := t.writer.Close()
+	t.writer = nil
+	return err
+}
@@ -0,0 +1,190 @@
+package kelthuzad
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// telemetry exports a restart cycle of the detection, the kill, the backoff, the spawn and the readiness as a trace,
+// and the restarts and how long they took as the metrics, by OTLP over HTTP.
+type telemetry struct {
+	traces   *sdktrace.TracerProvider
+	meters   *sdkmetric.MeterProvider
+	tracer   trace.Tracer
+	restarts metric.Int64Counter
+	duration metric.Float64Histogram
+
+	mu    sync.Mutex
+	cycle *cycle
+}
+
+// cycle is the restart being traced, whose stage is the child span going on.
+type cycle struct {
+	ctx   context.Context
+	span  trace.Span
+	stage trace.Span
+	cause string
+	began time.Time
+}
+
+// newTelemetry returns the telemetry of the process of name exporting to cfg.OTLPEndpoint, or nil without it.
+func newTelemetry(cfg *Config, name string) (*telemetry, error) {
+	if cfg.OTLPEndpoint == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(cfg.OTLPEndpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("kelthuzad: OTLPEndpoint %v must be http://HOST:PORT or https://HOST:PORT", cfg.OTLPEndpoint)
+	}
+	headers := make(map[string]string)
+	for _, header := range cfg.OTLPHeaders {
+		key, value, ok := strings.Cut(header, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("kelthuzad: OTLPHeaders %v isn't name=value", header)
+		}
+		headers[key] = value
+	}
+	base := strings.TrimSuffix(u.Path, "/")
+
+	traceOpts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host), otlptracehttp.WithURLPath(base + "/v1/traces"), otlptracehttp.WithHeaders(headers)}
+	metricOpts := []otlpmetrichttp.Option{otlpmetrichttp.WithEndpoint(u.Host), otlpmetrichttp.WithURLPath(base + "/v1/metrics"), otlpmetrichttp.WithHeaders(headers)}
+	if u.Scheme == "http" {
+		traceOpts = append(traceOpts, otlptracehttp.WithInsecure())
+		metricOpts = append(metricOpts, otlpmetrichttp.WithInsecure())
+	}
+	// the exporters connect on the first export
+	traceExporter, err := otlptracehttp.New(context.Background(), traceOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("kelthuzad: otlptracehttp: %w", err)
+	}
+	metricExporter, err := otlpmetrichttp.New(context.Background(), metricOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("kelthuzad: otlpmetrichttp: %w", err)
+	}
+
+	res := resource.NewSchemaless(attribute.String("service.name", name))
+	t := &telemetry{
+		traces: sdktrace.NewTracerProvider(sdktrace.WithBatcher(traceExporter), sdktrace.WithResource(res)),
+		meters: sdkmetric.NewMeterProvider(sdkmetric.WithResource(res), sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter,
+			sdkmetric.WithInterval(time.Duration(cfg.OTLPInterval)*time.Second)))),
+	}
+	t.tracer = t.traces.Tracer("kelthuzad")
+	meter := t.meters.Meter("kelthuzad")
+	t.restarts, err = meter.Int64Counter("kelthuzad.restarts", metric.WithDescription("The number of the restarts by the cause."))
+	if err != nil {
+		return nil, err
+	}
+	t.duration, err = meter.Float64Histogram("kelthuzad.restart.duration", metric.WithUnit("s"),
+		metric.WithDescription("The seconds from the detection to the respawned process getting ready, by the cause and the outcome."))
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// begin begins tracing the restart of the process of pid for reason classified as cause by line matching pattern.
+// The cycle going on is ended as an interrupted one.
+func (t *telemetry) begin(reason string, cause string, pid int, line string, pattern string) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.finish(errors.New("interrupted by another restart"))
+	attrs := []attribute.KeyValue{attribute.String("kelthuzad.reason", reason), attribute.String("kelthuzad.cause", cause), attribute.Int("process.pid", pid)}
+	if line != "" {
+		attrs = append(attrs, attribute.String("kelthuzad.line", line))
+	}
+	if pattern != "" {
+		attrs = append(attrs, attribute.String("kelthuzad.pattern", pattern))
+	}
+	ctx, span := t.tracer.Start(context.Background(), "restart", trace.WithAttributes(attrs...))
+	t.cycle = &cycle{ctx: ctx, span: span, cause: cause, began: time.Now()}
+	t.restarts.Add(context.Background(), 1, metric.WithAttributes(attribute.String("cause", cause)))
+}
+
+// stage ends the stage going on and begins the one of name, unless no restart is being traced.
+func (t *telemetry) stage(name string, attrs ...attribute.KeyValue) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := t.cycle
+	if c == nil {
+		return
+	}
+	if c.stage != nil {
+		c.stage.End()
+	}
+	_, c.stage = t.tracer.Start(c.ctx, name, trace.WithAttributes(attrs...))
+}
+
+// end ends the restart being traced, which failed by err unless it's nil, and records how long it took.
+func (t *telemetry) end(err error) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.finish(err)
+}
+
+// finish ends the restart being traced by err as end does.
+// t.mu must be held.
+func (t *telemetry) finish(err error) {
+	c := t.cycle
+	if c == nil {
+		return
+	}
+	t.cycle = nil
+
+	outcome := "ready"
+	if err != nil {
+		outcome = "failed"
+		for _, span := range []trace.Span{c.stage, c.span} {
+			if span != nil {
+				span.SetStatus(codes.Error, err.Error())
+			}
+		}
+	}
+	if c.stage != nil {
+		c.stage.End()
+	}
+	c.span.End()
+	t.duration.Record(context.Background(), time.Since(c.began).Seconds(), metric.WithAttributes(attribute.String("cause", c.cause), attribute.String("outcome", outcome)))
+}
+
+// shutdown exports what's left, waiting up to a few seconds.
+func (t *telemetry) shutdown() {
+	if t == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	t.end(errors.New("kelthuzad stopped"))
+	t.traces.Shutdown(ctx)
+	t.meters.Shutdown(ctx)
+}
@@ -0,0 +1,178 @@
+package kelthuzad
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// templateData is what the templates of the hooks and the notifications can refer to, such as {{.MatchedLine}}.
+type templateData struct {
+	Type         string
+	Service      string
+	Host         string
+	Pid          int
+	Pod          string
+	Cause        string
+	MatchedLine  string
+	Pattern      string
+	Captures     map[string]string
+	Context      []string
+	RestartCount int
+	Timestamp    time.Time
+}
+
+// newTemplateData returns what the templates refer to about e.
+func newTemplateData(e event) templateData {
+	host, _ := os.Hostname()
+	return templateData{
+		Type:         e.Type,
+		Service:      e.Service,
+		Host:         host,
+		Pid:          e.Pid,
+		Pod:          e.Pod,
+		Cause:        e.Cause,
+		MatchedLine:  e.Line,
+		Pattern:      e.Pattern,
+		Captures:     e.Captures,
+		Context:      e.Context,
+		RestartCount: e.Restarts,
+		Timestamp:    e.Timestamp,
+	}
+}
+
+// templateFuncs are the functions of the templates besides the builtin ones.
+// quote quotes a value for the shell, which the commands do to every value by themselves.
+var templateFuncs = template.FuncMap{
+	"quote": quoteArg,
+	"join":  strings.Join,
+}
+
+// parseTemplate parses text of the template of name, which is nil if text is empty,
+// and catches a reference to what doesn't exist by executing it once.
+func parseTemplate(name string, text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+
+	t, err := template.New(name).Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err == nil {
+		_, err = render(t, event{Captures: map[string]string{}})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("kelthuzad: %v: %w", name, err)
+	}
+	return t, nil
+}
+
+// render executes t with e.
+func render(t *template.Template, e event) (string, error) {
+	var out strings.Builder
+	err := t.Execute(&out, newTemplateData(e))
+	return out.String(), err
+}
+
+// renderCommand returns the command string of a hook with e filled in, which is as it is unless it has a template,
+// and the environment variables holding the values filled in.
+// Every value is filled in as the reference to its variable, which the shell expands to a word without running what's in it,
+// and a value within the quotes of the command is an error, where the reference would be a part of the string.
+func renderCommand(name string, command string, e event) (string, []string, error) {
+	if !strings.Contains(command, "{{") {
+		return command, nil, nil
+	}
+
+	var env []string
+	t, err := template.New(name).Funcs(templateFuncs).Funcs(template.FuncMap{
+		// the reference is a word already
+		"quote": func(s string) string {
+			return s
+		},
+		"valueRef": func(v interface{}) string {
+			name := "KELTHUZAD_VALUE_" + strconv.Itoa(len(env)+1)
+			env = append(env, name+"="+fmt.Sprint(v))
+			return valueRef(name)
+		},
+	}).Option("missingkey=zero").Parse(command)
+	if err == nil {
+		for _, tt := range t.Templates() {
+			err = refValues(command, tt.Tree.Root)
+			if err != nil {
+				break
+			}
+		}
+	}
+	var out string
+	if err == nil {
+		out, err = render(t, e)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("kelthuzad: %v: %w", name, err)
+	}
+	return out, env, nil
+}
+
+// refValues pipes every action under node of command printing a value to valueRef,
+// unless it's within the quotes of command.
+func refValues(command string, node parse.Node) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, child := range n.Nodes {
+			err := refValues(command, child)
+			if err != nil {
+				return err
+			}
+		}
+	case *parse.IfNode:
+		return refBranch(command, &n.BranchNode)
+	case *parse.RangeNode:
+		return refBranch(command, &n.BranchNode)
+	case *parse.WithNode:
+		return refBranch(command, &n.BranchNode)
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) > 0 || len(n.Pipe.Cmds) == 0 {
+			return nil
+		}
+		start := strings.LastIndex(command[:n.Pos], "{{")
+		if withinQuotes(literalBefore(command, start)) {
+			return fmt.Errorf("%v at %v is within quotes, where a value can't be filled in as a word", n, start)
+		}
+		n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{NodeType: parse.NodeCommand, Pos: n.Pos, Args: []parse.Node{parse.NewIdentifier("valueRef").SetPos(n.Pos)}})
+	}
+	return nil
+}
+
+// refBranch pipes the actions of both the lists of n as refValues does.
+func refBranch(command string, n *parse.BranchNode) error {
+	err := refValues(command, n.List)
+	if err == nil {
+		err = refValues(command, n.ElseList)
+	}
+	return err
+}
+
+// literalBefore returns the text of command before the action at pos without the other actions,
+// which is what the shell parses up to there.
+func literalBefore(command string, pos int) string {
+	var b strings.Builder
+	for i := 0; i < pos; {
+		open := strings.Index(command[i:pos], "{{")
+		if open < 0 {
+			b.WriteString(command[i:pos])
+			break
+		}
+		b.WriteString(command[i : i+open])
+		end := strings.Index(command[i+open:], "}}")
+		if end < 0 || i+open+end >= pos {
+			break
+		}
+		i += open + end + len("}}")
+	}
+	return b.String()
+}
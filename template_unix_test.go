@@ -0,0 +1,102 @@
+//go:build !windows
+
+package kelthuzad
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRenderCommand(t *testing.T) {
+	e := event{Service: "web", Pid: 7, Line: "error: 500", Captures: map[string]string{"code": "500"}, Context: []string{"a", "b"}}
+	tests := []struct {
+		name     string
+		command  string
+		want     string
+		wantVars []string
+	}{
+		{"no template", `echo "hi"`, `echo "hi"`, nil},
+		{"values", `report {{.Service}} {{.Pid}} {{.Captures.code}}`, `report "${KELTHUZAD_VALUE_1}" "${KELTHUZAD_VALUE_2}" "${KELTHUZAD_VALUE_3}"`,
+			[]string{"KELTHUZAD_VALUE_1=web", "KELTHUZAD_VALUE_2=7", "KELTHUZAD_VALUE_3=500"}},
+		{"quote", `report {{quote .MatchedLine}}`, `report "${KELTHUZAD_VALUE_1}"`, []string{"KELTHUZAD_VALUE_1=error: 500"}},
+		{"join", `report {{join .Context ","}}`, `report "${KELTHUZAD_VALUE_1}"`, []string{"KELTHUZAD_VALUE_1=a,b"}},
+		{"range", `report{{range .Context}} {{.}}{{end}}`, `report "${KELTHUZAD_VALUE_1}" "${KELTHUZAD_VALUE_2}"`,
+			[]string{"KELTHUZAD_VALUE_1=a", "KELTHUZAD_VALUE_2=b"}},
+		{"if without a value", `report{{if .Pod}} {{.Pod}}{{end}}`, `report`, nil},
+		{"variable", `{{$line := .MatchedLine}}report {{$line}}`, `report "${KELTHUZAD_VALUE_1}"`, []string{"KELTHUZAD_VALUE_1=error: 500"}},
+		{"after quotes", `printf '%s\n' "it's" {{.Pid}}`, `printf '%s\n' "it's" "${KELTHUZAD_VALUE_1}"`, []string{"KELTHUZAD_VALUE_1=7"}},
+		{"after an escaped quote", `echo \"{{.Pid}}`, `echo \""${KELTHUZAD_VALUE_1}"`, []string{"KELTHUZAD_VALUE_1=7"}},
+		{"an option", `report --pid={{.Pid}}`, `report --pid="${KELTHUZAD_VALUE_1}"`, []string{"KELTHUZAD_VALUE_1=7"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, vars, err := renderCommand("PreRestart", tt.command, e)
+			if err != nil {
+				t.Fatalf("renderCommand(%q) error = %v", tt.command, err)
+			}
+			if got != tt.want || !reflect.DeepEqual(vars, tt.wantVars) {
+				t.Errorf("renderCommand(%q) = %q, %q, want %q, %q", tt.command, got, vars, tt.want, tt.wantVars)
+			}
+		})
+	}
+}
+
+func TestRenderCommandError(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		wantErr string
+	}{
+		{"within double quotes", `echo "line: {{.MatchedLine}}"`, "{{.MatchedLine}} at 12 is within quotes"},
+		{"within single quotes", `echo 'line: {{.MatchedLine}}'`, "{{.MatchedLine}} at 12 is within quotes"},
+		{"within quotes after another action", `echo {{.Pid}} "{{.Pid}}"`, "{{.Pid}} at 15 is within quotes"},
+		{"within quotes opened by a branch", `echo {{if .Pod}}"{{end}}{{.Pid}}"`, "{{.Pid}} at 24 is within quotes"},
+		{"within quotes of a range", `echo "{{range .Context}}{{.}}{{end}}"`, "{{.}} at 24 is within quotes"},
+		{"unknown field", `echo {{.Nothing}}`, "can't evaluate field Nothing"},
+		{"unterminated action", `echo {{.Pid`, "unclosed action"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := renderCommand("PreRestart", tt.command, event{})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("renderCommand(%q) error = %v, want %v", tt.command, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRenderCommandShell(t *testing.T) {
+	pwned := filepath.Join(t.TempDir(), "pwned")
+	lines := []string{
+		"boom $(touch " + pwned + ")",
+		"boom `touch " + pwned + "`",
+		"boom '; touch " + pwned + "; '",
+		`boom "; touch ` + pwned + `; "`,
+		"boom ${IFS} * ~ \\ %PATH% !x!",
+		"boom\ntouch " + pwned,
+	}
+	for _, line := range lines {
+		t.Run(line, func(t *testing.T) {
+			command, vars, err := renderCommand("PreRestart", `printf '%s|' {{.MatchedLine}} {{quote .MatchedLine}}`, event{Line: line})
+			if err != nil {
+				t.Fatalf("renderCommand() error = %v", err)
+			}
+			cmd := exec.Command("bash", "-c", command)
+			cmd.Env = append(os.Environ(), vars...)
+			out, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("bash -c %q error = %v", command, err)
+			}
+			if want := line + "|" + line + "|"; string(out) != want {
+				t.Errorf("bash -c %q = %q, want %q", command, out, want)
+			}
+			if _, err := os.Stat(pwned); err == nil {
+				t.Errorf("bash -c %q ran the line", command)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package kelthuzad
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// waitInterval is how often the conditions to wait for are checked again.
+const waitInterval = time.Second
+
+// waitFor waits until every file of WaitForFile exists and every port of WaitForPort accepts a connection
+// before spawning, and fails once they aren't there within WaitTimeout unless it's 0 or ctx is done.
+func (w *Watchdog) waitFor(ctx context.Context) error {
+	if len(w.config().WaitForFile) == 0 && len(w.config().WaitForPort) == 0 {
+		return nil
+	}
+
+	var deadline time.Time
+	if w.config().WaitTimeout > 0 {
+		deadline = time.Now().Add(time.Duration(w.config().WaitTimeout) * time.Second)
+	}
+	told := make(map[string]bool)
+	for {
+		missing := w.missing()
+		if missing == "" {
+			return nil
+		}
+		if !told[missing] {
+			told[missing] = true
+			w.log.logf("SYSTEM", record{Level: "info", Event: "wait"}, "waiting for %v before spawning...", missing)
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return fmt.Errorf("kelthuzad: waitFor: %v isn't there in %v seconds", missing, w.config().WaitTimeout)
+		}
+		if !sleep(ctx, waitInterval) {
+			return ctx.Err()
+		}
+	}
+}
+
+// missing returns the first of the files and the ports to wait for which isn't there, or "" if all are.
+func (w *Watchdog) missing() string {
+	for _, path := range w.config().WaitForFile {
+		_, err := os.Stat(path)
+		if err != nil {
+			return path
+		}
+	}
+	for _, addr := range w.config().WaitForPort {
+		conn, err := net.DialTimeout("tcp", addr, waitInterval)
+		if err != nil {
+			return addr
+		}
+		conn.Close()
+	}
+	return ""
+}